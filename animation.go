@@ -0,0 +1,247 @@
+package termimg
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// DEFAULT_FRAME_DELAY is the delay (in 100ths of a second) used for GIF frames without one, like browsers do
+const DEFAULT_FRAME_DELAY = 10
+
+// AnimatedImage is a multi-frame GIF image, played with the Kitty animation protocol. The embedded
+// TermImg holds the first frame, which is what other protocols display.
+type AnimatedImage struct {
+	*TermImg
+	frames []image.Image // fully composited frames
+	delays []int         // per frame delays in 100ths of a second
+	loops  int           // same as gif.GIF.LoopCount: 0 loops forever, -1 plays once
+}
+
+// OpenAnimated opens an animated GIF, decoding all of its frames with their delays and loop count
+func OpenAnimated(imagePath string) (*AnimatedImage, error) {
+	protocol := DetectProtocol()
+	if protocol == Unsupported {
+		return nil, fmt.Errorf("%w, supported protocols: %s", ErrNoProtocol, protocol.Supported())
+	}
+
+	imagePath, err := filepath.Abs(imagePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get absolute path for image: %s", err)
+	}
+	ai, err := decodeAnimated(imagePath)
+	if err != nil {
+		return nil, err
+	}
+	ai.protocol = protocol
+	return ai, nil
+}
+
+// Animate decodes all the frames of the image, an animated GIF opened with OpenLazy (Open rejects
+// GIF files), to play them with PlayAnimation. The animation keeps the image's options, and gets
+// its own Kitty image ID unless one was set with KittyImageID or CacheKey (see Clone).
+func (ti *TermImg) Animate() (*AnimatedImage, error) {
+	if ti.path == "" {
+		return nil, fmt.Errorf("the frames of an image not opened from a file can't be decoded")
+	}
+	if ti.format != "" && ti.format != "gif" {
+		return nil, fmt.Errorf("%s images can't be animated, only GIF", ti.format)
+	}
+	ai, err := decodeAnimated(ti.path)
+	if err != nil {
+		return nil, err
+	}
+	first := ai.img
+	ai.TermImg = ti.Clone()
+	ai.img, ai.format, ai.raw = first, "gif", nil
+	return ai, nil
+}
+
+// decodeAnimated decodes all the frames of the GIF file at imagePath
+func decodeAnimated(imagePath string) (*AnimatedImage, error) {
+	f, err := os.Open(imagePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open image: %s", err)
+	}
+	defer f.Close()
+
+	g, err := gif.DecodeAll(f)
+	if err != nil {
+		return nil, fmt.Errorf("%w as GIF: %s", ErrDecode, err)
+	}
+	ai := newAnimatedImage(g)
+	ai.path = imagePath
+	return ai, nil
+}
+
+// newAnimatedImage composites the frames of a GIF, as each frame only draws over the previous ones
+func newAnimatedImage(g *gif.GIF) *AnimatedImage {
+	ai := &AnimatedImage{loops: g.LoopCount}
+	canvas := image.NewNRGBA(image.Rect(0, 0, g.Config.Width, g.Config.Height))
+	for i, frame := range g.Image {
+		var previous *image.NRGBA
+		if i < len(g.Disposal) && g.Disposal[i] == gif.DisposalPrevious {
+			previous = image.NewNRGBA(canvas.Bounds())
+			copy(previous.Pix, canvas.Pix)
+		}
+		draw.Draw(canvas, frame.Bounds(), frame, frame.Bounds().Min, draw.Over)
+		composited := image.NewNRGBA(canvas.Bounds())
+		copy(composited.Pix, canvas.Pix)
+		ai.frames = append(ai.frames, composited)
+
+		delay := DEFAULT_FRAME_DELAY
+		if i < len(g.Delay) && g.Delay[i] > 1 {
+			delay = g.Delay[i]
+		}
+		ai.delays = append(ai.delays, delay)
+
+		switch {
+		case previous != nil:
+			canvas = previous
+		case i < len(g.Disposal) && g.Disposal[i] == gif.DisposalBackground:
+			draw.Draw(canvas, frame.Bounds(), image.Transparent, image.Point{}, draw.Src)
+		}
+	}
+	var first image.Image = image.NewNRGBA(image.Rect(0, 0, g.Config.Width, g.Config.Height))
+	if len(ai.frames) > 0 {
+		first = ai.frames[0]
+	}
+	ai.TermImg = &TermImg{img: &first, format: "gif"}
+	return ai
+}
+
+// Loops sets how many times the animation loops, with the same meaning as a GIF's
+// loop count (the default): 0 loops forever, -1 plays it once and n plays it n+1 times
+func (ai *AnimatedImage) Loops(n int) *AnimatedImage {
+	ai.loops = n
+	return ai
+}
+
+// The setters below shadow those of the embedded TermImg, so they can be chained with Loops
+
+// FillCells is like TermImg.FillCells, for the animation
+func (ai *AnimatedImage) FillCells(cols, rows int) *AnimatedImage {
+	ai.TermImg.FillCells(cols, rows)
+	return ai
+}
+
+// FitWidth is like TermImg.FitWidth, for the animation
+func (ai *AnimatedImage) FitWidth(cols int) *AnimatedImage {
+	ai.TermImg.FitWidth(cols)
+	return ai
+}
+
+// FitHeight is like TermImg.FitHeight, for the animation
+func (ai *AnimatedImage) FitHeight(rows int) *AnimatedImage {
+	ai.TermImg.FitHeight(rows)
+	return ai
+}
+
+// Layer is like TermImg.Layer, for the animation
+func (ai *AnimatedImage) Layer(n int) *AnimatedImage {
+	ai.TermImg.Layer(n)
+	return ai
+}
+
+// PixelOffset is like TermImg.PixelOffset, for the animation
+func (ai *AnimatedImage) PixelOffset(x, y int) *AnimatedImage {
+	ai.TermImg.PixelOffset(x, y)
+	return ai
+}
+
+// Background is like TermImg.Background, for the animation
+func (ai *AnimatedImage) Background(c color.Color) *AnimatedImage {
+	ai.TermImg.Background(c)
+	return ai
+}
+
+// MaxPixels is like TermImg.MaxPixels, for the animation
+func (ai *AnimatedImage) MaxPixels(n int) *AnimatedImage {
+	ai.TermImg.MaxPixels(n)
+	return ai
+}
+
+// ResizeQuality is like TermImg.ResizeQuality, for the animation
+func (ai *AnimatedImage) ResizeQuality(q ResizeQuality) *AnimatedImage {
+	ai.TermImg.ResizeQuality(q)
+	return ai
+}
+
+// KittyImageID is like TermImg.KittyImageID, for the animation
+func (ai *AnimatedImage) KittyImageID(id uint32) *AnimatedImage {
+	ai.TermImg.KittyImageID(id)
+	return ai
+}
+
+// Frames returns the number of frames of the animation
+func (ai *AnimatedImage) Frames() int {
+	return len(ai.frames)
+}
+
+// PlayAnimation prints the image and plays its animation (in a loop, see Loops) with the delay of each frame.
+// Protocols other than Kitty (and single frame images) display the first frame only.
+func (ai *AnimatedImage) PlayAnimation() error {
+	return ai.PlayAnimationTo(os.Stdout)
+}
+
+// PlayAnimationTo is like PlayAnimation but writes to w
+func (ai *AnimatedImage) PlayAnimationTo(w io.Writer) error {
+	if ai.protocol != Kitty || len(ai.frames) < 2 {
+		return ai.PrintTo(w)
+	}
+	out, err := ai.renderAnimation()
+	if err != nil {
+		return err
+	}
+	kittyPrinted.Store(true)
+	_, err = fmt.Fprintln(w, out)
+	return err
+}
+
+// renderAnimation encodes the Kitty escape sequences that transmit and display the first frame,
+// add every other frame to the image, and start the animation loop
+func (ai *AnimatedImage) renderAnimation() (string, error) {
+	first := *ai.img
+	defer func() { ai.img = &first }()
+
+	var sb strings.Builder
+	ai.img = &ai.frames[0]
+	out, err := ai.encodeKitty(ACTION_TRANSFER)
+	if err != nil {
+		return "", err
+	}
+	sb.WriteString(out)
+	id := ai.kittyImageID()
+	for i := 1; i < len(ai.frames); i++ {
+		ai.img = &ai.frames[i]
+		data, err := encodePNG(ai.processImage())
+		if err != nil {
+			return "", err
+		}
+		sb.WriteString(kittyChunks(fmt.Sprintf("%s,i=%d,%s,%s,%s,z=%d",
+			ACTION_FRAME, id, DATA_PNG, SUPPRESS_OK, SUPPRESS_ERR, ai.delays[i]*10,
+		), data, ai.kittyChunkSize()))
+	}
+	// the gap of the first frame (transmitted as the image itself) is set afterwards
+	sb.WriteString(START + fmt.Sprintf("_G%s,i=%d,r=1,z=%d,%s", ACTION_ANIMATE, id, ai.delays[0]*10, SUPPRESS_ERR) + ESCAPE + CLOSE)
+	sb.WriteString(START + fmt.Sprintf("_G%s,i=%d,s=3,v=%d,%s", ACTION_ANIMATE, id, ai.kittyLoops(), SUPPRESS_ERR) + ESCAPE + CLOSE)
+	return sb.String(), nil
+}
+
+// kittyLoops converts the GIF loop count to Kitty's v= key (1 loops forever, n plays the animation n-1 times)
+func (ai *AnimatedImage) kittyLoops() int {
+	switch {
+	case ai.loops == 0:
+		return 1
+	case ai.loops < 0:
+		return 2
+	default:
+		return ai.loops + 2
+	}
+}
@@ -0,0 +1,67 @@
+package termimg
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+)
+
+// KittyBatch displays several Kitty images at once, e.g. a grid of thumbnails: Flush transmits
+// the data of every image first, then places them all, so the grid appears in one go instead of
+// image by image as each transmission completes
+type KittyBatch struct {
+	images []kittyBatchImage
+}
+
+type kittyBatchImage struct {
+	ti   *TermImg
+	x, y int
+}
+
+// AddImage adds an image to the batch, to be displayed with its top left corner at the 0-based cell x,y
+// (with its options, e.g. FillCells or Layer)
+func (b *KittyBatch) AddImage(ti *TermImg, x, y int) error {
+	if ti.protocol != Kitty {
+		return fmt.Errorf("%w: batches are not supported by the %s protocol", ErrProtocolUnavailable, ti.protocol)
+	}
+	if x < 0 || y < 0 {
+		return fmt.Errorf("invalid cell position %d,%d", x, y)
+	}
+	b.images = append(b.images, kittyBatchImage{ti: ti, x: x, y: y})
+	return nil
+}
+
+// Flush displays the images of the batch and empties it, leaving the cursor where it was
+func (b *KittyBatch) Flush() error {
+	return b.FlushTo(os.Stdout)
+}
+
+// FlushTo is like Flush but writes to w
+func (b *KittyBatch) FlushTo(w io.Writer) error {
+	if len(b.images) == 0 {
+		return nil
+	}
+	var sb strings.Builder
+	for _, img := range b.images {
+		if err := img.ti.load(); err != nil {
+			return err
+		}
+		out, err := img.ti.encodeKitty(ACTION_TRANSMIT)
+		if err != nil {
+			return err
+		}
+		sb.WriteString(out)
+	}
+	sb.WriteString("\x1b7") // save cursor
+	for _, img := range b.images {
+		control := slices.Concat([]string{ACTION_PLACEMENT}, img.ti.kittyQuietKeys(SUPPRESS_ERR), img.ti.kittyOptions())
+		sb.WriteString(cursorTo(img.x, img.y) + START + "_G" + strings.Join(control, ",") + ESCAPE + CLOSE)
+	}
+	sb.WriteString("\x1b8") // restore cursor
+	b.images = nil
+	kittyPrinted.Store(true)
+	_, err := io.WriteString(w, sb.String())
+	return err
+}
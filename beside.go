@@ -0,0 +1,66 @@
+package termimg
+
+import (
+	"fmt"
+	"strings"
+)
+
+// RenderBeside renders the image with text to its right, wrapped to textWidth columns, as a single
+// output (e.g. for "image + description" rows in a CLI). The text is printed first, with the image's
+// cell columns left blank, then the image is drawn into the reserved cells at the start of the row.
+// The cursor ends up on the line below the taller of the two.
+func (ti *TermImg) RenderBeside(text string, textWidth int) (string, error) {
+	if textWidth <= 0 {
+		return "", fmt.Errorf("invalid text width %d", textWidth)
+	}
+	img, err := ti.render() // the cursor is saved and restored around it below anyway
+	if err != nil {
+		return "", err
+	}
+	cols, rows, err := ti.cells()
+	if err != nil {
+		return "", err
+	}
+
+	lines := wrapText(text, textWidth)
+	n := max(rows, len(lines))
+	var sb strings.Builder
+	for i := range n {
+		sb.WriteString(fmt.Sprintf("\x1b[%dC", cols+1)) // skip the image columns and a gap
+		if i < len(lines) {
+			sb.WriteString(lines[i])
+		}
+		sb.WriteString("\n")
+	}
+	// back to the first row to draw the image, then below both again
+	sb.WriteString(fmt.Sprintf("\x1b[%dA\r", n))
+	sb.WriteString("\x1b7" + img + "\x1b8") // save and restore the cursor around the image
+	sb.WriteString(fmt.Sprintf("\x1b[%dB", n))
+	return sb.String(), nil
+}
+
+// wrapText word wraps text to lines of at most width runes, keeping its line breaks
+// (words longer than width are split)
+func wrapText(text string, width int) []string {
+	var lines []string
+	for _, para := range strings.Split(text, "\n") {
+		var line []rune
+		for _, word := range strings.Fields(para) {
+			w := []rune(word)
+			if len(line) > 0 && len(line)+1+len(w) > width {
+				lines = append(lines, string(line))
+				line = nil
+			}
+			for len(w) > width {
+				lines = append(lines, string(w[:width]))
+				w = w[width:]
+			}
+			if len(line) > 0 {
+				line = append(line, ' ')
+			}
+			line = append(line, w...)
+		}
+		lines = append(lines, string(line))
+	}
+	return lines
+}
@@ -0,0 +1,98 @@
+package termimg
+
+import (
+	"fmt"
+	"image"
+	"time"
+)
+
+// ErrRenderBudget is returned by RenderWithinBudget when no rendering completed in time
+var ErrRenderBudget = fmt.Errorf("render did not complete within its time budget")
+
+// budgetScales are the downscale factors tried in turn by RenderWithinBudget
+var budgetScales = []int{1, 2, 4, 8}
+
+// renderAttempt renders one of the attempts of RenderWithinBudget (swappable in tests)
+var renderAttempt = func(ti *TermImg) (string, error) {
+	return ti.Render()
+}
+
+type budgetResult struct {
+	ti  *TermImg
+	out string
+	err error
+}
+
+// RenderWithinBudget renders the image like Render, but returns within d for apps with a strict
+// per-frame time budget, at the cost of quality under load. It starts rendering at full quality and,
+// each time half of the remaining budget has elapsed, also starts a cheaper rendering (half the
+// resolution of the previous one, stretched by the terminal to the same cells, and without DitherColors).
+// The first rendering to complete is returned, or ErrRenderBudget if none completes in time.
+func (ti *TermImg) RenderWithinBudget(d time.Duration) (string, error) {
+	if err := ti.load(); err != nil {
+		return "", err
+	}
+	render := renderAttempt
+	results := make(chan budgetResult, len(budgetScales))
+	deadline := time.After(d)
+	next := time.NewTimer(0)
+	defer next.Stop()
+	remaining := d
+	attempt := 0
+	for {
+		select {
+		case r := <-results:
+			if ti.kittyID == 0 {
+				ti.kittyID = r.ti.kittyID // the ID the displayed image was given
+			}
+			return r.out, r.err
+		case <-deadline:
+			return "", ErrRenderBudget
+		case <-next.C:
+			sti, err := ti.budgetAttempt(budgetScales[attempt])
+			if err != nil {
+				return "", err
+			}
+			go func() {
+				out, err := render(sti)
+				results <- budgetResult{sti, out, err}
+			}()
+			if attempt++; attempt < len(budgetScales) {
+				remaining /= 2
+				next.Reset(remaining)
+			}
+		}
+	}
+}
+
+// budgetAttempt returns a Clone of the image (so attempts that complete too late don't touch it)
+// downscaled by scale, displayed in the same cells as the full size image. The attempts share the
+// image's Kitty ID if it has one, and RenderWithinBudget gives it the ID of the attempt returned.
+func (ti *TermImg) budgetAttempt(scale int) (*TermImg, error) {
+	img := ti.source() // cropped before it is downscaled
+	sti := ti.Clone()
+	sti.img = &img
+	sti.crop, sti.cropCenter = image.Rectangle{}, false
+	sti.invert, sti.autoInvert = ti.inverted(), false
+	sti.fillCols, sti.fillRows = ti.fillCells()
+	sti.kittyID = ti.kittyID
+	if scale == 1 {
+		if ti.cropped() {
+			sti.raw, sti.path = nil, "" // the original file no longer matches the pixels
+		}
+		return sti, nil
+	}
+	sti.raw, sti.path = nil, ""
+	sti.colors = 0
+	b := img.Bounds()
+	if sti.fillCols <= 0 || sti.fillRows <= 0 {
+		fontWidth, fontHeight, err := ti.fontSize()
+		if err != nil {
+			return nil, err
+		}
+		sti.fillCols, sti.fillRows = ceilDiv(b.Dx(), fontWidth), ceilDiv(b.Dy(), fontHeight)
+	}
+	sti.maxW, sti.maxH = max(b.Dx()/scale, 1), max(b.Dy()/scale, 1)
+	sti.scaleDecoded()
+	return sti, nil
+}
@@ -0,0 +1,173 @@
+package termimg
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/draw"
+	"strings"
+	"sync"
+)
+
+// renderCache is a package-level LRU cache of rendered escape sequences
+type renderCache struct {
+	mu      sync.Mutex
+	maxSize int
+	order   *list.List
+	entries map[string]*list.Element
+	hits    int
+	misses  int
+}
+
+type renderCacheEntry struct {
+	key     string
+	encoded string
+	size    int
+	width   int
+	height  int
+	kittyID uint32 // the Kitty image ID in encoded, replaced by the ID of the image it is loaded for
+}
+
+var globalRenderCache = &renderCache{
+	order:   list.New(),
+	entries: make(map[string]*list.Element),
+}
+
+// EnableRenderCache enables a package-level cache of up to size rendered escape sequences,
+// keyed by the image's content and render options, so rendering the same image with
+// the same settings again skips the (expensive) encoding step. A size of 0 disables it.
+func EnableRenderCache(size int) {
+	globalRenderCache.mu.Lock()
+	defer globalRenderCache.mu.Unlock()
+	globalRenderCache.maxSize = max(size, 0)
+	globalRenderCache.evict()
+}
+
+// ClearRenderCache removes all entries from the render cache and resets its statistics
+func ClearRenderCache() {
+	globalRenderCache.mu.Lock()
+	defer globalRenderCache.mu.Unlock()
+	globalRenderCache.order.Init()
+	clear(globalRenderCache.entries)
+	globalRenderCache.hits, globalRenderCache.misses = 0, 0
+}
+
+// RenderCacheStats returns the number of renders served from the render cache (hits), the number
+// that had to be encoded while it was enabled (misses), and the number of entries it holds, to
+// tune its size (e.g. a gallery of thumbnails rendered repeatedly needs one entry per thumbnail)
+func RenderCacheStats() (hits, misses, entries int) {
+	globalRenderCache.mu.Lock()
+	defer globalRenderCache.mu.Unlock()
+	return globalRenderCache.hits, globalRenderCache.misses, globalRenderCache.order.Len()
+}
+
+func (c *renderCache) enabled() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.maxSize > 0
+}
+
+func (c *renderCache) get(key string) (*renderCacheEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.entries[key]
+	if !ok {
+		c.misses++
+		return nil, false
+	}
+	c.hits++
+	c.order.MoveToFront(elem)
+	return elem.Value.(*renderCacheEntry), true
+}
+
+func (c *renderCache) put(entry *renderCacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.maxSize <= 0 {
+		return
+	}
+	if elem, ok := c.entries[entry.key]; ok {
+		elem.Value = entry
+		c.order.MoveToFront(elem)
+		return
+	}
+	c.entries[entry.key] = c.order.PushFront(entry)
+	c.evict()
+}
+
+// evict drops the least recently used entries until the cache fits (must hold c.mu)
+func (c *renderCache) evict() {
+	for c.order.Len() > c.maxSize {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*renderCacheEntry).key)
+	}
+}
+
+// loadRenderCache populates the encoded escape sequence from the render cache if present
+func (ti *TermImg) loadRenderCache() bool {
+	if !globalRenderCache.enabled() {
+		return false
+	}
+	ti.renderKey = ti.renderCacheKey()
+	entry, ok := globalRenderCache.get(ti.renderKey)
+	if !ok {
+		return false
+	}
+	ti.encoded = entry.encoded
+	if entry.kittyID != 0 {
+		// the output may have been rendered for another image with the same pixels: transmit it with
+		// this image's own ID (the only i= key is in the control data of the first chunk)
+		ti.encoded = strings.Replace(entry.encoded, fmt.Sprintf(",i=%d", entry.kittyID), fmt.Sprintf(",i=%d", ti.kittyImageID()), 1)
+	}
+	ti.size = entry.size
+	ti.width = entry.width
+	ti.height = entry.height
+	return true
+}
+
+// storeRenderCache saves the encoded escape sequence in the render cache
+func (ti *TermImg) storeRenderCache() {
+	if ti.renderKey == "" {
+		return
+	}
+	entry := &renderCacheEntry{key: ti.renderKey, encoded: ti.encoded, size: ti.size, width: ti.width, height: ti.height}
+	if ti.protocol == Kitty {
+		entry.kittyID = ti.kittyID
+	}
+	globalRenderCache.put(entry)
+	ti.renderKey = ""
+}
+
+// renderCacheKey returns a key made of the processed image's content hash and the render options
+func (ti *TermImg) renderCacheKey() string {
+	img := ti.processImage()
+	b := img.Bounds()
+	nrgba, ok := img.(*image.NRGBA)
+	if !ok {
+		nrgba = image.NewNRGBA(b)
+		draw.Draw(nrgba, b, img, b.Min, draw.Src)
+	}
+	h := sha256.New()
+	binary.Write(h, binary.LittleEndian, [4]int64{int64(b.Min.X), int64(b.Min.Y), int64(b.Max.X), int64(b.Max.Y)})
+	h.Write(nrgba.Pix)
+	return fmt.Sprintf("%s:%q:%s:%x", ti.protocol, START, ti.optionsKey(), h.Sum(nil))
+}
+
+// optionsKey returns the normalized render options that affect the escape sequence but not the pixels
+func (ti *TermImg) optionsKey() string {
+	cols, rows := ti.fillCells()
+	key := fmt.Sprintf("layer=%d,offset=%d:%d,chunk=%d:%d,fill=%dx%d,key=%q,quiet=%v", ti.layer, ti.offsetX, ti.offsetY, ti.iterm2ChunkSize(), ti.kittyChunkSize(), cols, rows, ti.cacheKey, ti.kittyQuietKeys(SUPPRESS_OK, SUPPRESS_ERR))
+	if ti.kittyNoMove {
+		key += ",C=1"
+	}
+	if ti.kittyIDForced {
+		key += fmt.Sprintf(",id=%d", ti.kittyID)
+	}
+	if limit := ti.overflowLimit(); limit != nil && ti.overflow == OverflowDownscale {
+		key += fmt.Sprintf(",rows=%d", limit.rows)
+	}
+	return key
+}
@@ -0,0 +1,67 @@
+package termimg
+
+import (
+	"fmt"
+	"image/color"
+)
+
+// ColorDepth is the number of colors the terminal can display in text output (e.g. Preview)
+type ColorDepth int
+
+const (
+	DepthTrueColor ColorDepth = iota // 24-bit RGB (default)
+	Depth256                         // xterm 256 color palette
+	Depth16                          // the 16 standard ANSI colors
+)
+
+// ansi16 are the (xterm default) RGB values of the 16 standard ANSI colors
+var ansi16 = color.Palette{
+	color.RGBA{0, 0, 0, 255}, color.RGBA{205, 0, 0, 255}, color.RGBA{0, 205, 0, 255}, color.RGBA{205, 205, 0, 255},
+	color.RGBA{0, 0, 238, 255}, color.RGBA{205, 0, 205, 255}, color.RGBA{0, 205, 205, 255}, color.RGBA{229, 229, 229, 255},
+	color.RGBA{127, 127, 127, 255}, color.RGBA{255, 0, 0, 255}, color.RGBA{0, 255, 0, 255}, color.RGBA{255, 255, 0, 255},
+	color.RGBA{92, 92, 255, 255}, color.RGBA{255, 0, 255, 255}, color.RGBA{0, 255, 255, 255}, color.RGBA{255, 255, 255, 255},
+}
+
+// xterm256 is the xterm 256 color palette
+var xterm256 = func() color.Palette {
+	p := append(color.Palette{}, ansi16...)
+	levels := []uint8{0, 95, 135, 175, 215, 255}
+	for r := 0; r < 6; r++ {
+		for g := 0; g < 6; g++ {
+			for b := 0; b < 6; b++ {
+				p = append(p, color.RGBA{levels[r], levels[g], levels[b], 255})
+			}
+		}
+	}
+	for i := 0; i < 24; i++ {
+		v := uint8(8 + i*10)
+		p = append(p, color.RGBA{v, v, v, 255})
+	}
+	return p
+}()
+
+// background returns the SGR escape sequence setting the background to the closest color available
+func (d ColorDepth) background(c color.RGBA) string {
+	return d.sgr(c, 40)
+}
+
+// foreground returns the SGR escape sequence setting the foreground to the closest color available
+func (d ColorDepth) foreground(c color.RGBA) string {
+	return d.sgr(c, 30)
+}
+
+// sgr returns the SGR escape sequence setting the color of base (30: foreground, 40: background)
+func (d ColorDepth) sgr(c color.RGBA, base int) string {
+	switch d {
+	case Depth16:
+		i := ansi16.Index(c)
+		if i < 8 {
+			return fmt.Sprintf("\x1b[%dm", base+i)
+		}
+		return fmt.Sprintf("\x1b[%dm", base+60+i-8)
+	case Depth256:
+		return fmt.Sprintf("\x1b[%d;5;%dm", base+8, xterm256.Index(c))
+	default:
+		return fmt.Sprintf("\x1b[%d;2;%d;%d;%dm", base+8, c.R, c.G, c.B)
+	}
+}
@@ -0,0 +1,53 @@
+package termimg
+
+import (
+	"fmt"
+	"image"
+)
+
+// Crop displays only the part of the image inside rect (in the coordinates of the image's pixels,
+// the downscaled ones for images opened with OpenDownscaled), e.g. to show a region of interest. The
+// rectangle is clamped to the image bounds, and the crop is applied before any other processing.
+// An empty rectangle displays the whole image again.
+func (ti *TermImg) Crop(rect image.Rectangle) *TermImg {
+	ti.crop = rect.Canon()
+	ti.cropCenter = false
+	ti.invalidate()
+	return ti
+}
+
+// CropCenter displays only the centered width x height pixels of the image (see Crop)
+func (ti *TermImg) CropCenter(width, height int) *TermImg {
+	ti.crop = image.Rect(0, 0, max(width, 0), max(height, 0))
+	ti.cropCenter = true
+	ti.invalidate()
+	return ti
+}
+
+// cropped reports whether only part of the image is displayed
+func (ti *TermImg) cropped() bool {
+	return !ti.crop.Empty()
+}
+
+// checkCrop returns an error if the crop region doesn't overlap the image
+func (ti *TermImg) checkCrop() error {
+	if ti.cropped() && ti.source().Bounds().Empty() {
+		return fmt.Errorf("crop region %v is outside of the image bounds %v", ti.crop, (*ti.img).Bounds())
+	}
+	return nil
+}
+
+// source returns the image to process, cropped to the configured region
+func (ti *TermImg) source() image.Image {
+	img := *ti.img
+	if !ti.cropped() {
+		return img
+	}
+	rect := ti.crop
+	if ti.cropCenter {
+		b := img.Bounds()
+		offset := b.Min.Add(b.Size().Sub(rect.Size()).Div(2))
+		rect = rect.Add(image.Pt(max(offset.X, b.Min.X), max(offset.Y, b.Min.Y)))
+	}
+	return cropImage(img, rect)
+}
@@ -0,0 +1,36 @@
+package termimg
+
+import (
+	"encoding/base64"
+	"fmt"
+)
+
+// DataURIFormat sets the image format ("png" or "jpeg") used by DataURI (PNG by default)
+func (ti *TermImg) DataURIFormat(format string) *TermImg {
+	ti.uriFormat = format
+	return ti
+}
+
+// DataURI returns the processed image as a base64 `data:` URI, for embedding in HTML, markdown
+// or logs viewed in a browser rather than displaying it in the terminal
+func (ti *TermImg) DataURI() (string, error) {
+	var (
+		data []byte
+		mime string
+		err  error
+	)
+	switch ti.uriFormat {
+	case "png", "":
+		data, err = ti.AsPNGBytes()
+		mime = "image/png"
+	case "jpeg", "jpg":
+		data, err = ti.AsJPEGBytes()
+		mime = "image/jpeg"
+	default:
+		return "", fmt.Errorf("unsupported data URI format: %s; supported formats: (png, jpeg)", ti.uriFormat)
+	}
+	if err != nil {
+		return "", err
+	}
+	return "data:" + mime + ";base64," + base64.StdEncoding.EncodeToString(data), nil
+}
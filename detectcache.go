@@ -0,0 +1,59 @@
+package termimg
+
+import (
+	"sync"
+	"time"
+)
+
+var (
+	detectionCacheMu  sync.Mutex
+	detectionCacheTTL time.Duration // 0: cached for the life of the process
+)
+
+// SetDetectionCacheTTL sets how long the terminal detection results cached by this package (the
+// Kitty transmission probe of DetectProtocol, the terminal name and version (XTVERSION) used to
+// detect iTerm2 and Kitty features, the font size of GetTerminalFontSize and the colors of
+// QueryBackgroundColor and QueryForegroundColor) stay valid before the terminal is queried again,
+// e.g. for a long-lived process that attaches to different terminals over time. 0 (the default)
+// caches them forever.
+func SetDetectionCacheTTL(d time.Duration) {
+	detectionCacheMu.Lock()
+	defer detectionCacheMu.Unlock()
+	detectionCacheTTL = max(d, 0)
+}
+
+// ClearDetectionCache forgets the cached terminal detection results, so the next detection
+// queries the terminal again
+func ClearDetectionCache() {
+	kittyTransmissionMu.Lock()
+	kittyTransmission = nil
+	kittyTransmissionMu.Unlock()
+	termColorsMu.Lock()
+	clear(termColors)
+	termColorsMu.Unlock()
+	fontSizeMu.Lock()
+	detectedFontSize = nil
+	fontSizeMu.Unlock()
+	terminalNameMu.Lock()
+	terminalName = nil
+	terminalNameMu.Unlock()
+}
+
+// cachedDetection is a terminal detection result and when it was detected
+type cachedDetection[T any] struct {
+	value T
+	at    time.Time
+}
+
+// newCachedDetection returns the result detected now
+func newCachedDetection[T any](value T) cachedDetection[T] {
+	return cachedDetection[T]{value: value, at: time.Now()}
+}
+
+// fresh reports whether the result is still valid with the detection cache TTL
+func (c cachedDetection[T]) fresh() bool {
+	detectionCacheMu.Lock()
+	ttl := detectionCacheTTL
+	detectionCacheMu.Unlock()
+	return ttl == 0 || time.Since(c.at) < ttl
+}
@@ -0,0 +1,103 @@
+package termimg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/term"
+)
+
+// diagnosticEnv are the environment variables that influence detection
+var diagnosticEnv = []string{
+	"TERM",
+	"TERM_PROGRAM",
+	"TERM_PROGRAM_VERSION",
+	"COLORTERM",
+	"COLORFGBG",
+	"KITTY_WINDOW_ID",
+	"TMUX",
+	"SSH_CONNECTION",
+	"SSH_TTY",
+	BYPASS_DETECTION_ENV,
+}
+
+// diagnosticQuery is a terminal query sent by Diagnostics
+type diagnosticQuery struct {
+	name  string
+	query string
+	da1   bool // the query is DA1 itself, so it can't be followed by DA1 to detect the end of the response
+}
+
+func diagnosticQueries() []diagnosticQuery {
+	return []diagnosticQuery{
+		{"DA1 (primary device attributes)", "\x1b[c", true},
+		{"DA2 (secondary device attributes)", "\x1b[>c", false},
+		{"Cursor position", "\x1b[6n", false},
+		{"Cell size (CSI 16t)", "\x1b[16t", false},
+		{"Window size in pixels (CSI 14t)", "\x1b[14t", false},
+		{"Window size in cells (CSI 18t)", "\x1b[18t", false},
+		{"Kitty graphics", START + "_Gi=31,s=1,v=1,a=q,t=d,f=24;AAAA" + ESCAPE + CLOSE, false},
+		{"iTerm2 cell size", START + "]1337;ReportCellSize\x07" + CLOSE, false},
+		{"XTSMGRAPHICS geometry", "\x1b[?2;1;0S", false},
+		{"Background color (OSC 11)", START + "]11;?\x07" + CLOSE, false},
+	}
+}
+
+// Diagnostics sends every known terminal query and returns a human-readable report
+// of the environment, the detection results and the raw responses. It is meant to be
+// pasted into bug reports when images do not display correctly in a terminal.
+//
+// The queries are sent one at a time through the same serialized path as detection, and the report
+// tells apart the queries the terminal ignored (answered by nothing but the DA1 sent after them, see
+// queryTerminal) from those that timed out, e.g. because a multiplexer didn't pass them through.
+func Diagnostics() string {
+	var sb strings.Builder
+
+	sb.WriteString("Environment:\n")
+	for _, key := range diagnosticEnv {
+		fmt.Fprintf(&sb, "  %s=%q\n", key, os.Getenv(key))
+	}
+
+	sb.WriteString("Detection:\n")
+	fmt.Fprintf(&sb, "  protocol: %s\n", DetectProtocol())
+	fmt.Fprintf(&sb, "  stdin is a terminal: %t\n", term.IsTerminal(int(os.Stdin.Fd())))
+	if cols, rows, err := terminalSize(); err != nil {
+		fmt.Fprintf(&sb, "  window size: error: %v\n", err)
+	} else {
+		fmt.Fprintf(&sb, "  window size: %dx%d cells\n", cols, rows)
+	}
+	if width, height, err := GetTerminalFontSize(); err != nil {
+		fmt.Fprintf(&sb, "  font size: error: %v\n", err)
+	} else {
+		fmt.Fprintf(&sb, "  font size: %dx%d px\n", width, height)
+	}
+
+	sb.WriteString("Queries:\n")
+	for _, q := range diagnosticQueries() {
+		start := time.Now()
+		var resp []byte
+		var err error
+		if q.da1 {
+			resp, err = queryTerminalUntil(context.Background(), os.Stdout, q.query, false)
+		} else {
+			resp, err = queryTerminal(context.Background(), q.query)
+		}
+		elapsed := time.Since(start).Round(time.Millisecond)
+		switch {
+		case errors.Is(err, ErrQueryTimeout):
+			fmt.Fprintf(&sb, "  %s %q: timed out after %s\n", q.name, q.query, elapsed)
+		case errors.Is(err, ErrEmptyResponse):
+			fmt.Fprintf(&sb, "  %s %q: no answer (%s)\n", q.name, q.query, elapsed)
+		case err != nil:
+			fmt.Fprintf(&sb, "  %s %q: error: %v\n", q.name, q.query, err)
+		default:
+			fmt.Fprintf(&sb, "  %s %q: %q (%s)\n", q.name, q.query, resp, elapsed)
+		}
+	}
+
+	return sb.String()
+}
@@ -0,0 +1,247 @@
+package termimg
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+	"slices"
+)
+
+// DitherMode is the dithering algorithm used by DitherColors
+type DitherMode int
+
+const (
+	DitherFloydSteinberg DitherMode = iota // error diffusion, smoothest gradients (default)
+	DitherAtkinson                         // error diffusion of only 3/4 of the error, cleaner and higher contrast
+	DitherOrdered                          // 4x4 Bayer threshold matrix, much faster and stable between frames
+)
+
+func (m DitherMode) String() string {
+	switch m {
+	case DitherFloydSteinberg:
+		return "floyd-steinberg"
+	case DitherAtkinson:
+		return "atkinson"
+	case DitherOrdered:
+		return "ordered"
+	default:
+		return "unknown"
+	}
+}
+
+// bayer4 is the 4x4 Bayer threshold matrix
+var bayer4 = [4][4]float64{
+	{0, 8, 2, 10},
+	{12, 4, 14, 6},
+	{3, 11, 1, 9},
+	{15, 7, 13, 5},
+}
+
+// ditherColors returns the image dithered to a palette of n colors derived from the
+// image itself (using median cut). The palette only holds opaque colors and transparent,
+// so translucent pixels become transparent below 50% alpha and keep their (straight,
+// not premultiplied) color otherwise, rather than being darkened or fringed.
+func ditherColors(src image.Image, n int, mode DitherMode, strength float64) image.Image {
+	nrgba, transparent := binarizeAlpha(src)
+	var pixels [][3]uint8
+	for i := 0; i < len(nrgba.Pix); i += 4 {
+		if nrgba.Pix[i+3] != 0 {
+			pixels = append(pixels, [3]uint8{nrgba.Pix[i], nrgba.Pix[i+1], nrgba.Pix[i+2]})
+		}
+	}
+	// a palette holds at most 256 colors, including transparent
+	limit := 256
+	if transparent {
+		limit = 255
+	}
+	return dither(src, nrgba, medianCut(pixels, min(n, limit)), transparent, mode, strength)
+}
+
+// ditherPalette returns the image dithered to the opaque colors of a fixed palette (and
+// transparent, with the same handling of translucent pixels as ditherColors)
+func ditherPalette(src image.Image, p color.Palette, mode DitherMode, strength float64) image.Image {
+	nrgba, transparent := binarizeAlpha(src)
+	var opaque color.Palette
+	for _, c := range p {
+		if c := color.NRGBAModel.Convert(c).(color.NRGBA); opaqueAlpha(c.A) && len(opaque) < 255 {
+			c.A = 255
+			opaque = append(opaque, c)
+		}
+	}
+	return dither(src, nrgba, opaque, transparent, mode, strength)
+}
+
+// binarizeAlpha returns a copy of the image where every pixel is either opaque or transparent
+// (see opaqueAlpha), and whether any pixel is transparent
+func binarizeAlpha(src image.Image) (*image.NRGBA, bool) {
+	b := src.Bounds()
+	nrgba := image.NewNRGBA(b)
+	draw.Draw(nrgba, b, src, b.Min, draw.Src)
+	transparent := false
+	for i := 0; i < len(nrgba.Pix); i += 4 {
+		if !opaqueAlpha(nrgba.Pix[i+3]) {
+			nrgba.Pix[i+3] = 0
+			transparent = true
+			continue
+		}
+		nrgba.Pix[i+3] = 255
+	}
+	return nrgba, transparent
+}
+
+// dither dithers nrgba (the binarized src) to the opaque colors, plus transparent if needed, with
+// the error diffusion (or the ordered thresholds) scaled by strength.
+// Without opaque colors (e.g. a fully translucent palette) there is nothing to dither to, and
+// src is returned as is.
+func dither(src image.Image, nrgba *image.NRGBA, opaque color.Palette, transparent bool, mode DitherMode, strength float64) image.Image {
+	if len(opaque) == 0 {
+		return src
+	}
+	b := nrgba.Bounds()
+	palette := opaque
+	if transparent {
+		palette = append(palette[:len(palette):len(palette)], color.Transparent)
+	}
+
+	dst := image.NewPaletted(b, palette)
+	switch mode {
+	case DitherAtkinson:
+		diffuse(dst, nrgba, opaque, atkinson, strength)
+	case DitherOrdered:
+		ordered(dst, nrgba, opaque, len(opaque), strength)
+	default:
+		diffuse(dst, nrgba, opaque, floydSteinberg, strength)
+	}
+	return dst
+}
+
+// errorWeight is the share of the quantization error diffused to the neighbour at dx,dy
+type errorWeight struct {
+	dx, dy int
+	weight float64
+}
+
+var (
+	// floydSteinberg diffuses 7/16 of the error to the right, and 3/16, 5/16 and 1/16 below
+	floydSteinberg = []errorWeight{{1, 0, 7.0 / 16}, {-1, 1, 3.0 / 16}, {0, 1, 5.0 / 16}, {1, 1, 1.0 / 16}}
+	// atkinson diffuses 1/8 of the error to each of 6 neighbours (x+1, x+2 on this row, x-1..x+1
+	// on the next one and x on the one after), dropping the remaining 1/4
+	atkinson = []errorWeight{{1, 0, 1.0 / 8}, {2, 0, 1.0 / 8}, {-1, 1, 1.0 / 8}, {0, 1, 1.0 / 8}, {1, 1, 1.0 / 8}, {0, 2, 1.0 / 8}}
+)
+
+// diffuse dithers src into dst, diffusing the quantization error of each pixel to its neighbours
+// with the kernel's weights, scaled by strength
+func diffuse(dst *image.Paletted, src *image.NRGBA, opaque color.Palette, kernel []errorWeight, strength float64) {
+	b := src.Bounds()
+	w, h := b.Dx(), b.Dy()
+	// the pixels with the accumulated error, as floats so the error can exceed the channel range
+	buf := make([][3]float64, w*h)
+	for i := range buf {
+		p := src.Pix[i*4 : i*4+3]
+		buf[i] = [3]float64{float64(p[0]), float64(p[1]), float64(p[2])}
+	}
+	transparent := uint8(len(dst.Palette) - 1)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			if src.Pix[(y*w+x)*4+3] == 0 {
+				dst.SetColorIndex(b.Min.X+x, b.Min.Y+y, transparent)
+				continue
+			}
+			old := buf[y*w+x]
+			idx := opaque.Index(color.NRGBA{R: clamp8(old[0]), G: clamp8(old[1]), B: clamp8(old[2]), A: 255})
+			dst.SetColorIndex(b.Min.X+x, b.Min.Y+y, uint8(idx))
+			c := opaque[idx].(color.NRGBA)
+			diff := [3]float64{(old[0] - float64(c.R)) * strength, (old[1] - float64(c.G)) * strength, (old[2] - float64(c.B)) * strength}
+			for _, d := range kernel {
+				nx, ny := x+d.dx, y+d.dy
+				if nx < 0 || nx >= w || ny >= h {
+					continue
+				}
+				for ch := range 3 {
+					buf[ny*w+nx][ch] += diff[ch] * d.weight
+				}
+			}
+		}
+	}
+}
+
+// ordered dithers src into dst by offsetting each pixel by the Bayer matrix threshold at its
+// position (scaled to the spacing of a palette of n colors, and by strength) before picking the
+// nearest color
+func ordered(dst *image.Paletted, src *image.NRGBA, opaque color.Palette, n int, strength float64) {
+	b := src.Bounds()
+	spread := 255 / math.Max(math.Cbrt(float64(n)), 1) * strength
+	transparent := uint8(len(dst.Palette) - 1)
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			c := src.NRGBAAt(x, y)
+			if c.A == 0 {
+				dst.SetColorIndex(x, y, transparent)
+				continue
+			}
+			offset := ((bayer4[y&3][x&3]+0.5)/16 - 0.5) * spread
+			idx := opaque.Index(color.NRGBA{
+				R: clamp8(float64(c.R) + offset),
+				G: clamp8(float64(c.G) + offset),
+				B: clamp8(float64(c.B) + offset),
+				A: 255,
+			})
+			dst.SetColorIndex(x, y, uint8(idx))
+		}
+	}
+}
+
+// opaqueAlpha reports whether a pixel with the given alpha is drawn opaque by two level (opaque or transparent) outputs
+func opaqueAlpha(a uint8) bool {
+	return a >= 128
+}
+
+// clamp8 rounds v to the nearest value of a color channel
+func clamp8(v float64) uint8 {
+	return uint8(math.Round(math.Max(0, math.Min(255, v))))
+}
+
+// medianCut builds a palette of up to n colors by repeatedly splitting the box of
+// pixels with the widest channel range at its median, and averaging each box
+func medianCut(pixels [][3]uint8, n int) color.Palette {
+	if len(pixels) == 0 || n <= 0 {
+		return nil
+	}
+	boxes := [][][3]uint8{pixels}
+	for len(boxes) < n {
+		// find the box with the widest range in any channel
+		best, bestChannel, bestRange := -1, 0, 0
+		for i, box := range boxes {
+			if len(box) < 2 {
+				continue
+			}
+			for c := 0; c < 3; c++ {
+				lo, hi := uint8(255), uint8(0)
+				for _, p := range box {
+					lo, hi = min(lo, p[c]), max(hi, p[c])
+				}
+				if r := int(hi) - int(lo); r > bestRange {
+					best, bestChannel, bestRange = i, c, r
+				}
+			}
+		}
+		if best < 0 {
+			break // every box holds a single color
+		}
+		box := boxes[best]
+		slices.SortFunc(box, func(a, b [3]uint8) int { return int(a[bestChannel]) - int(b[bestChannel]) })
+		mid := len(box) / 2
+		boxes = append(boxes[:best], append([][][3]uint8{box[:mid], box[mid:]}, boxes[best+1:]...)...)
+	}
+
+	palette := make(color.Palette, 0, len(boxes))
+	for _, box := range boxes {
+		var r, g, b int
+		for _, p := range box {
+			r, g, b = r+int(p[0]), g+int(p[1]), b+int(p[2])
+		}
+		palette = append(palette, color.NRGBA{R: uint8(r / len(box)), G: uint8(g / len(box)), B: uint8(b / len(box)), A: 255})
+	}
+	return palette
+}
@@ -47,6 +47,20 @@ which protocol is supported:
 	    fmt.Println("No supported protocol detected")
 	}
 
+Detection can be bypassed by setting the TERMIMG_BYPASS_DETECTION environment
+variable to "kitty", "iterm2" or "blocks" (or "halfblocks"), which DetectProtocol then
+returns without querying the terminal. Other values are ignored.
+
+The option setters of TermImg (e.g. FitWidth or Invert) modify the image they are called
+on and return it for chaining, so chains starting from the same image share a single
+configuration. Use Clone to derive independently configured images from a common one:
+
+	small := base.Clone().FitWidth(10)
+	large := base.Clone().FitWidth(40)
+
+Cell coordinates taken by this package (e.g. PlaceByID) are 0-based: the top left
+cell of the terminal is 0,0.
+
 This package is designed to make it easy to add image rendering capabilities to
 terminal-based Go applications.
 */
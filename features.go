@@ -0,0 +1,101 @@
+package termimg
+
+import (
+	"bytes"
+	"compress/zlib"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// KittyFeatures are the optional parts of the Kitty graphics protocol supported by the terminal,
+// as older versions of Kitty and other terminals implementing the protocol only support a subset
+type KittyFeatures struct {
+	SupportsAnimation        bool // frames and animation control (a=f, a=a), Kitty 0.20.0+
+	SupportsCompression      bool // zlib compressed data (o=z)
+	SupportsUnicodePlacement bool // virtual placements displayed with Unicode placeholders (U=1), Kitty 0.28.0+
+	SupportsFileTransfer     bool // reading the image data from a file (t=f), only possible on the same machine
+}
+
+// DetectKittyFeatures probes the terminal for the optional Kitty graphics protocol features it supports.
+// Compression and file transfer are tested with 1 pixel query actions (a=q), which display nothing,
+// while animation and Unicode placement are only detectable from the terminal name and version
+// (XTVERSION), so they are reported as unsupported by terminals other than Kitty and Ghostty.
+func DetectKittyFeatures() KittyFeatures {
+	var features KittyFeatures
+	if name, err := queryTerminalName(context.Background()); err == nil {
+		features.SupportsAnimation, features.SupportsUnicodePlacement = kittyVersionFeatures(name)
+	}
+
+	var zdata bytes.Buffer
+	zw := zlib.NewWriter(&zdata)
+	zw.Write([]byte{0, 0, 0}) // a single RGB pixel
+	zw.Close()
+	features.SupportsCompression = kittyQueryOK("44", "f=24,o=z", zdata.Bytes())
+
+	if f, err := os.CreateTemp("", "termimg-probe-*.rgb"); err == nil {
+		defer os.Remove(f.Name())
+		_, err := f.Write([]byte{0, 0, 0})
+		f.Close()
+		if err == nil {
+			features.SupportsFileTransfer = kittyQueryOK("45", "f=24,t=f", []byte(f.Name()))
+		}
+	}
+	return features
+}
+
+// kittyQueryOK sends a query action for a 1x1 image with the given control data and payload
+// and reports whether the terminal accepts it
+func kittyQueryOK(id, control string, payload []byte) bool {
+	query := fmt.Sprintf("_Gi=%s,s=1,v=1,%s,%s;%s", id, ACTION_QUERY, control, base64.StdEncoding.EncodeToString(payload))
+	resp, err := queryTerminal(context.Background(), START+query+ESCAPE+CLOSE)
+	return err == nil && kittyResponseOK(resp, id)
+}
+
+// kittyVersionFeatures returns the features that depend on the terminal version, from its XTVERSION name
+// (e.g. "kitty(0.35.2)" or "ghostty 1.1.0")
+func kittyVersionFeatures(name string) (animation, unicodePlacement bool) {
+	name = strings.ToLower(name)
+	switch {
+	case strings.HasPrefix(name, "kitty("):
+		version := parseVersion(strings.TrimSuffix(strings.TrimPrefix(name, "kitty("), ")"))
+		return !versionLess(version, []int{0, 20, 0}), !versionLess(version, []int{0, 28, 0})
+	case strings.HasPrefix(name, "ghostty"):
+		return false, true
+	default:
+		return false, false
+	}
+}
+
+// parseVersion parses a dotted version number, stopping at the first non numeric part
+func parseVersion(s string) []int {
+	var version []int
+	for _, part := range strings.Split(s, ".") {
+		n, err := strconv.Atoi(part)
+		if err != nil {
+			break
+		}
+		version = append(version, n)
+	}
+	return version
+}
+
+// versionLess reports whether version a is lower than b (missing parts count as 0)
+func versionLess(a, b []int) bool {
+	for i := range max(len(a), len(b)) {
+		var x, y int
+		if i < len(a) {
+			x = a[i]
+		}
+		if i < len(b) {
+			y = b[i]
+		}
+		if x != y {
+			return x < y
+		}
+	}
+	return false
+}
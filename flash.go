@@ -0,0 +1,37 @@
+package termimg
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// Flash prints the image, waits for d, then removes it again, e.g. for a transient preview. Kitty
+// images are deleted by their id and iTerm2 images overwritten in the cells they were drawn in (when
+// the terminal reports the cursor position), while blocks are overwritten with blanks. The cursor is
+// returned to where it was before the image was printed.
+func (ti *TermImg) Flash(d time.Duration) error {
+	return ti.FlashTo(os.Stdout, d)
+}
+
+// FlashTo is like Flash but writes to w
+func (ti *TermImg) FlashTo(w io.Writer, d time.Duration) error {
+	io.WriteString(w, "\x1b7") // save cursor
+	defer io.WriteString(w, "\x1b8")
+	if err := ti.PrintTo(w); err != nil {
+		return err
+	}
+	time.Sleep(d)
+	if ti.protocol != Blocks {
+		return ti.ClearTo(w)
+	}
+	cols, rows, err := ti.cells()
+	if err != nil {
+		return err
+	}
+	// back to the top left cell of the image and erase its cells row by row
+	_, err = io.WriteString(w, "\x1b8"+strings.Repeat(fmt.Sprintf("\x1b[%dX\x1b[1B", cols), rows))
+	return err
+}
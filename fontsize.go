@@ -0,0 +1,286 @@
+package termimg
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+)
+
+// FontSizeMethod is a method used to detect the terminal's font (cell) size in pixels
+type FontSizeMethod int
+
+const (
+	ITerm2ReportCellSize FontSizeMethod = iota // OSC 1337;ReportCellSize
+	CSI16t                                     // report cell size in pixels
+	CSI14t18t                                  // report window size in pixels and in cells
+	XTSMGRAPHICS                               // report graphics geometry and divide by the window size
+	Fallback                                   // assume DEFAULT_FONT_WIDTH x DEFAULT_FONT_HEIGHT
+)
+
+const (
+	DEFAULT_FONT_WIDTH  = 8
+	DEFAULT_FONT_HEIGHT = 16
+)
+
+var ErrFontSizeUnknown = fmt.Errorf("unable to detect terminal font size")
+
+func (m FontSizeMethod) String() string {
+	switch m {
+	case ITerm2ReportCellSize:
+		return "ITerm2ReportCellSize"
+	case CSI16t:
+		return "CSI16t"
+	case CSI14t18t:
+		return "CSI14t+18t"
+	case XTSMGRAPHICS:
+		return "XTSMGRAPHICS"
+	case Fallback:
+		return "Fallback"
+	default:
+		return "unknown"
+	}
+}
+
+var (
+	fontSizeMu    sync.Mutex
+	fontSizeOrder = DefaultFontSizeDetectionOrder()
+	// defaultFontWidth and defaultFontHeight are set by SetDefaultFontSize
+	defaultFontWidth, defaultFontHeight int
+	// detectedFontSize is the last font size detected by GetTerminalFontSize (nil until detected)
+	detectedFontSize *cachedDetection[[2]int]
+	// fontSizeMethods maps each method to its implementation (swappable in tests)
+	fontSizeMethods = map[FontSizeMethod]func() (int, int, error){
+		ITerm2ReportCellSize: fontSizeITerm2,
+		CSI16t:               fontSizeCSI16t,
+		CSI14t18t:            fontSizeCSI14t18t,
+		XTSMGRAPHICS:         fontSizeXTSMGRAPHICS,
+		Fallback:             fontSizeFallback,
+	}
+)
+
+// DefaultFontSizeDetectionOrder returns the order in which font size detection methods are tried by default
+func DefaultFontSizeDetectionOrder() []FontSizeMethod {
+	return []FontSizeMethod{ITerm2ReportCellSize, CSI16t, CSI14t18t, XTSMGRAPHICS, Fallback}
+}
+
+// SetFontSizeDetectionOrder sets the order in which GetTerminalFontSize tries each detection method.
+// Methods left out of the list are never tried, so a method that misbehaves on a
+// given terminal can be skipped entirely. An empty list restores the default order.
+func SetFontSizeDetectionOrder(methods []FontSizeMethod) {
+	fontSizeMu.Lock()
+	defer fontSizeMu.Unlock()
+	detectedFontSize = nil
+	if len(methods) == 0 {
+		fontSizeOrder = DefaultFontSizeDetectionOrder()
+		return
+	}
+	fontSizeOrder = append([]FontSizeMethod(nil), methods...)
+}
+
+// SetDefaultFontSize sets the terminal's font (cell) size in pixels, for apps that already know their
+// cell geometry, so GetTerminalFontSize returns it without querying the terminal (avoiding the cost and
+// the raw mode flicker of the queries). A size of 0 restores detection.
+func SetDefaultFontSize(width, height int) {
+	fontSizeMu.Lock()
+	defer fontSizeMu.Unlock()
+	defaultFontWidth, defaultFontHeight = max(width, 0), max(height, 0)
+}
+
+// GetTerminalFontSize returns the terminal's font (cell) size in pixels set by SetDefaultFontSize, or
+// else detected using the first detection method (in the configured order) that succeeds. The detected
+// size is cached (see SetDetectionCacheTTL), failures are detected again on the next call.
+func GetTerminalFontSize() (width, height int, err error) {
+	fontSizeMu.Lock()
+	order := append([]FontSizeMethod(nil), fontSizeOrder...)
+	width, height = defaultFontWidth, defaultFontHeight
+	detected := detectedFontSize
+	fontSizeMu.Unlock()
+	if width > 0 && height > 0 {
+		return width, height, nil
+	}
+	if detected != nil && detected.fresh() {
+		return detected.value[0], detected.value[1], nil
+	}
+
+	for _, method := range order {
+		fn, ok := fontSizeMethods[method]
+		if !ok {
+			continue
+		}
+		if width, height, err = fn(); err == nil && width > 0 && height > 0 {
+			fontSizeMu.Lock()
+			result := newCachedDetection([2]int{width, height})
+			detectedFontSize = &result
+			fontSizeMu.Unlock()
+			return width, height, nil
+		}
+	}
+	return 0, 0, ErrFontSizeUnknown
+}
+
+// knownFontSize returns the font size set by SetDefaultFontSize or already detected by
+// GetTerminalFontSize (and still valid), without querying the terminal
+func knownFontSize() (width, height int, ok bool) {
+	fontSizeMu.Lock()
+	defer fontSizeMu.Unlock()
+	if defaultFontWidth > 0 && defaultFontHeight > 0 {
+		return defaultFontWidth, defaultFontHeight, true
+	}
+	if detectedFontSize != nil && detectedFontSize.fresh() {
+		return detectedFontSize.value[0], detectedFontSize.value[1], true
+	}
+	return 0, 0, false
+}
+
+// FontSize sets the terminal's font (cell) size in pixels used for the image, overriding
+// SetDefaultFontSize and detection, so rendering it never queries the terminal for it
+func (ti *TermImg) FontSize(width, height int) *TermImg {
+	ti.fontWidth = max(width, 0)
+	ti.fontHeight = max(height, 0)
+	ti.invalidate()
+	return ti
+}
+
+// fontSize returns the font size set with FontSize, or else GetTerminalFontSize
+func (ti *TermImg) fontSize() (int, int, error) {
+	if ti.fontWidth > 0 && ti.fontHeight > 0 {
+		return ti.fontWidth, ti.fontHeight, nil
+	}
+	return GetTerminalFontSize()
+}
+
+func fontSizeITerm2() (int, int, error) {
+	if !checkITerm2Support(context.Background()) {
+		return 0, 0, fmt.Errorf("iTerm2 not detected")
+	}
+	resp, err := queryTerminal(context.Background(), START+"]1337;ReportCellSize\x07"+CLOSE)
+	if err != nil {
+		return 0, 0, err
+	}
+	return parseITerm2CellSize(resp)
+}
+
+func fontSizeCSI16t() (int, int, error) {
+	resp, err := queryTerminal(context.Background(), "\x1b[16t")
+	if err != nil {
+		return 0, 0, err
+	}
+	params, err := parseCSIResponse(resp, 't')
+	if err != nil {
+		return 0, 0, err
+	}
+	if len(params) != 3 || params[0] != 6 {
+		return 0, 0, fmt.Errorf("unexpected cell size response: %q", resp)
+	}
+	return params[2], params[1], nil
+}
+
+func fontSizeCSI14t18t() (int, int, error) {
+	resp, err := queryTerminal(context.Background(), "\x1b[14t")
+	if err != nil {
+		return 0, 0, err
+	}
+	pixels, err := parseCSIResponse(resp, 't')
+	if err != nil {
+		return 0, 0, err
+	}
+	if len(pixels) != 3 || pixels[0] != 4 {
+		return 0, 0, fmt.Errorf("unexpected window size response: %q", resp)
+	}
+	resp, err = queryTerminal(context.Background(), "\x1b[18t")
+	if err != nil {
+		return 0, 0, err
+	}
+	cells, err := parseCSIResponse(resp, 't')
+	if err != nil {
+		return 0, 0, err
+	}
+	if len(cells) != 3 || cells[0] != 8 || cells[1] == 0 || cells[2] == 0 {
+		return 0, 0, fmt.Errorf("unexpected text area size response: %q", resp)
+	}
+	return pixels[2] / cells[2], pixels[1] / cells[1], nil
+}
+
+func fontSizeXTSMGRAPHICS() (int, int, error) {
+	cols, rows, err := terminalSize()
+	if err != nil {
+		return 0, 0, err
+	}
+	if cols == 0 || rows == 0 {
+		return 0, 0, fmt.Errorf("invalid terminal size %dx%d", cols, rows)
+	}
+	resp, err := queryTerminal(context.Background(), "\x1b[?2;1;0S")
+	if err != nil {
+		return 0, 0, err
+	}
+	params, err := parseCSIResponse(resp, 'S')
+	if err != nil {
+		return 0, 0, err
+	}
+	// response: CSI ? 2 ; status ; width ; height S
+	if len(params) != 4 || params[0] != 2 || params[1] != 0 {
+		return 0, 0, fmt.Errorf("unexpected graphics geometry response: %q", resp)
+	}
+	return params[2] / cols, params[3] / rows, nil
+}
+
+func fontSizeFallback() (int, int, error) {
+	return DEFAULT_FONT_WIDTH, DEFAULT_FONT_HEIGHT, nil
+}
+
+// parseCSIResponse parses a `CSI [?] Ps ; ... final` response into its numeric parameters
+func parseCSIResponse(in []byte, final byte) ([]int, error) {
+	start := bytes.Index(in, []byte("\x1b["))
+	if start < 0 {
+		return nil, fmt.Errorf("invalid CSI response: %q", in)
+	}
+	in = in[start+2:]
+	end := bytes.IndexByte(in, final)
+	if end < 0 {
+		return nil, fmt.Errorf("invalid CSI response: missing final byte %q", final)
+	}
+	in = bytes.TrimPrefix(in[:end], []byte("?"))
+	var params []int
+	for _, field := range bytes.Split(in, []byte(";")) {
+		n, err := strconv.Atoi(string(field))
+		if err != nil {
+			return nil, fmt.Errorf("invalid CSI response parameter %q: %v", field, err)
+		}
+		params = append(params, n)
+	}
+	return params, nil
+}
+
+// parseITerm2CellSize parses a `OSC 1337;ReportCellSize=height;width[;scale] ST` response
+func parseITerm2CellSize(in []byte) (int, int, error) {
+	const prefix = "]1337;ReportCellSize="
+	start := bytes.Index(in, []byte(prefix))
+	if start < 0 {
+		return 0, 0, fmt.Errorf("invalid ReportCellSize response: %q", in)
+	}
+	in = in[start+len(prefix):]
+	if end := bytes.IndexAny(in, "\x1b\x07"); end >= 0 {
+		in = in[:end]
+	}
+	fields := bytes.Split(in, []byte(";"))
+	if len(fields) < 2 {
+		return 0, 0, fmt.Errorf("invalid ReportCellSize response: %q", in)
+	}
+	height, err := strconv.ParseFloat(string(fields[0]), 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid ReportCellSize height: %v", err)
+	}
+	width, err := strconv.ParseFloat(string(fields[1]), 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid ReportCellSize width: %v", err)
+	}
+	scale := 1.0
+	if len(fields) > 2 {
+		if scale, err = strconv.ParseFloat(string(fields[2]), 64); err != nil {
+			return 0, 0, fmt.Errorf("invalid ReportCellSize scale: %v", err)
+		}
+	}
+	return int(width * scale), int(height * scale), nil
+}
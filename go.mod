@@ -2,6 +2,8 @@ module github.com/blacktop/go-termimg
 
 go 1.23.0
 
-require golang.org/x/term v0.28.0
-
-require golang.org/x/sys v0.29.0 // indirect
+require (
+	golang.org/x/image v0.24.0
+	golang.org/x/sys v0.29.0
+	golang.org/x/term v0.28.0
+)
@@ -0,0 +1,52 @@
+package termimg
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ControlInfo describes the escape sequences an image renders to, without their image data
+// (see Inspect)
+type ControlInfo struct {
+	Protocol Protocol
+	Width    int    // width in pixels of the transmitted (or drawn) image
+	Height   int    // height in pixels of the transmitted (or drawn) image
+	Cols     int    // number of cells the image occupies horizontally
+	Rows     int    // number of cells the image occupies vertically
+	Size     int    // size in bytes of the encoded image data, before base64
+	Chunks   int    // number of escape sequences the transfer is split into
+	Control  string // Kitty: control data of the first chunk, iTerm2: arguments of the file transfer
+}
+
+// Inspect renders the image and describes the result without its binary payload: the protocol,
+// the pixel and cell dimensions, how the transfer is split and its control data, e.g. to debug
+// why an image is displayed with the wrong size. Images drawn with Blocks, or split into strips
+// (see Wrap), have no transfer to describe: only their dimensions are set.
+func (ti *TermImg) Inspect() (ControlInfo, error) {
+	out, err := ti.render()
+	if err != nil {
+		return ControlInfo{}, err
+	}
+	info := ControlInfo{Protocol: ti.protocol}
+	info.Cols, info.Rows, err = ti.cells()
+	if err != nil {
+		return ControlInfo{}, err
+	}
+	if ti.protocol == Blocks || ti.stripWidth() > 0 {
+		b := ti.processImage().Bounds()
+		info.Width, info.Height = b.Dx(), b.Dy()
+		return info, nil
+	}
+	info.Width, info.Height, info.Size = ti.width, ti.height, ti.size
+	switch ti.protocol {
+	case Kitty:
+		info.Control = ti.kittyTransferControl(ACTION_TRANSFER)
+		info.Chunks = strings.Count(out, START+"_G")
+	case ITerm2:
+		info.Control = ti.iterm2Arguments()
+		info.Chunks = strings.Count(out, START+"]1337;")
+	default:
+		return ControlInfo{}, fmt.Errorf("%w: %s", ErrProtocolUnavailable, ti.protocol)
+	}
+	return info, nil
+}
@@ -1,13 +1,33 @@
 package termimg
 
 import (
+	"context"
 	"encoding/base64"
 	"fmt"
+	"io"
 	"os"
 	"slices"
+	"strings"
+	"sync"
+
+	"golang.org/x/term"
 )
 
-func checkITerm2Support() bool {
+// ITERM2_CHUNK_SIZE is the default number of raw bytes sent per part of a multipart file transfer
+const ITERM2_CHUNK_SIZE = 0x40000
+
+// imageRegion is the screen area (0-based cell coordinates) covered by a printed image
+type imageRegion struct {
+	row, col   int
+	cols, rows int
+}
+
+var (
+	itermRegionsMu sync.Mutex
+	itermRegions   []*imageRegion
+)
+
+func checkITerm2Support(ctx context.Context) bool {
 	// iTerm2 doesn't have a specific query mechanism, so we'll use a heuristic to check the env
 	switch {
 	case os.Getenv("TERM_PROGRAM") == "iTerm.app":
@@ -16,62 +36,161 @@ func checkITerm2Support() bool {
 		return true
 	case os.Getenv("TERM") == "mintty":
 		return true
+	case os.Getenv("TERM_PROGRAM") == "":
+		// launched without TERM_PROGRAM (e.g. from a login shell or a launcher), ask the terminal itself
+		name, err := queryTerminalName(ctx)
+		return err == nil && strings.HasPrefix(name, "iTerm2")
 	default:
 		return false
 	}
 }
 
+// iterm2ChunkSize returns the number of raw bytes sent in each part of a multipart file transfer
+func (ti *TermImg) iterm2ChunkSize() int {
+	chunkSize := ITERM2_CHUNK_SIZE
+	if ti.chunkSize > 0 {
+		chunkSize = ti.chunkSize
+	}
+	if ti.maxLineLength > 0 {
+		// every 3 raw bytes are encoded as 4 base64 characters
+		chunkSize = min(chunkSize, max(ti.maxLineLength/4*3, 3))
+	}
+	return chunkSize
+}
+
+// iterm2Dimensions returns the width and height arguments of the inline file transfer
+func (ti *TermImg) iterm2Dimensions() string {
+	if cols, rows := ti.fillCells(); cols > 0 {
+		return fmt.Sprintf("width=%d;height=%d;preserveAspectRatio=0", cols, rows)
+	}
+	width, height := ti.displaySize()
+	return fmt.Sprintf("width=%dpx;height=%dpx", width, height)
+}
+
+// iterm2Arguments returns the arguments of the image's (first) inline file transfer
+func (ti *TermImg) iterm2Arguments() string {
+	return fmt.Sprintf("inline=1;size=%d;%s;doNotMoveCursor=1", ti.size, ti.iterm2Dimensions())
+}
+
+// renderITerm2 encodes the image as iTerm2 inline file transfers. The OSC sequences are
+// terminated by BEL only (like the other OSC sequences sent by this package), Kitty APC
+// sequences by ST (ESCAPE).
 func (ti *TermImg) renderITerm2() (string, error) {
-	if ti.encoded == "" {
-		data, err := ti.AsJPEGBytes()
+	if ti.encoded == "" && !ti.loadRenderCache() {
+		data, _, err := ti.encodeData()
 		if err != nil {
 			return "", err
 		}
-		ti.size = len(data)
-		ti.width = (*ti.img).Bounds().Dx()
-		ti.height = (*ti.img).Bounds().Dy()
 		// encode iTerm2 escape sequence
-		if len(data) > 0x40000 {
+		chunkSize := ti.iterm2ChunkSize()
+		if len(data) > chunkSize {
 			isfirt := true
-			for chunk := range slices.Chunk(data, 0x40000) {
+			for chunk := range slices.Chunk(data, chunkSize) {
 				if isfirt {
-					ti.encoded = START + fmt.Sprintf("]1337;MultipartFile=inline=1;size=%d;width=%dpx;height=%dpx;doNotMoveCursor=1:%s\x07",
-						ti.size,
-						ti.width,
-						ti.height,
+					ti.encoded = START + fmt.Sprintf("]1337;MultipartFile=%s:%s\x07",
+						ti.iterm2Arguments(),
 						base64.StdEncoding.EncodeToString(chunk),
-					) + ESCAPE + CLOSE
+					) + CLOSE
 					isfirt = false
 				} else {
 					ti.encoded += START + fmt.Sprintf("]1337;FilePart=inline=1:%s\x07",
 						base64.StdEncoding.EncodeToString(chunk),
-					) + ESCAPE + CLOSE
+					) + CLOSE
 				}
 			}
-			ti.encoded += START + "]1337;FileEnd\x07" + ESCAPE + CLOSE
+			ti.encoded += START + "]1337;FileEnd\x07" + CLOSE
 		} else {
-			ti.encoded = START + fmt.Sprintf("]1337;File=inline=1;size=%d;width=%dpx;height=%dpx;doNotMoveCursor=1:%s\x07",
-				ti.size,
-				ti.width,
-				ti.height,
+			ti.encoded = START + fmt.Sprintf("]1337;File=%s:%s\x07",
+				ti.iterm2Arguments(),
 				base64.StdEncoding.EncodeToString(data),
-			) + ESCAPE + CLOSE
+			) + CLOSE
 		}
+		ti.storeRenderCache()
 	}
 	return ti.encoded, nil
 }
 
-func (ti *TermImg) printITerm2() error {
+func (ti *TermImg) printITerm2(w io.Writer) error {
 	out, err := ti.renderITerm2()
 	if err != nil {
 		return err
 	}
 
-	fmt.Println(out)
+	if isTerminal(w) {
+		// the cursor position is only where the image is drawn if it is written to the terminal
+		ti.trackITerm2Region()
+	}
 
+	if err := ti.writeTransfer(w, out); err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(w)
+	return err
+}
+
+// isTerminal reports whether w writes to a terminal (swappable in tests)
+var isTerminal = func(w io.Writer) bool {
+	f, ok := w.(*os.File)
+	return ok && term.IsTerminal(int(f.Fd()))
+}
+
+// trackITerm2Region records where the image is about to be drawn (via a cursor position
+// report) and its footprint in cells, so it can later be cleared by overwriting it
+func (ti *TermImg) trackITerm2Region() {
+	resp, err := queryTerminal(context.Background(), "\x1b[6n")
+	if err != nil {
+		return
+	}
+	pos, err := parseCSIResponse(resp, 'R')
+	if err != nil || len(pos) != 2 {
+		return
+	}
+	cols, rows, err := ti.cells()
+	if err != nil {
+		return
+	}
+	ti.region = &imageRegion{
+		row:  pos[0] - 1, // cursor position reports are 1-based
+		col:  pos[1] - 1,
+		cols: cols,
+		rows: rows,
+	}
+	itermRegionsMu.Lock()
+	itermRegions = append(itermRegions, ti.region)
+	itermRegionsMu.Unlock()
+}
+
+// clearSequence returns the escape sequence that overwrites the region with spaces
+// while preserving the cursor position
+func (r *imageRegion) clearSequence() string {
+	var sb strings.Builder
+	sb.WriteString("\x1b7") // save cursor
+	for row := r.row; row < r.row+r.rows; row++ {
+		sb.WriteString(cursorTo(r.col, row) + strings.Repeat(" ", r.cols))
+	}
+	sb.WriteString("\x1b8") // restore cursor
+	return sb.String()
+}
+
+// clearITerm2 overwrites the image's tracked region with spaces, as iTerm2 has no way to delete an image
+func (ti *TermImg) clearITerm2(w io.Writer) error {
+	if ti.region == nil {
+		return nil // image was never printed or its position could not be determined
+	}
+	io.WriteString(w, ti.region.clearSequence())
+	itermRegionsMu.Lock()
+	itermRegions = slices.DeleteFunc(itermRegions, func(r *imageRegion) bool { return r == ti.region })
+	itermRegionsMu.Unlock()
+	ti.region = nil
 	return nil
 }
 
-func (ti *TermImg) clearITerm2() error {
-	return nil // TODO: implement this: we must redraw the image with " " to clear it
+// clearAllITerm2 overwrites every tracked iTerm2 image region with spaces
+func clearAllITerm2(w io.Writer) {
+	itermRegionsMu.Lock()
+	defer itermRegionsMu.Unlock()
+	for _, r := range itermRegions {
+		io.WriteString(w, r.clearSequence())
+	}
+	itermRegions = nil
 }
@@ -2,13 +2,19 @@ package termimg
 
 import (
 	"bytes"
+	"context"
 	"encoding/base64"
 	"fmt"
+	"hash/fnv"
+	"image"
+	"io"
+	"math/rand/v2"
 	"os"
+	"slices"
+	"strconv"
 	"strings"
-	"time"
-
-	"golang.org/x/term"
+	"sync"
+	"sync/atomic"
 )
 
 // ref: https://github.com/kovidgoyal/kitty/tree/master/kittens/icat
@@ -18,10 +24,12 @@ const (
 	DATA_RGBA_24_BIT = "f=24"
 	DATA_PNG         = "f=100"
 
-	ACTION_TRANSFER  = "a=T"
+	ACTION_TRANSFER  = "a=T" // transmit and display
+	ACTION_TRANSMIT  = "a=t" // transmit only
 	ACTION_DELETE    = "a=d"
 	ACTION_QUERY     = "a=q"
 	ACTION_ANIMATE   = "a=a"
+	ACTION_FRAME     = "a=f"
 	ACTION_PLACEMENT = "a=p"
 
 	COMPRESS_ZLIB = "0=z"
@@ -31,7 +39,8 @@ const (
 	TRANSFER_TEMP   = "t=t"
 	TRANSFER_SHARED = "t=s"
 
-	DELETE_WITH_ID          = "d=i"
+	DELETE_WITH_ID          = "d=i" // delete the placements, keep the image data
+	DELETE_WITH_ID_AND_DATA = "d=I" // delete the placements and free the image data
 	DELETE_NEWEST           = "d=n"
 	DELETE_AT_CURSOR        = "d=c"
 	DELETE_ANIMATION_FRAMES = "d=a"
@@ -41,8 +50,90 @@ const (
 	SUPPRESS_ERR = "q=2"
 )
 
+// KITTY_CHUNK_SIZE is the default number of raw bytes sent per chunk of a Kitty transfer (4096 base64 bytes)
+const KITTY_CHUNK_SIZE = 3072
+
 var ErrEmptyResponse = fmt.Errorf("empty response")
 
+// globalKittyImageID is the last Kitty image ID handed out (seeded randomly so
+// separate processes drawing to the same terminal are unlikely to collide)
+var globalKittyImageID atomic.Uint32
+
+func init() {
+	globalKittyImageID.Store(rand.Uint32N(1 << 24))
+}
+
+// ResetKittyImageIDs restarts the automatic Kitty image IDs from 1, making them deterministic (e.g. in
+// tests). IDs of images still displayed by the terminal will be reused, replacing those images.
+func ResetKittyImageIDs() {
+	globalKittyImageID.Store(0)
+}
+
+// KittyImageID forces the Kitty image ID the image is transmitted with, instead of the next automatic
+// one, for workflows that refer to images by known IDs (e.g. PlaceByID). 0 restores automatic IDs.
+func (ti *TermImg) KittyImageID(id uint32) *TermImg {
+	ti.kittyID = id
+	ti.kittyIDForced = id != 0
+	ti.cacheKey = ""
+	ti.invalidate()
+	return ti
+}
+
+// KittyID returns the image's Kitty image ID, the one it is transmitted with, e.g. to place it again
+// with PlaceByID or delete it with ClearImages after printing it
+func (ti *TermImg) KittyID() uint32 {
+	return ti.kittyImageID()
+}
+
+// kittyImageID returns the image's Kitty image ID, allocating one on first use
+func (ti *TermImg) kittyImageID() uint32 {
+	if ti.kittyID == 0 {
+		ti.kittyID = globalKittyImageID.Add(1)
+	}
+	return ti.kittyID
+}
+
+// CacheKey gives the image a stable Kitty image ID derived from key, instead of a new one for
+// each image. Printing an image with a cache key first tries to display the image the terminal
+// already holds under that ID (e.g. an icon printed earlier, even by another process), and only
+// transmits the image data if the terminal doesn't have it.
+func (ti *TermImg) CacheKey(key string) *TermImg {
+	ti.cacheKey = key
+	ti.kittyID = 0
+	ti.kittyIDForced = false
+	if key != "" {
+		ti.kittyID = cacheKeyImageID(key)
+	}
+	ti.invalidate()
+	return ti
+}
+
+// cacheKeyImageID maps a cache key to a deterministic image ID (with the high bit set, so it can't
+// collide with the IDs handed out by globalKittyImageID)
+func cacheKeyImageID(key string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return h.Sum32() | 1<<31
+}
+
+// placeCachedKitty displays the image if the terminal already holds it (under its cache key ID)
+func (ti *TermImg) placeCachedKitty(w io.Writer) bool {
+	// the query is answered by (and places the image in) the terminal, so w must be the terminal
+	if ti.cacheKey == "" || w != os.Stdout {
+		return false
+	}
+	// without q=, the terminal answers OK or ENOENT if it doesn't have the image
+	resp, err := queryTerminal(context.Background(), START+fmt.Sprintf("_G%s", strings.Join(append([]string{ACTION_PLACEMENT}, ti.kittyOptions()...), ","))+ESCAPE+CLOSE)
+	if err != nil || !kittyResponseOK(resp, strconv.FormatUint(uint64(ti.kittyID), 10)) {
+		return false
+	}
+	fmt.Fprintln(w)
+	return true
+}
+
+// kittyPrinted tracks whether any Kitty image has been printed or rendered (and not yet cleared)
+var kittyPrinted atomic.Bool
+
 type KittyResponse struct {
 	ID      string
 	Message string
@@ -73,26 +164,6 @@ func parseResponse(in []byte) (*KittyResponse, error) {
 	return &resp, nil
 }
 
-func readStdin() []byte {
-	buf := make([]byte, 100)
-	done := make(chan bool)
-
-	time.AfterFunc(1*time.Second, func() {
-		done <- true
-	})
-
-	go func() {
-		_, _ = os.Stdin.Read(buf)
-		done <- false
-	}()
-
-	if <-done {
-		return nil // timeout
-	} else {
-		return buf
-	}
-}
-
 func dumbKittySupport() bool {
 	switch {
 	case os.Getenv("KITTY_WINDOW_ID") != "":
@@ -107,103 +178,540 @@ func dumbKittySupport() bool {
 }
 
 // Send a query action followed by a request for primary device attributes
-func checkKittySupport() bool {
+func checkKittySupport(ctx context.Context) bool {
 	if dumbKittySupport() {
 		return true
 	}
 
-	oldState, err := term.MakeRaw(int(os.Stdin.Fd()))
+	id := "42"
+
+	// Send a query action
+	resp, err := queryTerminal(ctx, START+fmt.Sprintf("_Gi=%s,s=1,v=1,a=q,t=d,f=24;AAAA", id)+ESCAPE+CLOSE)
 	if err != nil {
 		return false
 	}
-	defer term.Restore(int(os.Stdin.Fd()), oldState)
+	if resp, err := parseResponse(resp); err != nil || resp.ID != id || ctx.Err() != nil {
+		return false
+	}
 
-	id := "42"
+	// some terminals answer the query but fail to display transmitted images
+	return kittyTransmissionSupported(ctx)
+}
 
-	// Send a query action followed by a request for primary device attributes
-	fmt.Printf(START + fmt.Sprintf("_Gi=%s,s=1,v=1,a=q,t=d,f=24;AAAA", id) + ESCAPE + CLOSE)
+var (
+	kittyTransmissionMu sync.Mutex
+	kittyTransmission   *cachedDetection[bool] // nil until probed
+)
 
-	// Read response
-	if resp, err := parseResponse(readStdin()); err != nil {
+// kittyTransmissionSupported transmits a 1x1 RGBA image (once per process, or per detection
+// cache TTL) and checks that the terminal acknowledges it, as partial implementations accept
+// queries but reject the actual transmission. A probe ended by ctx isn't cached.
+func kittyTransmissionSupported(ctx context.Context) bool {
+	kittyTransmissionMu.Lock()
+	defer kittyTransmissionMu.Unlock()
+	if kittyTransmission != nil && kittyTransmission.fresh() {
+		return kittyTransmission.value
+	}
+	id := "43"
+	resp, err := queryTerminal(ctx, START+fmt.Sprintf("_Gi=%s,s=1,v=1,a=t,t=d,f=32;AAAAAA==", id)+ESCAPE+CLOSE)
+	ok := err == nil && kittyResponseOK(resp, id)
+	// delete the probe image and free its data
+	fmt.Print(START + fmt.Sprintf("_Ga=d,d=I,i=%s,%s", id, SUPPRESS_ERR) + ESCAPE + CLOSE)
+	if ctx.Err() != nil {
+		return false
+	}
+	result := newCachedDetection(ok)
+	kittyTransmission = &result
+	return ok
+}
+
+// kittyResponseOK reports whether the response acknowledges the image id without error
+func kittyResponseOK(in []byte, id string) bool {
+	resp, err := parseResponse(in)
+	if err != nil {
 		return false
+	}
+	return resp.ID == id && resp.Message == "OK"
+}
+
+// KittyQuiet sets which responses the terminal sends back for the image's Kitty commands (the q= key):
+// 0 for all responses, 1 for errors only and 2 for none (the default). Responses are useful to diagnose
+// why images don't appear (e.g. on a remote host), see PrintWithResponse.
+func (ti *TermImg) KittyQuiet(n int) *TermImg {
+	n = min(max(n, 0), 2)
+	ti.kittyQuiet = &n
+	ti.invalidate()
+	return ti
+}
+
+// KittyDoNotMoveCursor keeps the cursor where it is when the image is displayed (the C=1 key), like
+// iTerm2 images always do, instead of moving it past the image, e.g. so TUI text doesn't get pushed
+func (ti *TermImg) KittyDoNotMoveCursor(doNotMove bool) *TermImg {
+	ti.kittyNoMove = doNotMove
+	ti.invalidate()
+	return ti
+}
+
+// kittyQuietKeys returns the q= keys of the image's Kitty commands, or defaults when KittyQuiet wasn't set
+func (ti *TermImg) kittyQuietKeys(defaults ...string) []string {
+	if ti.kittyQuiet == nil {
+		return defaults
+	}
+	switch *ti.kittyQuiet {
+	case 0:
+		return nil
+	case 1:
+		return []string{SUPPRESS_OK}
+	default:
+		return []string{SUPPRESS_ERR}
+	}
+}
+
+// PrintWithResponse prints the image (Kitty only) and returns the terminal's response to its transfer.
+// The terminal only responds when allowed to by KittyQuiet: use KittyQuiet(0) to get the OK as well as
+// errors, with KittyQuiet(1) a successful transfer returns ErrEmptyResponse.
+func (ti *TermImg) PrintWithResponse() (*KittyResponse, error) {
+	return ti.PrintWithResponseTo(os.Stdout)
+}
+
+// PrintWithResponseTo is like PrintWithResponse but writes to w. The response is read from stdin,
+// so w must write to the same terminal (e.g. /dev/tty when stdout is redirected).
+func (ti *TermImg) PrintWithResponseTo(w io.Writer) (*KittyResponse, error) {
+	if ti.protocol != Kitty {
+		return nil, fmt.Errorf("responses are not supported by the %s protocol", ti.protocol)
+	}
+	if err := ti.load(); err != nil {
+		return nil, err
+	}
+	out, err := ti.renderKitty()
+	if err != nil {
+		return nil, err
+	}
+	kittyPrinted.Store(true)
+	var resp []byte
+	if w == os.Stdout {
+		resp, err = queryTerminal(context.Background(), out) // swappable in tests
 	} else {
-		return resp.ID == id
+		resp, err = queryTerminalTo(context.Background(), w, out)
+	}
+	if err != nil {
+		return nil, err
+	}
+	fmt.Fprintln(w)
+	return parseResponse(resp)
+}
+
+// kittyOptions returns the optional control data keys for the image's options
+func (ti *TermImg) kittyOptions() []string {
+	opts := []string{fmt.Sprintf("i=%d", ti.kittyImageID())}
+	if ti.layer != 0 {
+		opts = append(opts, fmt.Sprintf("z=%d", ti.layer))
 	}
+	if ti.offsetX > 0 {
+		opts = append(opts, fmt.Sprintf("X=%d", ti.offsetX))
+	}
+	if ti.offsetY > 0 {
+		opts = append(opts, fmt.Sprintf("Y=%d", ti.offsetY))
+	}
+	if ti.kittyNoMove {
+		opts = append(opts, "C=1")
+	}
+	if cols, rows := ti.fillCells(); cols > 0 {
+		opts = append(opts, fmt.Sprintf("c=%d", cols), fmt.Sprintf("r=%d", rows))
+	} else if ti.overflow == OverflowDownscale {
+		if limit := ti.overflowLimit(); limit != nil {
+			// only set the rows, Kitty computes the columns from the aspect ratio
+			opts = append(opts, fmt.Sprintf("r=%d", limit.rows))
+		}
+	}
+	return opts
 }
 
-// TODO: chunk this up with the `m=1` command
 func (ti *TermImg) renderKitty() (string, error) {
-	if ti.encoded == "" {
-		data, err := ti.AsPNGBytes()
+	if ti.encoded == "" && !ti.loadRenderCache() {
+		encoded, err := ti.encodeKitty(ACTION_TRANSFER)
 		if err != nil {
 			return "", err
 		}
-		ti.size = len(data)
-		ti.width = (*ti.img).Bounds().Dx()
-		ti.height = (*ti.img).Bounds().Dy()
-		// encode Kitty escape sequence
-		ti.encoded = START + fmt.Sprintf(
-			"_Gs=%d,v=%d,%s;%s",
-			ti.width,
-			ti.height,
-			strings.Join([]string{
-				DATA_PNG,
-				ACTION_TRANSFER,
-				TRANSFER_DIRECT,
-				SUPPRESS_OK,
-				SUPPRESS_ERR,
-			}, ","),
-			base64.StdEncoding.EncodeToString(data),
-		) + ESCAPE + CLOSE
+		ti.encoded = encoded
+		ti.storeRenderCache()
 	}
 	return ti.encoded, nil
 }
 
-func (ti *TermImg) printKitty() error {
+// encodeKitty encodes the image as a Kitty escape sequence that transmits it with the given action
+func (ti *TermImg) encodeKitty(action string) (string, error) {
+	data, _, err := ti.encodeData()
+	if err != nil {
+		return "", err
+	}
+	// encode Kitty escape sequence
+	return kittyChunks(ti.kittyTransferControl(action), data, ti.kittyChunkSize()), nil
+}
+
+// kittyTransferControl returns the control data of a direct transfer of the encoded image
+func (ti *TermImg) kittyTransferControl(action string) string {
+	return fmt.Sprintf(
+		"s=%d,v=%d,%s",
+		ti.width,
+		ti.height,
+		strings.Join(slices.Concat([]string{
+			DATA_PNG,
+			action,
+			TRANSFER_DIRECT,
+		}, ti.kittyQuietKeys(SUPPRESS_OK, SUPPRESS_ERR), ti.kittyOptions()), ","),
+	)
+}
+
+// KittyChunkSize sets the number of raw image bytes sent in each escape sequence of a Kitty transfer
+// (KITTY_CHUNK_SIZE by default, rounded down to a multiple of 3 so every chunk is whole base64).
+// Larger chunks reduce the escape sequence overhead on fast local terminals, smaller ones can avoid
+// buffer stalls over SSH. Note the protocol recommends at most 4096 base64 bytes (3072 raw bytes) per chunk.
+func (ti *TermImg) KittyChunkSize(n int) *TermImg {
+	ti.kittyChunk = n
+	ti.invalidate()
+	return ti
+}
+
+// kittyChunkSize returns the number of raw bytes sent in each chunk of a Kitty transfer
+func (ti *TermImg) kittyChunkSize() int {
+	if ti.kittyChunk <= 0 {
+		return KITTY_CHUNK_SIZE
+	}
+	return max(ti.kittyChunk/3*3, 3)
+}
+
+// kittyChunks encodes data as a Kitty transfer with the given control data, split into chunks of
+// chunkSize raw bytes: the first chunk carries the control data and every chunk but the last m=1
+func kittyChunks(control string, data []byte, chunkSize int) string {
+	var sb strings.Builder
+	writeKittyChunks(&sb, control, data, chunkSize, nil)
+	return sb.String()
+}
+
+// writeKittyChunks writes the chunks of kittyChunks to w one by one, calling progress (if not nil)
+// after each one
+func writeKittyChunks(w io.Writer, control string, data []byte, chunkSize int, progress func(sent, total int)) error {
+	if len(data) <= chunkSize {
+		_, err := io.WriteString(w, START+fmt.Sprintf("_G%s;%s", control, base64.StdEncoding.EncodeToString(data))+ESCAPE+CLOSE)
+		if err == nil && progress != nil {
+			progress(1, 1)
+		}
+		return err
+	}
+	total := ceilDiv(len(data), chunkSize)
+	for i := 0; i < len(data); i += chunkSize {
+		more := 0
+		if i+chunkSize < len(data) {
+			more = 1
+		}
+		keys := fmt.Sprintf("m=%d", more)
+		if i == 0 {
+			keys = control + "," + keys
+		}
+		chunk := base64.StdEncoding.EncodeToString(data[i:min(i+chunkSize, len(data))])
+		if _, err := io.WriteString(w, START+fmt.Sprintf("_G%s;%s", keys, chunk)+ESCAPE+CLOSE); err != nil {
+			return err
+		}
+		if progress != nil {
+			progress(i/chunkSize+1, total)
+		}
+	}
+	return nil
+}
+
+// PrintStreaming prints the image to w like PrintTo (Kitty only), but encodes and writes the
+// transfer one chunk at a time instead of building the whole escape sequence first, so only the
+// (compressed) PNG data and a single base64 chunk are held in memory. Useful for very large images
+// on memory constrained devices. The output isn't kept for later renders.
+func (ti *TermImg) PrintStreaming(w io.Writer) error {
+	if ti.protocol != Kitty {
+		return fmt.Errorf("streaming is not supported by the %s protocol", ti.protocol)
+	}
+	if err := ti.load(); err != nil {
+		return err
+	}
+	data, _, err := ti.encodeData()
+	if err != nil {
+		return err
+	}
+	kittyPrinted.Store(true)
+	if err := writeKittyChunks(w, ti.kittyTransferControl(ACTION_TRANSFER), data, ti.kittyChunkSize(), ti.onProgress); err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(w)
+	return err
+}
+
+// Preload transmits the image data to the terminal without displaying it (Kitty only) and returns
+// its image ID. This moves the expensive transmission ahead of time (e.g. to a loading screen) so
+// PlaceByID can display the image instantly later.
+func (ti *TermImg) Preload() (uint32, error) {
+	return ti.PreloadTo(os.Stdout)
+}
+
+// PreloadTo is like Preload but writes to w
+func (ti *TermImg) PreloadTo(w io.Writer) (uint32, error) {
+	if ti.protocol != Kitty {
+		return 0, fmt.Errorf("preloading is not supported by the %s protocol", ti.protocol)
+	}
+	if err := ti.load(); err != nil {
+		return 0, err
+	}
+	out, err := ti.encodeKitty(ACTION_TRANSMIT)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := io.WriteString(w, out); err != nil {
+		return 0, err
+	}
+	return ti.kittyImageID(), nil
+}
+
+// PlaceByID displays a previously transmitted (e.g. preloaded) Kitty image with its top left
+// corner at the 0-based cell x,y, leaving the cursor where it was
+func PlaceByID(id uint32, x, y int) error {
+	return PlaceByIDTo(os.Stdout, id, x, y)
+}
+
+// PlaceByIDTo is like PlaceByID but writes to w
+func PlaceByIDTo(w io.Writer, id uint32, x, y int) error {
+	if x < 0 || y < 0 {
+		return fmt.Errorf("invalid cell position %d,%d", x, y)
+	}
+	_, err := io.WriteString(w,
+		"\x1b7"+ // save cursor
+			cursorTo(x, y)+
+			START+fmt.Sprintf("_G%s,i=%d,%s", ACTION_PLACEMENT, id, SUPPRESS_ERR)+ESCAPE+CLOSE+
+			"\x1b8") // restore cursor
+	kittyPrinted.Store(true)
+	return err
+}
+
+// PlaceByIDWithSize is like PlaceByID but scales the image to cols x rows cells (0 keeps the
+// image's size in that direction, or its aspect ratio if the other one is set), at z-index z
+func PlaceByIDWithSize(id uint32, x, y, z, cols, rows int) error {
+	return PlaceByIDWithSizeTo(os.Stdout, id, x, y, z, cols, rows)
+}
+
+// PlaceByIDWithSizeTo is like PlaceByIDWithSize but writes to w
+func PlaceByIDWithSizeTo(w io.Writer, id uint32, x, y, z, cols, rows int) error {
+	if x < 0 || y < 0 {
+		return fmt.Errorf("invalid cell position %d,%d", x, y)
+	}
+	if cols < 0 || rows < 0 {
+		return fmt.Errorf("invalid size %dx%d cells", cols, rows)
+	}
+	opts := []string{ACTION_PLACEMENT, fmt.Sprintf("i=%d", id)}
+	if cols > 0 {
+		opts = append(opts, fmt.Sprintf("c=%d", cols))
+	}
+	if rows > 0 {
+		opts = append(opts, fmt.Sprintf("r=%d", rows))
+	}
+	if z != 0 {
+		opts = append(opts, fmt.Sprintf("z=%d", z))
+	}
+	opts = append(opts, SUPPRESS_ERR)
+	_, err := io.WriteString(w,
+		"\x1b7"+ // save cursor
+			cursorTo(x, y)+
+			START+fmt.Sprintf("_G%s", strings.Join(opts, ","))+ESCAPE+CLOSE+
+			"\x1b8") // restore cursor
+	kittyPrinted.Store(true)
+	return err
+}
+
+// PlaceRelative displays a previously transmitted Kitty image offset from the cursor position by
+// cellX,cellY cells (negative is left/up) plus pixelX,pixelY pixels within that cell, at z-index z,
+// leaving the cursor where it was. This layers an image (e.g. a badge) a few pixels inside another
+// one printed at the cursor without computing absolute screen coordinates.
+func PlaceRelative(id uint32, cellX, cellY, pixelX, pixelY, z int) error {
+	return PlaceRelativeTo(os.Stdout, id, cellX, cellY, pixelX, pixelY, z)
+}
+
+// PlaceRelativeTo is like PlaceRelative but writes to w
+func PlaceRelativeTo(w io.Writer, id uint32, cellX, cellY, pixelX, pixelY, z int) error {
+	if pixelX < 0 || pixelY < 0 {
+		return fmt.Errorf("invalid pixel offset %d,%d: must be positive and smaller than a cell", pixelX, pixelY)
+	}
+	opts := []string{ACTION_PLACEMENT, fmt.Sprintf("i=%d", id)}
+	if pixelX > 0 {
+		opts = append(opts, fmt.Sprintf("X=%d", pixelX))
+	}
+	if pixelY > 0 {
+		opts = append(opts, fmt.Sprintf("Y=%d", pixelY))
+	}
+	if z != 0 {
+		opts = append(opts, fmt.Sprintf("z=%d", z))
+	}
+	// the image is drawn from the cursor, so don't let it move the cursor past the restore below
+	opts = append(opts, "C=1", SUPPRESS_ERR)
+	_, err := io.WriteString(w,
+		"\x1b7"+ // save cursor
+			cursorMove(cellX, cellY)+
+			START+fmt.Sprintf("_G%s", strings.Join(opts, ","))+ESCAPE+CLOSE+
+			"\x1b8") // restore cursor
+	kittyPrinted.Store(true)
+	return err
+}
+
+// ClearImages deletes the Kitty images with the given IDs (their placements and data) with a
+// single write, avoiding the flicker of clearing many images one by one
+func ClearImages(ids []uint32) error {
+	return ClearImagesTo(os.Stdout, ids)
+}
+
+// ClearImagesTo is like ClearImages but writes to w
+func ClearImagesTo(w io.Writer, ids []uint32) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	var sb strings.Builder
+	for _, id := range ids {
+		sb.WriteString(START + fmt.Sprintf("_G%s,%s,i=%d,%s", ACTION_DELETE, DELETE_WITH_ID_AND_DATA, id, SUPPRESS_ERR) + ESCAPE + CLOSE)
+	}
+	_, err := io.WriteString(w, sb.String())
+	return err
+}
+
+// UpdateRegion replaces the pixels of a displayed Kitty image inside region (in the image's
+// pixel coordinates) by editing its root frame, instead of transmitting the whole image again,
+// e.g. for a live chart where only a few pixels change. img is the updated image, or only the
+// part of it inside region.
+func UpdateRegion(id uint32, region image.Rectangle, img image.Image) error {
+	return UpdateRegionTo(os.Stdout, id, region, img)
+}
+
+// UpdateRegionTo is like UpdateRegion but writes to w
+func UpdateRegionTo(w io.Writer, id uint32, region image.Rectangle, img image.Image) error {
+	if region.Empty() || region.Min.X < 0 || region.Min.Y < 0 {
+		return fmt.Errorf("invalid region %v", region)
+	}
+	patch := cropImage(img, region)
+	if patch.Bounds().Size() != region.Size() {
+		return fmt.Errorf("image bounds %v don't cover the region %v", img.Bounds(), region)
+	}
+	data, err := encodePNG(patch)
+	if err != nil {
+		return err
+	}
+	control := strings.Join([]string{
+		ACTION_FRAME,
+		fmt.Sprintf("i=%d", id),
+		"r=1", // edit the root frame (the image itself)
+		fmt.Sprintf("x=%d", region.Min.X),
+		fmt.Sprintf("y=%d", region.Min.Y),
+		fmt.Sprintf("s=%d", region.Dx()),
+		fmt.Sprintf("v=%d", region.Dy()),
+		DATA_PNG,
+		SUPPRESS_OK, SUPPRESS_ERR,
+	}, ",")
+	return writeKittyChunks(w, control, data, KITTY_CHUNK_SIZE, nil)
+}
+
+func (ti *TermImg) printKitty(w io.Writer) error {
+	kittyPrinted.Store(true)
+	if ti.placeCachedKitty(w) {
+		return nil
+	}
 	// try to send the image locally first
-	if err := ti.sendFileKitty(); err != nil {
+	if err := ti.sendFileKitty(w); err != nil {
 		// if that fails, try to stream it
 		out, err := ti.renderKitty()
 		if err != nil {
 			return err
 		}
-		fmt.Println(out)
+		if err := ti.writeTransfer(w, out); err != nil {
+			return err
+		}
+		_, err = fmt.Fprintln(w)
+		return err
 	}
 	return nil
 }
 
-func (ti *TermImg) sendFileKitty() error {
+func (ti *TermImg) sendFileKitty(w io.Writer) error {
 	if ti.path == "" {
 		return fmt.Errorf("no image path provided")
 	}
+	if ti.transformed() {
+		return fmt.Errorf("image must be re-encoded to apply its options")
+	}
+	if IsRemoteSession() {
+		// the terminal runs on another host and can't read our files, stream the (compressed PNG) data instead
+		return fmt.Errorf("file transfer is not available in a remote session")
+	}
 	// send the image file on the local filesystem
-	fmt.Println(
-		START +
-			fmt.Sprintf("_G%s;%s",
-				strings.Join([]string{
-					DATA_PNG,
-					ACTION_TRANSFER,
-					TRANSFER_FILE,
-					SUPPRESS_OK,
-					SUPPRESS_ERR,
-				}, ","),
-				base64.StdEncoding.EncodeToString([]byte(ti.path)),
-			) +
-			ESCAPE + CLOSE)
-	return nil
+	_, err := fmt.Fprintln(w, START+
+		fmt.Sprintf("_G%s;%s",
+			strings.Join(slices.Concat([]string{
+				DATA_PNG,
+				ACTION_TRANSFER,
+				TRANSFER_FILE,
+			}, ti.kittyQuietKeys(SUPPRESS_OK, SUPPRESS_ERR), ti.kittyOptions()), ","),
+			base64.StdEncoding.EncodeToString([]byte(ti.path)),
+		)+ESCAPE+CLOSE)
+	return err
 }
 
-func (ti *TermImg) clearKitty() error {
-	// delete all visible placements
-	fmt.Println(
-		START +
-			fmt.Sprintf("_G%s",
-				strings.Join([]string{
-					ACTION_DELETE,
-					SUPPRESS_OK,
-					SUPPRESS_ERR,
-				}, ","),
-			) +
-			ESCAPE + CLOSE)
-	return nil
+// HidePlacement hides a Kitty image by deleting its placements while keeping the image data in
+// the terminal (lowercase d=i), so ShowPlacement can display it again without retransmitting it.
+// Uppercase delete codes (d=I) also free the image data.
+func (ti *TermImg) HidePlacement() error {
+	return ti.HidePlacementTo(os.Stdout)
+}
+
+// HidePlacementTo is like HidePlacement but writes to w
+func (ti *TermImg) HidePlacementTo(w io.Writer) error {
+	if ti.protocol != Kitty {
+		return fmt.Errorf("hiding placements is not supported by the %s protocol", ti.protocol)
+	}
+	if ti.kittyID == 0 {
+		return fmt.Errorf("image has not been rendered")
+	}
+	_, err := io.WriteString(w, START+fmt.Sprintf("_G%s", strings.Join(slices.Concat([]string{ACTION_DELETE, DELETE_WITH_ID, fmt.Sprintf("i=%d", ti.kittyID)}, ti.kittyQuietKeys(SUPPRESS_ERR)), ","))+ESCAPE+CLOSE)
+	return err
+}
+
+// ShowPlacement displays a previously transmitted (and hidden) Kitty image again at the cursor position
+func (ti *TermImg) ShowPlacement() error {
+	return ti.ShowPlacementTo(os.Stdout)
+}
+
+// ShowPlacementTo is like ShowPlacement but writes to w
+func (ti *TermImg) ShowPlacementTo(w io.Writer) error {
+	if ti.protocol != Kitty {
+		return fmt.Errorf("showing placements is not supported by the %s protocol", ti.protocol)
+	}
+	if ti.kittyID == 0 {
+		return fmt.Errorf("image has not been rendered")
+	}
+	kittyPrinted.Store(true)
+	_, err := fmt.Fprintln(w, START+fmt.Sprintf("_G%s", strings.Join(slices.Concat([]string{ACTION_PLACEMENT}, ti.kittyQuietKeys(SUPPRESS_ERR), ti.kittyOptions()), ","))+ESCAPE+CLOSE)
+	return err
+}
+
+// clearKitty deletes the placements of the image, or of all images if it hasn't been printed
+// as a single image (e.g. when it was split into strips by Wrap)
+func (ti *TermImg) clearKitty(w io.Writer) error {
+	if ti.kittyID == 0 {
+		clearAllKitty(w)
+		return nil
+	}
+	_, err := io.WriteString(w, START+fmt.Sprintf("_G%s", strings.Join(slices.Concat([]string{ACTION_DELETE, DELETE_WITH_ID, fmt.Sprintf("i=%d", ti.kittyID)}, ti.kittyQuietKeys(SUPPRESS_ERR)), ","))+ESCAPE+CLOSE)
+	return err
+}
+
+// clearAllKitty deletes all visible Kitty placements
+func clearAllKitty(w io.Writer) {
+	fmt.Fprintln(w, START+
+		fmt.Sprintf("_G%s",
+			strings.Join([]string{
+				ACTION_DELETE,
+				SUPPRESS_OK,
+				SUPPRESS_ERR,
+			}, ","),
+		)+ESCAPE+CLOSE)
+	kittyPrinted.Store(false)
 }
@@ -0,0 +1,59 @@
+package termimg
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+)
+
+// LabelPosition is the corner of the image a label is drawn in
+type LabelPosition int
+
+const (
+	LabelBottomLeft LabelPosition = iota // default
+	LabelBottomRight
+	LabelTopLeft
+	LabelTopRight
+)
+
+const labelPadding = 2
+
+var labelBackground = color.NRGBA{A: 160}
+
+// drawLabel returns a copy of the image with text drawn (white on a translucent black box) in the given corner
+func drawLabel(src image.Image, text string, pos LabelPosition) image.Image {
+	b := src.Bounds()
+	dst := image.NewNRGBA(b)
+	draw.Draw(dst, b, src, b.Min, draw.Src)
+
+	face := basicfont.Face7x13
+	boxWidth := font.MeasureString(face, text).Ceil() + 2*labelPadding
+	boxHeight := face.Metrics().Height.Ceil() + 2*labelPadding
+
+	box := image.Rect(0, 0, boxWidth, boxHeight)
+	switch pos {
+	case LabelBottomLeft:
+		box = box.Add(image.Pt(b.Min.X, b.Max.Y-boxHeight))
+	case LabelBottomRight:
+		box = box.Add(image.Pt(b.Max.X-boxWidth, b.Max.Y-boxHeight))
+	case LabelTopLeft:
+		box = box.Add(b.Min)
+	case LabelTopRight:
+		box = box.Add(image.Pt(b.Max.X-boxWidth, b.Min.Y))
+	}
+	draw.Draw(dst, box.Intersect(b), image.NewUniform(labelBackground), image.Point{}, draw.Over)
+
+	d := &font.Drawer{
+		Dst:  dst,
+		Src:  image.White,
+		Face: face,
+		Dot:  fixed.P(box.Min.X+labelPadding, box.Min.Y+labelPadding+face.Metrics().Ascent.Ceil()),
+	}
+	d.DrawString(text)
+
+	return dst
+}
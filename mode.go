@@ -0,0 +1,60 @@
+package termimg
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strconv"
+)
+
+// DEC private modes relevant to image rendering
+const (
+	MODE_SIXEL_SCROLLING      = 80   // DECSDM
+	MODE_SIXEL_PRIVATE_COLORS = 1070 // use a private color register set for each sixel graphic
+)
+
+// QueryMode asks the terminal for the state of a DEC private mode using DECRQM and reports
+// whether the terminal recognizes the mode and whether it is currently enabled
+func QueryMode(mode int) (supported bool, enabled bool, err error) {
+	resp, err := queryTerminal(context.Background(), fmt.Sprintf("\x1b[?%d$p", mode))
+	if err != nil {
+		return false, false, err
+	}
+	return parseDECRPM(resp, mode)
+}
+
+// parseDECRPM parses a DECRPM `CSI ? mode ; value $ y` response, where value is one of
+//
+//	0: not recognized, 1: set, 2: reset, 3: permanently set, 4: permanently reset
+func parseDECRPM(in []byte, mode int) (supported bool, enabled bool, err error) {
+	start := bytes.Index(in, []byte("\x1b[?"))
+	if start < 0 {
+		return false, false, fmt.Errorf("invalid DECRPM response: %q", in)
+	}
+	in = in[start+3:]
+	end := bytes.Index(in, []byte("$y"))
+	if end < 0 {
+		return false, false, fmt.Errorf("invalid DECRPM response: %q", in)
+	}
+	fields := bytes.Split(in[:end], []byte(";"))
+	if len(fields) != 2 {
+		return false, false, fmt.Errorf("invalid DECRPM response: %q", in)
+	}
+	if m, err := strconv.Atoi(string(fields[0])); err != nil || m != mode {
+		return false, false, fmt.Errorf("DECRPM response for unexpected mode %q (want %d)", fields[0], mode)
+	}
+	value, err := strconv.Atoi(string(fields[1]))
+	if err != nil {
+		return false, false, fmt.Errorf("invalid DECRPM mode value %q: %v", fields[1], err)
+	}
+	switch value {
+	case 0:
+		return false, false, nil
+	case 1, 3:
+		return true, true, nil
+	case 2, 4:
+		return true, false, nil
+	default:
+		return false, false, fmt.Errorf("unknown DECRPM mode value %d", value)
+	}
+}
@@ -0,0 +1,51 @@
+package termimg
+
+import (
+	"image"
+	"image/color"
+)
+
+// monochrome are the options of a two color (binarized) image
+type monochrome struct {
+	threshold uint8
+	fg, bg    color.Color
+}
+
+// Monochrome binarizes the image into two colors for e-ink style or single color themes: pixels
+// darker than threshold (by luminance) are drawn in fg and the others in bg. A nil color leaves
+// those pixels transparent, so the terminal's own colors show through. A threshold of 0 disables it.
+func (ti *TermImg) Monochrome(threshold uint8, fg, bg color.Color) *TermImg {
+	ti.mono = nil
+	if threshold > 0 {
+		ti.mono = &monochrome{threshold: threshold, fg: fg, bg: bg}
+	}
+	ti.invalidate()
+	return ti
+}
+
+// apply returns the image binarized into the fg and bg colors, pixels below 50% alpha become transparent
+func (m *monochrome) apply(src image.Image) image.Image {
+	fg, bg := m.fg, m.bg
+	if fg == nil {
+		fg = color.Transparent
+	}
+	if bg == nil {
+		bg = color.Transparent
+	}
+	b := src.Bounds()
+	dst := image.NewPaletted(b, color.Palette{color.Transparent, fg, bg})
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			c := color.NRGBAModel.Convert(src.At(x, y)).(color.NRGBA)
+			switch {
+			case !opaqueAlpha(c.A):
+				dst.SetColorIndex(x, y, 0)
+			case color.GrayModel.Convert(color.NRGBA{c.R, c.G, c.B, 255}).(color.Gray).Y < m.threshold:
+				dst.SetColorIndex(x, y, 1)
+			default:
+				dst.SetColorIndex(x, y, 2)
+			}
+		}
+	}
+	return dst
+}
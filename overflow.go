@@ -0,0 +1,180 @@
+package termimg
+
+import (
+	"fmt"
+	"image"
+	"image/draw"
+	"os"
+	"strings"
+
+	"golang.org/x/term"
+)
+
+// OverflowMode controls what happens when an image is taller than the terminal
+type OverflowMode int
+
+const (
+	OverflowScroll    OverflowMode = iota // render the full image, scrolling the terminal (default)
+	OverflowClip                          // render only the top portion of the image that fits
+	OverflowDownscale                     // shrink the image (preserving its aspect ratio) to fit
+)
+
+func (m OverflowMode) String() string {
+	switch m {
+	case OverflowScroll:
+		return "scroll"
+	case OverflowClip:
+		return "clip"
+	case OverflowDownscale:
+		return "downscale"
+	default:
+		return "unknown"
+	}
+}
+
+// ParseOverflowMode parses an overflow mode name (case-insensitive), as returned by OverflowMode.String
+func ParseOverflowMode(s string) (OverflowMode, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "scroll", "":
+		return OverflowScroll, nil
+	case "clip":
+		return OverflowClip, nil
+	case "downscale":
+		return OverflowDownscale, nil
+	default:
+		return OverflowScroll, fmt.Errorf("unknown overflow mode %q; supported modes: scroll, clip, downscale", s)
+	}
+}
+
+// MarshalText implements the encoding.TextMarshaler interface
+func (m OverflowMode) MarshalText() ([]byte, error) {
+	return []byte(m.String()), nil
+}
+
+// UnmarshalText implements the encoding.TextUnmarshaler interface
+func (m *OverflowMode) UnmarshalText(text []byte) error {
+	mode, err := ParseOverflowMode(string(text))
+	if err != nil {
+		return err
+	}
+	*m = mode
+	return nil
+}
+
+// overflowLimit is the terminal height an overflowing image must fit into
+type overflowLimit struct {
+	rows     int // in cells
+	heightPx int // in pixels
+}
+
+// terminalSize returns the size of the terminal in cells (swappable in tests)
+var terminalSize = func() (cols, rows int, err error) {
+	return term.GetSize(int(os.Stdout.Fd()))
+}
+
+// WatchResize invalidates the image's rendered escape sequence whenever a signal is received on
+// ch, so the next Render or Print adapts to the new terminal size (e.g. with OnOverflow). The
+// caller registers the channel for terminal resizes and closes it to stop watching:
+//
+//	ch := make(chan os.Signal, 1)
+//	signal.Notify(ch, syscall.SIGWINCH)
+//	ti.WatchResize(ch)
+func (ti *TermImg) WatchResize(ch chan os.Signal) {
+	go func() {
+		for range ch {
+			ti.resized.Store(true)
+		}
+	}()
+}
+
+// checkResize invalidates the rendered escape sequence if the terminal was resized
+func (ti *TermImg) checkResize() {
+	if ti.resized.Swap(false) {
+		ti.invalidate()
+	}
+}
+
+// overflowLimit returns the terminal height limit if the image overflows it and the
+// overflow mode requires the image to be adjusted, or nil otherwise
+func (ti *TermImg) overflowLimit() *overflowLimit {
+	if ti.overflow == OverflowScroll {
+		return nil
+	}
+	if ti.limit == nil {
+		ti.limit = &overflowLimit{}
+		if _, rows, err := terminalSize(); err == nil && rows > 0 {
+			if _, fontHeight, err := ti.fontSize(); err == nil {
+				ti.limit.rows = rows
+				ti.limit.heightPx = rows * fontHeight
+			}
+		}
+	}
+	if ti.limit.heightPx == 0 || ti.source().Bounds().Dy() <= ti.limit.heightPx {
+		return nil // unknown terminal size or the image already fits
+	}
+	return ti.limit
+}
+
+// clipped reports whether processImage crops the image to the terminal height
+func (ti *TermImg) clipped() bool {
+	return ti.overflow == OverflowClip && ti.overflowLimit() != nil
+}
+
+// displaySize returns the size in pixels the image should be displayed at
+func (ti *TermImg) displaySize() (width, height int) {
+	width, height = ti.width, ti.height
+	if ti.overflow == OverflowDownscale {
+		if limit := ti.overflowLimit(); limit != nil && height > 0 {
+			width = width * limit.heightPx / height
+			height = limit.heightPx
+		}
+	}
+	return width, height
+}
+
+// FitDimensions returns the number of cells (columns and rows) the image occupies when fit into a
+// box of maxCols x maxRows cells, preserving its aspect ratio (images smaller than the box keep their
+// natural size). It uses the detected terminal font size to convert between pixels and cells.
+func (ti *TermImg) FitDimensions(maxCols, maxRows int) (cols, rows int) {
+	if err := ti.load(); err != nil {
+		return 0, 0
+	}
+	fontWidth, fontHeight, err := ti.fontSize()
+	if err != nil {
+		fontWidth, fontHeight = DEFAULT_FONT_WIDTH, DEFAULT_FONT_HEIGHT
+	}
+	b := ti.processImage().Bounds()
+	return fitCells(b.Dx(), b.Dy(), fontWidth, fontHeight, maxCols, maxRows)
+}
+
+// fitCells returns the cells an image of width x height pixels occupies when fit into maxCols x maxRows cells
+func fitCells(width, height, fontWidth, fontHeight, maxCols, maxRows int) (cols, rows int) {
+	if width <= 0 || height <= 0 || maxCols <= 0 || maxRows <= 0 {
+		return 0, 0
+	}
+	if width <= maxCols*fontWidth && height <= maxRows*fontHeight {
+		return ceilDiv(width, fontWidth), ceilDiv(height, fontHeight)
+	}
+	// compare the image aspect ratio with the box's (in pixels) to find the constraining side
+	if width*maxRows*fontHeight >= height*maxCols*fontWidth {
+		return maxCols, min(ceilDiv(height*maxCols*fontWidth, width*fontHeight), maxRows)
+	}
+	return min(ceilDiv(width*maxRows*fontHeight, height*fontWidth), maxCols), maxRows
+}
+
+func ceilDiv(a, b int) int {
+	return (a + b - 1) / b
+}
+
+// cropImage returns the part of the image inside r
+func cropImage(img image.Image, r image.Rectangle) image.Image {
+	r = r.Intersect(img.Bounds())
+	if sub, ok := img.(interface {
+		SubImage(image.Rectangle) image.Image
+	}); ok {
+		return sub.SubImage(r)
+	}
+	dst := image.NewNRGBA(image.Rect(0, 0, r.Dx(), r.Dy()))
+	draw.Draw(dst, dst.Bounds(), img, r.Min, draw.Src)
+	return dst
+}
@@ -0,0 +1,188 @@
+package termimg
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"strings"
+)
+
+// BlockResolution is the number of blocks of color each cell of a Preview (and the Blocks
+// protocol) is split into, using Unicode block characters
+type BlockResolution int
+
+const (
+	BlockCell    BlockResolution = iota // 1x1: a colored space per cell, works with any font (default)
+	BlockHalf                           // 1x2: upper half blocks (▀) with different foreground and background colors
+	BlockSextant                        // 2x3: sextants (U+1FB00 to U+1FB3B), 2 colors per cell, needs a font with the Unicode 13 block characters
+)
+
+func (r BlockResolution) String() string {
+	switch r {
+	case BlockCell:
+		return "cell"
+	case BlockHalf:
+		return "half"
+	case BlockSextant:
+		return "sextant"
+	default:
+		return "unknown"
+	}
+}
+
+// size returns the number of blocks per cell horizontally and vertically
+func (r BlockResolution) size() (int, int) {
+	switch r {
+	case BlockHalf:
+		return 1, 2
+	case BlockSextant:
+		return 2, 3
+	default:
+		return 1, 1
+	}
+}
+
+// BlockResolution sets how many blocks of color each cell of a Preview is split into (BlockCell
+// by default). Higher resolutions show much more detail on terminals without graphics support.
+func (ti *TermImg) BlockResolution(r BlockResolution) *TermImg {
+	ti.blockRes = r
+	ti.invalidate()
+	return ti
+}
+
+// Preview returns a tiny preview of the image as a cols x rows grid of cells, each filled
+// (using ANSI colors) with the average color of the part of the image it covers, or of
+// each block of the cell with BlockResolution. Unlike scaling the image down, it shows clean
+// blocks of color at sizes where any detail would be illegible anyway, and works in any
+// terminal (see TermImg.ColorDepth).
+func (ti *TermImg) Preview(cols, rows int) (string, error) {
+	if cols <= 0 || rows <= 0 {
+		return "", fmt.Errorf("invalid preview size %dx%d", cols, rows)
+	}
+	if err := ti.load(); err != nil {
+		return "", err
+	}
+	bw, bh := ti.blockRes.size()
+	grid := averageGrid(ti.processImage(), cols*bw, rows*bh)
+	var sb strings.Builder
+	for row := range rows {
+		for col := range cols {
+			switch ti.blockRes {
+			case BlockHalf:
+				top, bottom := grid[row*2][col], grid[row*2+1][col]
+				sb.WriteString(ti.depth.foreground(top) + ti.depth.background(bottom) + "▀")
+			case BlockSextant:
+				var blocks [6]color.RGBA
+				for i := range blocks {
+					blocks[i] = grid[row*3+i/2][col*2+i%2]
+				}
+				sb.WriteString(ti.sextant(blocks))
+			default:
+				sb.WriteString(ti.depth.background(grid[row][col]) + " ")
+			}
+		}
+		sb.WriteString("\x1b[0m\n")
+	}
+	return sb.String(), nil
+}
+
+// sextant returns the cell showing 6 blocks of color (left to right, top to bottom) with the
+// sextant character closest to them: the blocks are split in 2 groups around the 2 most different
+// colors, drawn with the average color of each group as the foreground and background
+func (ti *TermImg) sextant(blocks [6]color.RGBA) string {
+	a, b, best := 0, 0, -1
+	for i := range blocks {
+		for j := i + 1; j < len(blocks); j++ {
+			if d := colorDistance(blocks[i], blocks[j]); d > best {
+				a, b, best = i, j, d
+			}
+		}
+	}
+	var mask int
+	var fg, bg [4]int // sums of the RGB channels and count of each group
+	for i, c := range blocks {
+		sum := &bg
+		if colorDistance(c, blocks[a]) < colorDistance(c, blocks[b]) {
+			mask |= 1 << i
+			sum = &fg
+		}
+		sum[0], sum[1], sum[2], sum[3] = sum[0]+int(c.R), sum[1]+int(c.G), sum[2]+int(c.B), sum[3]+1
+	}
+	average := func(sum [4]int) color.RGBA {
+		return color.RGBA{R: uint8(sum[0] / sum[3]), G: uint8(sum[1] / sum[3]), B: uint8(sum[2] / sum[3]), A: 255}
+	}
+	if mask == 0 {
+		return ti.depth.background(average(bg)) + " " // a single color
+	}
+	return ti.depth.foreground(average(fg)) + ti.depth.background(average(bg)) + string(sextantRune(mask))
+}
+
+// sextantRune returns the character with the blocks of mask (bit 0: top left, 1: top right,
+// 2: middle left, ... 5: bottom right) in the foreground color. The Symbols for Legacy Computing
+// block skips the sextants that already exist as block elements (empty, half and full blocks).
+func sextantRune(mask int) rune {
+	switch {
+	case mask == 0b010101:
+		return '▌'
+	case mask == 0b101010:
+		return '▐'
+	case mask == 0b111111:
+		return '█'
+	case mask < 0b010101:
+		return rune(0x1FB00 + mask - 1)
+	case mask < 0b101010:
+		return rune(0x1FB00 + mask - 2)
+	default:
+		return rune(0x1FB00 + mask - 3)
+	}
+}
+
+// colorDistance returns the squared euclidean distance between two colors
+func colorDistance(a, b color.RGBA) int {
+	dr, dg, db := int(a.R)-int(b.R), int(a.G)-int(b.G), int(a.B)-int(b.B)
+	return dr*dr + dg*dg + db*db
+}
+
+// renderBlocks renders the image as a Preview filling the cells it would cover as an image,
+// fit to the terminal size
+func (ti *TermImg) renderBlocks() (string, error) {
+	if ti.encoded != "" {
+		return ti.encoded, nil
+	}
+	cols, rows, err := ti.cells()
+	if err != nil {
+		return "", err
+	}
+	out, err := ti.Preview(cols, rows)
+	if err != nil {
+		return "", err
+	}
+	ti.encoded = out
+	return out, nil
+}
+
+// averageGrid splits the image into a cols x rows grid and returns the average color of each cell
+func averageGrid(img image.Image, cols, rows int) [][]color.RGBA {
+	b := img.Bounds()
+	grid := make([][]color.RGBA, rows)
+	for row := range grid {
+		grid[row] = make([]color.RGBA, cols)
+		y0 := b.Min.Y + row*b.Dy()/rows
+		y1 := max(b.Min.Y+(row+1)*b.Dy()/rows, y0+1)
+		for col := range grid[row] {
+			x0 := b.Min.X + col*b.Dx()/cols
+			x1 := max(b.Min.X+(col+1)*b.Dx()/cols, x0+1)
+			var r, g, bl, n uint64
+			for y := y0; y < min(y1, b.Max.Y); y++ {
+				for x := x0; x < min(x1, b.Max.X); x++ {
+					pr, pg, pb, _ := img.At(x, y).RGBA()
+					r, g, bl, n = r+uint64(pr), g+uint64(pg), bl+uint64(pb), n+1
+				}
+			}
+			if n > 0 {
+				grid[row][col] = color.RGBA{R: uint8(r / n >> 8), G: uint8(g / n >> 8), B: uint8(bl / n >> 8), A: 255}
+			}
+		}
+	}
+	return grid
+}
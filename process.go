@@ -0,0 +1,114 @@
+package termimg
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// processImage returns the image with all of the configured transformations applied
+func (ti *TermImg) processImage() image.Image {
+	img := normalize(ti.source())
+	if ti.oversized() {
+		ti.warnOversized()
+		img = scaleToFit(img, ti.pixelLimit(), ti.pixelLimit(), ti.resizeQuality)
+	}
+	if ti.clipped() {
+		b := img.Bounds()
+		img = cropImage(img, image.Rect(b.Min.X, b.Min.Y, b.Max.X, b.Min.Y+ti.overflowLimit().heightPx))
+	}
+	if ti.inverted() {
+		img = invertImage(img)
+	}
+	if ti.background != nil {
+		img = composite(img, ti.background)
+	}
+	if ti.mono != nil {
+		img = ti.mono.apply(img)
+	}
+	if len(ti.palette) > 0 {
+		img = ditherPalette(img, ti.palette, ti.ditherMode, ti.ditherStrengthFactor())
+	} else if ti.colors > 0 {
+		img = ditherColors(img, ti.colors, ti.ditherMode, ti.ditherStrengthFactor())
+	}
+	if ti.label != "" {
+		img = drawLabel(img, ti.label, ti.labelPos)
+	}
+	return img
+}
+
+// normalize converts an image with more than 8 bits per channel or another color model than RGB,
+// gray or paletted (e.g. a 16-bit PNG or a CMYK JPEG) to NRGBA, so every output gets 8-bit colors
+func normalize(src image.Image) image.Image {
+	switch src.(type) {
+	case *image.NRGBA, *image.RGBA, *image.Paletted, *image.Gray, *image.YCbCr, *image.NYCbCrA:
+		return src
+	}
+	b := src.Bounds()
+	dst := image.NewNRGBA(b)
+	draw.Draw(dst, b, src, b.Min, draw.Src)
+	return dst
+}
+
+// transformed reports whether processImage modifies the source image
+func (ti *TermImg) transformed() bool {
+	return ti.cropped() || ti.oversized() || ti.inverted() || ti.clipped() || ti.background != nil || ti.mono != nil || len(ti.palette) > 0 || ti.colors > 0 || ti.label != ""
+}
+
+// inverted reports whether the image colors are inverted
+func (ti *TermImg) inverted() bool {
+	return ti.invert || (ti.autoInvert && isLightBackground())
+}
+
+// invertImage inverts the RGB channels of an image, preserving its alpha channel
+func invertImage(src image.Image) image.Image {
+	b := src.Bounds()
+	dst := image.NewNRGBA(b)
+	draw.Draw(dst, b, src, b.Min, draw.Src)
+	for i := 0; i < len(dst.Pix); i += 4 {
+		dst.Pix[i+0] = 255 - dst.Pix[i+0]
+		dst.Pix[i+1] = 255 - dst.Pix[i+1]
+		dst.Pix[i+2] = 255 - dst.Pix[i+2]
+	}
+	return dst
+}
+
+// composite returns the image drawn over a uniform background color
+func composite(src image.Image, bg color.Color) image.Image {
+	b := src.Bounds()
+	dst := image.NewNRGBA(b)
+	draw.Draw(dst, b, image.NewUniform(bg), image.Point{}, draw.Src)
+	draw.Draw(dst, b, src, b.Min, draw.Over)
+	return dst
+}
+
+// isLightBackground reports whether the terminal is known to use a light background, from
+// COLORFGBG or, when it isn't set, from the luminance of the color answered to OSC 11
+func isLightBackground() bool {
+	if light, ok := parseCOLORFGBG(os.Getenv("COLORFGBG")); ok {
+		return light
+	}
+	bg, err := QueryBackgroundColor()
+	if err != nil {
+		return false
+	}
+	return color.GrayModel.Convert(bg).(color.Gray).Y >= 128
+}
+
+// parseCOLORFGBG parses the `fg;bg` (or `fg;default;bg`) COLORFGBG value set by
+// rxvt, Konsole, iTerm2 and others, and reports whether the background is light
+func parseCOLORFGBG(val string) (light bool, ok bool) {
+	if val == "" {
+		return false, false
+	}
+	fields := strings.Split(val, ";")
+	bg, err := strconv.Atoi(fields[len(fields)-1])
+	if err != nil || bg < 0 || bg > 15 {
+		return false, false
+	}
+	// the 16 ANSI colors: 7 (white) and 9-15 (bright) are light, the rest are dark
+	return bg == 7 || bg >= 9, true
+}
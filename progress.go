@@ -0,0 +1,61 @@
+package termimg
+
+import (
+	"io"
+	"strings"
+)
+
+// OnProgress sets a function called after each chunk (escape sequence) of the image's transfer is
+// written by Print and its variants (Kitty and iTerm2 only), with the number of chunks written so
+// far and their total, e.g. to display a progress bar while printing large images over slow links.
+// Render only builds the escape sequences, so it never calls it. nil removes the function.
+func (ti *TermImg) OnProgress(fn func(sent, total int)) *TermImg {
+	ti.onProgress = fn
+	return ti
+}
+
+// writeTransfer writes the rendered transfer out to w, one escape sequence at a time when the
+// progress is reported
+func (ti *TermImg) writeTransfer(w io.Writer, out string) error {
+	prefix := ti.transferPrefix()
+	if ti.onProgress == nil || prefix == "" {
+		_, err := io.WriteString(w, out)
+		return err
+	}
+	chunks := splitSequences(out, START+prefix)
+	for i, chunk := range chunks {
+		if _, err := io.WriteString(w, chunk); err != nil {
+			return err
+		}
+		ti.onProgress(i+1, len(chunks))
+	}
+	return nil
+}
+
+// transferPrefix returns the beginning (after START) of the escape sequences of the image's transfer
+func (ti *TermImg) transferPrefix() string {
+	switch ti.protocol {
+	case Kitty:
+		return "_G"
+	case ITerm2:
+		return "]1337;"
+	default:
+		return ""
+	}
+}
+
+// splitSequences splits out before each escape sequence beginning with prefix (anything
+// before the first one is part of the first chunk)
+func splitSequences(out, prefix string) []string {
+	var chunks []string
+	for len(out) > 0 {
+		next := strings.Index(out[1:], prefix)
+		if next < 0 {
+			chunks = append(chunks, out)
+			break
+		}
+		chunks = append(chunks, out[:next+1])
+		out = out[next+1:]
+	}
+	return chunks
+}
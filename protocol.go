@@ -1,8 +1,10 @@
 package termimg
 
 import (
+	"context"
 	"fmt"
 	"os"
+	"strings"
 )
 
 type Protocol int
@@ -11,6 +13,14 @@ const (
 	Unsupported Protocol = iota
 	ITerm2
 	Kitty
+	Blocks // text: each cell filled with the average color of the image it covers (see Preview), works in any terminal
+)
+
+var (
+	// ErrNoProtocol is returned (wrapped) when the terminal supports none of the image protocols
+	ErrNoProtocol = fmt.Errorf("no supported image protocol detected")
+	// ErrProtocolUnavailable is returned (wrapped) when the image's protocol can't perform an operation
+	ErrProtocolUnavailable = fmt.Errorf("unsupported protocol")
 )
 
 func (p Protocol) String() string {
@@ -19,19 +29,120 @@ func (p Protocol) String() string {
 		return "iTerm2"
 	case Kitty:
 		return "Kitty"
+	case Blocks:
+		return "blocks"
 	default:
 		return "unsupported"
 	}
 }
 
+// ParseProtocol parses a protocol name (case-insensitive), as returned by Protocol.String
+func ParseProtocol(s string) (Protocol, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "iterm2", "iterm":
+		return ITerm2, nil
+	case "kitty":
+		return Kitty, nil
+	case "blocks", "halfblocks":
+		return Blocks, nil
+	case "unsupported", "":
+		return Unsupported, nil
+	default:
+		return Unsupported, fmt.Errorf("unknown protocol %q; supported protocols: %s", s, Unsupported.Supported())
+	}
+}
+
+// MarshalText implements the encoding.TextMarshaler interface
+func (p Protocol) MarshalText() ([]byte, error) {
+	return []byte(p.String()), nil
+}
+
+// UnmarshalText implements the encoding.TextUnmarshaler interface
+func (p *Protocol) UnmarshalText(text []byte) error {
+	protocol, err := ParseProtocol(string(text))
+	if err != nil {
+		return err
+	}
+	*p = protocol
+	return nil
+}
+
+// Capabilities are the features supported by an image protocol
+type Capabilities struct {
+	ZIndex        bool // Layer maps to a z-index (otherwise images are layered in draw order)
+	PixelOffset   bool // images can be offset within a cell (PixelOffset)
+	Transparency  bool // the image's alpha channel is preserved
+	FileTransfer  bool // the terminal can read images directly from local files
+	PreciseClear  bool // images can be deleted individually (otherwise their region is overwritten)
+	HidePlacement bool // images can be hidden and shown again without retransmitting them
+}
+
+// Capabilities returns the features supported by the protocol
+func (p Protocol) Capabilities() Capabilities {
+	switch p {
+	case Kitty:
+		return Capabilities{
+			ZIndex:        true,
+			PixelOffset:   true,
+			Transparency:  true,
+			FileTransfer:  true,
+			PreciseClear:  true,
+			HidePlacement: true,
+		}
+	default:
+		// iTerm2 images are sent as JPEG and positioned at the cursor
+		return Capabilities{}
+	}
+}
+
+// BYPASS_DETECTION_ENV is the environment variable that forces the protocol returned by
+// DetectProtocol, skipping all terminal queries: "kitty", "iterm2" or "blocks" (or "halfblocks")
+const BYPASS_DETECTION_ENV = "TERMIMG_BYPASS_DETECTION"
+
+// bypassProtocol returns the protocol forced with TERMIMG_BYPASS_DETECTION, if any
+func bypassProtocol() (Protocol, bool) {
+	p, err := ParseProtocol(os.Getenv(BYPASS_DETECTION_ENV))
+	if err != nil || p == Unsupported {
+		return Unsupported, false
+	}
+	return p, true
+}
+
+// protocolAvailable reports whether the terminal supports the protocol (swappable in tests)
+var protocolAvailable = func(p Protocol) bool {
+	if forced, ok := bypassProtocol(); ok {
+		return p == forced || p == Blocks
+	}
+	switch p {
+	case ITerm2:
+		return checkITerm2Support(context.Background())
+	case Kitty:
+		return checkKittySupport(context.Background())
+	case Blocks:
+		return true
+	default:
+		return false
+	}
+}
+
 func (p Protocol) Supported() string {
 	return fmt.Sprintf("%s, %s", ITerm2, Kitty)
 }
 
 func DetectProtocol() Protocol {
-	if checkITerm2Support() {
+	if forced, ok := bypassProtocol(); ok {
+		return forced
+	}
+	return detectProtocol(context.Background())
+}
+
+// detectProtocol queries the terminal for the supported protocols, until ctx is done
+func detectProtocol(ctx context.Context) Protocol {
+	if checkITerm2Support(ctx) {
 		return ITerm2
-	} else if checkKittySupport() {
+	} else if ctx.Err() != nil {
+		return Unsupported
+	} else if checkKittySupport(ctx) {
 		return Kitty
 	} else {
 		if os.Getenv("TERM_PROGRAM") == "screen" || os.Getenv("TERM_PROGRAM") == "tmux" {
@@ -40,3 +151,35 @@ func DetectProtocol() Protocol {
 		return Unsupported
 	}
 }
+
+// DetectProtocolContext is like DetectProtocol, but returns the best guess from environment
+// variables alone if ctx expires before the terminal answers the detection queries, for CLIs
+// that must start instantly. The query in progress stops waiting for its answer when ctx is
+// done, and no further queries are sent (an expired context sends none at all).
+func DetectProtocolContext(ctx context.Context) Protocol {
+	if forced, ok := bypassProtocol(); ok {
+		return forced
+	}
+	if ctx.Err() != nil {
+		return detectProtocolFromEnv()
+	}
+	p := detectProtocol(ctx)
+	if ctx.Err() != nil {
+		return detectProtocolFromEnv()
+	}
+	return p
+}
+
+// detectProtocolFromEnv guesses the protocol from environment variables, without querying the terminal
+func detectProtocolFromEnv() Protocol {
+	switch {
+	case os.Getenv("TERM_PROGRAM") == "iTerm.app" || os.Getenv("TERM_PROGRAM") == "vscode" || os.Getenv("TERM") == "mintty":
+		return ITerm2
+	case dumbKittySupport():
+		return Kitty
+	case os.Getenv("TERM_PROGRAM") == "screen" || os.Getenv("TERM_PROGRAM") == "tmux":
+		return ITerm2 // same guess as DetectProtocol
+	default:
+		return Unsupported
+	}
+}
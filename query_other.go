@@ -0,0 +1,33 @@
+//go:build !unix
+
+package termimg
+
+import (
+	"os"
+	"time"
+)
+
+// pendingRead receives the input of the read of stdin left waiting by a timeout, if any
+var pendingRead chan []byte
+
+// readStdinTimeout reads the terminal's input available within timeout. Reads of stdin can't
+// be interrupted on this platform, so a read left waiting by a timeout is reused by the next
+// call (serialized by queryMu) instead of starting another one that would compete for the input.
+func readStdinTimeout(p []byte, timeout time.Duration) (int, error) {
+	if pendingRead == nil {
+		ch := make(chan []byte, 1)
+		go func() {
+			buf := make([]byte, len(p))
+			n, _ := os.Stdin.Read(buf)
+			ch <- buf[:n]
+		}()
+		pendingRead = ch
+	}
+	select {
+	case in := <-pendingRead:
+		pendingRead = nil
+		return copy(p, in), nil
+	case <-time.After(max(timeout, 0)):
+		return 0, ErrQueryTimeout
+	}
+}
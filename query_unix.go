@@ -0,0 +1,33 @@
+//go:build unix
+
+package termimg
+
+import (
+	"os"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// readStdinTimeout reads the terminal's input available within timeout (0 only reads what is
+// already buffered). It waits with select instead of a blocked read, so nothing is left reading
+// stdin after a timeout to swallow the app's input or the next query's response.
+func readStdinTimeout(p []byte, timeout time.Duration) (int, error) {
+	fd := int(os.Stdin.Fd())
+	tv := unix.NsecToTimeval(max(timeout, 0).Nanoseconds())
+	for {
+		var fds unix.FdSet
+		fds.Set(fd)
+		n, err := unix.Select(fd+1, &fds, nil, nil, &tv)
+		if err == unix.EINTR {
+			continue // interrupted by a signal (e.g. SIGWINCH), wait again
+		}
+		if err != nil {
+			return 0, err
+		}
+		if n == 0 {
+			return 0, ErrQueryTimeout
+		}
+		return unix.Read(fd, p)
+	}
+}
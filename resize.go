@@ -0,0 +1,70 @@
+package termimg
+
+import (
+	"context"
+	"os"
+	"os/signal"
+)
+
+// TerminalSize is the size of the terminal in cells, and of its cells (the font size) in pixels
+type TerminalSize struct {
+	Cols, Rows            int
+	FontWidth, FontHeight int
+}
+
+// WatchTerminalSize returns a channel receiving the terminal size (detected again) each time the
+// terminal is resized (SIGWINCH), e.g. for TUI apps to render their images again at the new size
+// (see also TermImg.WatchResize). The signal handler is removed and the channel closed when ctx is
+// done. Sizes are dropped while the receiver is busy, so it always gets the latest one. On platforms
+// without resize signals (e.g. Windows) the channel is only closed.
+//
+// The terminal isn't queried for its font size on resizes, as the queries would compete with the
+// app's own reads of stdin (e.g. stealing keystrokes): the font size is the one set with
+// SetDefaultFontSize or already detected by GetTerminalFontSize, and 0 if neither is known.
+func WatchTerminalSize(ctx context.Context) <-chan TerminalSize {
+	sig := make(chan os.Signal, 1)
+	if len(resizeSignals) > 0 {
+		signal.Notify(sig, resizeSignals...)
+	}
+	sizes := watchTerminalSize(ctx, sig)
+	go func() {
+		<-ctx.Done()
+		signal.Stop(sig)
+	}()
+	return sizes
+}
+
+// watchTerminalSize sends the current terminal size on the returned channel for each signal received
+func watchTerminalSize(ctx context.Context, sig <-chan os.Signal) <-chan TerminalSize {
+	sizes := make(chan TerminalSize, 1)
+	go func() {
+		defer close(sizes)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-sig:
+				size := currentTerminalSize()
+				select {
+				case <-sizes: // drop the size the receiver hasn't read yet
+				default:
+				}
+				sizes <- size
+			}
+		}
+	}()
+	return sizes
+}
+
+// currentTerminalSize returns the terminal size (from the tty, without queries) and the known font
+// size, leaving the sizes that aren't known 0
+func currentTerminalSize() TerminalSize {
+	var size TerminalSize
+	if cols, rows, err := terminalSize(); err == nil {
+		size.Cols, size.Rows = cols, rows
+	}
+	if width, height, ok := knownFontSize(); ok {
+		size.FontWidth, size.FontHeight = width, height
+	}
+	return size
+}
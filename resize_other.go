@@ -0,0 +1,8 @@
+//go:build !unix
+
+package termimg
+
+import "os"
+
+// resizeSignals are the signals sent when the terminal is resized (none on this platform)
+var resizeSignals []os.Signal
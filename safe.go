@@ -0,0 +1,28 @@
+package termimg
+
+import "fmt"
+
+// ErrRenderPanic is returned (wrapped) by SafeRender and SafePrint when rendering panicked
+var ErrRenderPanic = fmt.Errorf("render panicked")
+
+// SafeRender renders the image like TermImg.Render, but recovers from any panic while
+// rendering (e.g. a malformed image) and returns it as an error instead of crashing
+func SafeRender(ti *TermImg) (output string, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			output, err = "", fmt.Errorf("%w: %v", ErrRenderPanic, r)
+		}
+	}()
+	return ti.Render()
+}
+
+// SafePrint prints the image like TermImg.Print, but recovers from any panic while
+// rendering (e.g. a malformed image) and returns it as an error instead of crashing
+func SafePrint(ti *TermImg) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%w: %v", ErrRenderPanic, r)
+		}
+	}()
+	return ti.Print()
+}
@@ -0,0 +1,146 @@
+package termimg
+
+import (
+	"fmt"
+	"image"
+	"log"
+
+	"golang.org/x/image/draw"
+)
+
+// ResizeQuality is the interpolation used to downscale images
+type ResizeQuality int
+
+const (
+	ResizeBalanced ResizeQuality = iota // approximate bilinear interpolation (default)
+	ResizeFast                          // nearest neighbor, fastest but blocky
+	ResizeHigh                          // Catmull-Rom, the sharpest result, several times slower
+)
+
+func (q ResizeQuality) String() string {
+	switch q {
+	case ResizeBalanced:
+		return "balanced"
+	case ResizeFast:
+		return "fast"
+	case ResizeHigh:
+		return "high"
+	default:
+		return "unknown"
+	}
+}
+
+// interpolator returns the scaler implementing the quality
+func (q ResizeQuality) interpolator() draw.Interpolator {
+	switch q {
+	case ResizeFast:
+		return draw.NearestNeighbor
+	case ResizeHigh:
+		return draw.CatmullRom
+	default:
+		return draw.ApproxBiLinear
+	}
+}
+
+// ResizeQuality sets the interpolation used to downscale the image (ResizeBalanced by default),
+// e.g. ResizeHigh for photos displayed much smaller than their resolution. An image opened with
+// OpenDownscaled is decoded again from its file to be downscaled with the new quality.
+func (ti *TermImg) ResizeQuality(q ResizeQuality) *TermImg {
+	if q != ti.resizeQuality && ti.maxW > 0 && ti.path != "" {
+		ti.Release()
+	}
+	ti.resizeQuality = q
+	ti.invalidate()
+	return ti
+}
+
+// defaultMaxPixels are the limits of the width and height of the images sent with each protocol,
+// as terminals may hang (or crash) trying to decode and display huge images
+var defaultMaxPixels = map[Protocol]int{
+	ITerm2: 8192,
+	Kitty:  10000,
+}
+
+// MaxPixels limits the width and height of the image sent to the terminal to n pixels, downscaling
+// larger images (preserving their aspect ratio) before they are encoded. A limit of 0 (the default)
+// uses a safe limit for the protocol (8192 pixels for iTerm2, 10000 for Kitty) and logs a warning
+// (with the standard log package) when it downscales the image, a negative one disables it. Blocks are never limited, as they are always rendered to the cells they cover.
+func (ti *TermImg) MaxPixels(n int) *TermImg {
+	ti.maxPixels = n
+	ti.invalidate()
+	return ti
+}
+
+// pixelLimit returns the maximum width and height of the image sent to the terminal, or 0 if there is none
+func (ti *TermImg) pixelLimit() int {
+	if ti.maxPixels != 0 {
+		return max(ti.maxPixels, 0)
+	}
+	return defaultMaxPixels[ti.protocol]
+}
+
+// warnOversized logs (once per image) that the image is downscaled to the default limit of its
+// protocol, which the caller didn't ask for with MaxPixels
+func (ti *TermImg) warnOversized() {
+	if ti.maxPixels != 0 || ti.sizeWarned {
+		return
+	}
+	ti.sizeWarned = true
+	b := ti.source().Bounds()
+	log.Printf("termimg: %dx%d image downscaled to the %s limit of %d pixels (see MaxPixels)", b.Dx(), b.Dy(), ti.protocol, ti.pixelLimit())
+}
+
+// oversized reports whether processImage downscales the image to the pixel limit
+func (ti *TermImg) oversized() bool {
+	limit := ti.pixelLimit()
+	if limit == 0 || ti.protocol == Blocks {
+		return false
+	}
+	b := ti.source().Bounds()
+	return b.Dx() > limit || b.Dy() > limit
+}
+
+// OpenDownscaled opens an image like Open, then downscales it (preserving its aspect ratio) to fit
+// within maxW x maxH pixels, for large source images that are displayed small (e.g. thumbnails of
+// large photos). The image is still decoded at full resolution, so opening it takes as long and as
+// much memory as Open, but only the downscaled pixels are kept afterwards and every render encodes
+// far less data. The image is downscaled again each time it is decoded (e.g. after Release).
+func OpenDownscaled(imagePath string, maxW, maxH int) (*TermImg, error) {
+	if maxW <= 0 || maxH <= 0 {
+		return nil, fmt.Errorf("invalid maximum size %dx%d", maxW, maxH)
+	}
+	ti, err := Open(imagePath)
+	if err != nil {
+		return nil, err
+	}
+	ti.maxW = maxW
+	ti.maxH = maxH
+	ti.scaleDecoded()
+	return ti, nil
+}
+
+// scaleDecoded downscales a freshly decoded image to fit within maxW x maxH (see OpenDownscaled)
+func (ti *TermImg) scaleDecoded() {
+	if ti.maxW <= 0 || ti.maxH <= 0 || ti.img == nil {
+		return
+	}
+	src := *ti.img
+	b := src.Bounds()
+	if b.Dx() <= ti.maxW && b.Dy() <= ti.maxH {
+		return
+	}
+	img := scaleToFit(src, ti.maxW, ti.maxH, ti.resizeQuality)
+	ti.img = &img
+	ti.raw = nil // the original encoded bytes no longer match the pixels
+}
+
+// scaleToFit downscales the image (preserving its aspect ratio) to fit within maxW x maxH pixels
+func scaleToFit(src image.Image, maxW, maxH int, q ResizeQuality) image.Image {
+	b := src.Bounds()
+	scale := min(float64(maxW)/float64(b.Dx()), float64(maxH)/float64(b.Dy()))
+	w := max(int(float64(b.Dx())*scale+0.5), 1)
+	h := max(int(float64(b.Dy())*scale+0.5), 1)
+	dst := image.NewNRGBA(image.Rect(0, 0, w, h))
+	q.interpolator().Scale(dst, dst.Bounds(), src, b, draw.Src, nil)
+	return dst
+}
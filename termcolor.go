@@ -0,0 +1,89 @@
+package termimg
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image/color"
+	"strconv"
+	"sync"
+)
+
+var (
+	termColorsMu sync.Mutex
+	termColors   = make(map[int]cachedDetection[color.Color]) // the colors reported by the terminal, by OSC code
+)
+
+// QueryBackgroundColor asks the terminal for its background color (OSC 11), e.g. to composite
+// transparent images over it with TermImg.Background. Terminals that don't support the query
+// don't answer, and an error is returned. The answer is cached (see SetDetectionCacheTTL).
+func QueryBackgroundColor() (color.Color, error) {
+	return queryColor(11)
+}
+
+// QueryForegroundColor asks the terminal for its foreground (text) color (OSC 10), e.g. to avoid
+// rendering blocks that are nearly invisible against the text color. Like QueryBackgroundColor, an
+// error is returned if the terminal doesn't answer, and the answer is cached.
+func QueryForegroundColor() (color.Color, error) {
+	return queryColor(10)
+}
+
+// queryColor asks the terminal for one of its dynamic colors (OSC 10: foreground, OSC 11: background)
+func queryColor(code int) (color.Color, error) {
+	termColorsMu.Lock()
+	defer termColorsMu.Unlock()
+	if c, ok := termColors[code]; ok && c.fresh() {
+		return c.value, nil
+	}
+	resp, err := queryTerminal(context.Background(), WrapForMultiplexer(fmt.Sprintf("\x1b]%d;?\x07", code)))
+	if err != nil {
+		return nil, err
+	}
+	c, err := parseOSCColor(resp, code)
+	if err != nil {
+		return nil, err
+	}
+	termColors[code] = newCachedDetection(c)
+	return c, nil
+}
+
+// parseOSCColor parses an `OSC code ; rgb:R/G/B ST` (or BEL terminated) color report, where
+// each channel has 1 to 4 hex digits (rgba:R/G/B/A reports are accepted, ignoring the alpha)
+func parseOSCColor(in []byte, code int) (color.Color, error) {
+	prefix := []byte(fmt.Sprintf("\x1b]%d;", code))
+	start := bytes.Index(in, prefix)
+	if start < 0 {
+		return nil, fmt.Errorf("invalid OSC %d response: %q", code, in)
+	}
+	in = in[start+len(prefix):]
+	if end := bytes.IndexAny(in, "\x07\x1b"); end >= 0 {
+		in = in[:end]
+	}
+	var spec []byte
+	switch {
+	case bytes.HasPrefix(in, []byte("rgb:")):
+		spec = in[4:]
+	case bytes.HasPrefix(in, []byte("rgba:")):
+		spec = in[5:]
+	default:
+		return nil, fmt.Errorf("unsupported OSC %d color format: %q", code, in)
+	}
+	fields := bytes.Split(spec, []byte("/"))
+	if len(fields) < 3 {
+		return nil, fmt.Errorf("invalid OSC %d color: %q", code, in)
+	}
+	var rgb [3]uint8
+	for i := range rgb {
+		if len(fields[i]) == 0 || len(fields[i]) > 4 {
+			return nil, fmt.Errorf("invalid OSC %d color channel %q", code, fields[i])
+		}
+		v, err := strconv.ParseUint(string(fields[i]), 16, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid OSC %d color channel %q: %v", code, fields[i], err)
+		}
+		// scale the channel from its number of hex digits to 8 bits
+		maxValue := uint64(1)<<(4*len(fields[i])) - 1
+		rgb[i] = uint8((v*255 + maxValue/2) / maxValue)
+	}
+	return color.RGBA{R: rgb[0], G: rgb[1], B: rgb[2], A: 255}, nil
+}
@@ -2,8 +2,10 @@ package termimg
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"image"
+	"image/color"
 	_ "image/gif"
 	"image/jpeg"
 	_ "image/jpeg"
@@ -12,12 +14,19 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"slices"
 	"strings"
+	"sync/atomic"
+
+	_ "golang.org/x/image/webp"
 )
 
 const ESC_ERASE_DISPLAY = "\x1b[2J\x1b[0;0H"
 
 var supportedFormats = []string{"png", "jpeg", "webp"}
+
+// ErrDecode is returned (wrapped) when the image data can't be decoded
+var ErrDecode = fmt.Errorf("failed to decode image")
 var (
 	ESCAPE = ""
 	START  = ""
@@ -37,16 +46,72 @@ func init() {
 	}
 }
 
+// TermImg is an image to display in the terminal. Its option setters modify it in place and return
+// it for chaining; use Clone to configure copies independently. A TermImg must not be used from
+// several goroutines at once.
 type TermImg struct {
 	path     string
 	protocol Protocol
 	img      *image.Image
 	format   string
+	raw      []byte // original encoded bytes (PNG only)
 	size     int
 	width    int
 	height   int
 	encoded  string
 	closer   io.Closer
+	reader   io.Reader // not yet decoded image data (NewTermImgLazy), read once
+	readErr  error     // why the reader's data couldn't be decoded, as it can't be read again
+	maxW     int       // size the image is downscaled to once decoded (OpenDownscaled)
+	maxH     int
+
+	invert     bool
+	autoInvert bool
+	layer      int
+	overflow   OverflowMode
+	offsetX    int
+	offsetY    int
+	label      string
+	labelPos   LabelPosition
+	colors     int
+	ditherMode DitherMode
+	palette    color.Palette
+	mono       *monochrome
+	background color.Color
+	depth      ColorDepth
+	blockRes   BlockResolution
+	fillCols   int
+	fillRows   int
+	wrap       bool
+	fontWidth  int
+	fontHeight int
+
+	preserveCursor bool
+	onProgress     func(sent, total int) // called after each chunk written by Print (OnProgress)
+	resizeQuality  ResizeQuality
+	crop           image.Rectangle
+	cropCenter     bool
+	maxPixels      int
+	ditherStrength *float64 // nil for full strength
+
+	fallbacks []Protocol
+	resolved  bool
+
+	chunkSize     int
+	kittyChunk    int
+	kittyQuiet    *int
+	kittyNoMove   bool
+	maxLineLength int
+	uriFormat     string
+
+	renderKey     string
+	region        *imageRegion
+	kittyID       uint32
+	kittyIDForced bool
+	cacheKey      string
+	limit         *overflowLimit
+	sizeWarned    bool
+	resized       atomic.Bool
 }
 
 func Open(imagePath string) (*TermImg, error) {
@@ -54,7 +119,7 @@ func Open(imagePath string) (*TermImg, error) {
 
 	protocol := DetectProtocol()
 	if protocol == Unsupported {
-		return nil, fmt.Errorf("no supported image protocol detected, supported protocols: %s", protocol.Supported())
+		return nil, fmt.Errorf("%w, supported protocols: %s", ErrNoProtocol, protocol.Supported())
 	}
 
 	imagePath, err = filepath.Abs(imagePath)
@@ -67,20 +132,60 @@ func Open(imagePath string) (*TermImg, error) {
 		return nil, fmt.Errorf("failed to open image: %s", err)
 	}
 
-	img, format, err := image.Decode(f)
+	img, format, raw, err := decodeImage(f)
 	if err != nil {
-		return nil, fmt.Errorf("failed to decode image: %s", err)
+		return nil, fmt.Errorf("%w: %s", ErrDecode, err)
 	}
 
-	switch format {
-	case "png":
-	case "jpeg":
-	case "webp":
-	default:
-		return nil, fmt.Errorf("unsupported image format: %s; supported formats: (%s)", format, strings.Join(supportedFormats, ", "))
+	if err := checkFormat(format); err != nil {
+		return nil, err
 	}
 
-	return &TermImg{path: imagePath, protocol: protocol, img: &img, format: format, closer: f}, nil
+	return &TermImg{path: imagePath, protocol: protocol, img: &img, format: format, raw: raw, closer: f}, nil
+}
+
+// OpenLazy is like Open, but only checks that the file exists: the image is decoded (and its format
+// checked) the first time it is rendered or printed, so creating many images (e.g. a gallery where
+// only a few are visible) is cheap. Decoding errors are returned by the first Render or Print.
+func OpenLazy(imagePath string) (*TermImg, error) {
+	protocol := DetectProtocol()
+	if protocol == Unsupported {
+		return nil, fmt.Errorf("%w, supported protocols: %s", ErrNoProtocol, protocol.Supported())
+	}
+	imagePath, err := filepath.Abs(imagePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get absolute path for image: %s", err)
+	}
+	if _, err := os.Stat(imagePath); err != nil {
+		return nil, fmt.Errorf("failed to open image: %s", err)
+	}
+	return &TermImg{path: imagePath, protocol: protocol}, nil
+}
+
+// checkFormat returns an error if the decoded image format isn't supported
+func checkFormat(format string) error {
+	if !slices.Contains(supportedFormats, format) {
+		return fmt.Errorf("unsupported image format: %s; supported formats: (%s)", format, strings.Join(supportedFormats, ", "))
+	}
+	return nil
+}
+
+// decodeImage decodes an image, keeping the original encoded bytes of PNG images so
+// they can be transmitted as is to protocols that accept PNG data
+func decodeImage(r io.Reader) (image.Image, string, []byte, error) {
+	var raw bytes.Buffer
+	img, format, err := image.Decode(io.TeeReader(r, &raw))
+	if errors.Is(err, image.ErrFormat) {
+		header := raw.Bytes()[:min(raw.Len(), 12)]
+		return nil, "", nil, fmt.Errorf("unknown image format (file header %q); supported formats: (%s)", header, strings.Join(supportedFormats, ", "))
+	}
+	if err != nil {
+		return nil, "", nil, err
+	}
+	if format != "png" {
+		return img, format, nil, nil
+	}
+	return img, format, raw.Bytes(), nil
 }
 
 func (t *TermImg) Info() string {
@@ -97,71 +202,656 @@ func (t *TermImg) Close() error {
 func NewTermImg(r io.Reader) (*TermImg, error) {
 	protocol := DetectProtocol()
 	if protocol == Unsupported {
-		return nil, fmt.Errorf("no supported image protocol detected, supported protocols: %#v", []Protocol{ITerm2, Kitty})
+		return nil, fmt.Errorf("%w, supported protocols: %#v", ErrNoProtocol, []Protocol{ITerm2, Kitty})
 	}
 
-	img, format, err := image.Decode(r)
+	img, format, raw, err := decodeImage(r)
 	if err != nil {
-		return nil, fmt.Errorf("failed to decode image: %s", err)
+		return nil, fmt.Errorf("%w: %s", ErrDecode, err)
 	}
 
-	switch format {
-	case "png":
-	case "jpeg":
-	case "webp":
-	default:
-		return nil, fmt.Errorf("unsupported image format: %s; supported formats: (%s)", format, strings.Join(supportedFormats, ", "))
+	if err := checkFormat(format); err != nil {
+		return nil, err
 	}
 
-	return &TermImg{protocol: protocol, img: &img, format: format}, nil
+	return &TermImg{protocol: protocol, img: &img, format: format, raw: raw}, nil
+}
+
+// NewTermImgLazy is like NewTermImg, but keeps the reader and only reads and decodes the image the
+// first time it is rendered or printed (see OpenLazy). The reader must stay readable until then,
+// and decoding errors are returned by the first Render or Print.
+func NewTermImgLazy(r io.Reader) (*TermImg, error) {
+	protocol := DetectProtocol()
+	if protocol == Unsupported {
+		return nil, fmt.Errorf("%w, supported protocols: %#v", ErrNoProtocol, []Protocol{ITerm2, Kitty})
+	}
+	return &TermImg{protocol: protocol, reader: r}, nil
+}
+
+// FromBytes creates a TermImg from an encoded image held in memory. Like NewTermImg, the
+// original bytes of PNG images are kept (data itself, not a copy, so it must not be modified
+// afterwards) and transmitted as is to protocols that accept PNG data, without re-encoding.
+func FromBytes(data []byte) (*TermImg, error) {
+	ti, err := NewTermImg(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	if ti.raw != nil {
+		ti.raw = data
+	}
+	return ti, nil
 }
 
 func (ti *TermImg) Render() (string, error) {
+	out, err := ti.render()
+	if err != nil || !ti.preserveCursor {
+		return out, err
+	}
+	return "\x1b7" + out + "\x1b8", nil // save and restore the cursor
+}
+
+// RenderWithSize renders the image like Render and also returns the number of cells (columns
+// and rows) the output occupies, e.g. to reserve space for it in a TUI layout
+func (ti *TermImg) RenderWithSize() (output string, cols, rows int, err error) {
+	output, err = ti.Render()
+	if err != nil {
+		return "", 0, 0, err
+	}
+	cols, rows, err = ti.cells()
+	if err != nil {
+		return "", 0, 0, err
+	}
+	return output, cols, rows, nil
+}
+
+// cells returns the number of cells (columns and rows) the rendered image occupies
+func (ti *TermImg) cells() (cols, rows int, err error) {
+	width := ti.stripWidth()
+	if width == 0 {
+		if cols, rows := ti.fillCells(); cols > 0 {
+			return cols, rows, nil
+		}
+	}
+	fontWidth, fontHeight, err := ti.fontSize()
+	if err != nil {
+		return 0, 0, err
+	}
+	if width > 0 {
+		// the strips are stacked vertically
+		b := ti.processImage().Bounds()
+		return ceilDiv(width, fontWidth), ceilDiv(b.Dx(), width) * ceilDiv(b.Dy(), fontHeight), nil
+	}
+	if ti.protocol == Blocks {
+		// like the terminals do with images, shrink the blocks to fit the terminal
+		b := ti.source().Bounds()
+		if termCols, termRows, err := terminalSize(); err == nil && termCols > 0 && termRows > 0 {
+			cols, rows := fitCells(b.Dx(), b.Dy(), fontWidth, fontHeight, termCols, termRows)
+			return max(cols, 1), max(rows, 1), nil
+		}
+		return ceilDiv(b.Dx(), fontWidth), ceilDiv(b.Dy(), fontHeight), nil
+	}
+	width, height := ti.displaySize()
+	return ceilDiv(width, fontWidth), ceilDiv(height, fontHeight), nil
+}
+
+func (ti *TermImg) render() (string, error) {
+	if err := ti.load(); err != nil {
+		return "", err
+	}
+	if err := ti.checkCrop(); err != nil {
+		return "", err
+	}
+	ti.resolveProtocol()
+	if ti.protocol == Kitty {
+		kittyPrinted.Store(true) // the caller writes the output itself (e.g. a TUI), ClearAll must clear it
+	}
+	if width := ti.stripWidth(); width > 0 {
+		return ti.renderStrips(width)
+	}
 	// Render the image based on the detected protocol
 	switch ti.protocol {
 	case ITerm2:
 		return ti.renderITerm2()
 	case Kitty:
 		return ti.renderKitty()
+	case Blocks:
+		return ti.renderBlocks()
 	default:
-		return "", fmt.Errorf("unsupported protocol")
+		return "", fmt.Errorf("%w: %s", ErrProtocolUnavailable, ti.protocol)
 	}
 }
 
+// Print prints the image to stdout
 func (ti *TermImg) Print() error {
+	return ti.PrintTo(os.Stdout)
+}
+
+// ttyPath is the controlling terminal device PrintToTTY writes to (swappable in tests)
+var ttyPath = "/dev/tty"
+
+// PrintToTTY prints the image to the controlling terminal (/dev/tty) rather than stdout, so it is
+// displayed even when stdout is redirected (e.g. to a file or a pipe). It falls back to stdout if
+// the terminal can't be opened (e.g. without a controlling terminal, or on Windows).
+func (ti *TermImg) PrintToTTY() error {
+	tty, err := os.OpenFile(ttyPath, os.O_WRONLY, 0)
+	if err != nil {
+		return ti.Print()
+	}
+	defer tty.Close()
+	return ti.PrintTo(tty)
+}
+
+// PrintTo prints the image to w (e.g. /dev/tty, or a buffer of all the terminal output).
+// Queries to the terminal made while printing are still sent to stdout.
+func (ti *TermImg) PrintTo(w io.Writer) error {
+	if !ti.preserveCursor {
+		return ti.print(w)
+	}
+	io.WriteString(w, "\x1b7") // save cursor
+	err := ti.print(w)
+	io.WriteString(w, "\x1b8") // restore cursor
+	return err
+}
+
+func (ti *TermImg) print(w io.Writer) error {
+	if err := ti.load(); err != nil {
+		return err
+	}
+	if err := ti.checkCrop(); err != nil {
+		return err
+	}
+	ti.resolveProtocol()
+	if width := ti.stripWidth(); width > 0 {
+		out, err := ti.renderStrips(width)
+		if err != nil {
+			return err
+		}
+		if ti.protocol == Kitty {
+			kittyPrinted.Store(true)
+		}
+		if err := ti.writeTransfer(w, out); err != nil {
+			return err
+		}
+		_, err = fmt.Fprintln(w)
+		return err
+	}
 	// Render the image based on the detected protocol
 	switch ti.protocol {
 	case ITerm2:
-		return ti.printITerm2()
+		return ti.printITerm2(w)
 	case Kitty:
-		return ti.printKitty()
+		return ti.printKitty(w)
+	case Blocks:
+		out, err := ti.renderBlocks()
+		if err != nil {
+			return err
+		}
+		_, err = io.WriteString(w, out)
+		return err
 	default:
-		return fmt.Errorf("unsupported protocol")
+		return fmt.Errorf("%w: %s", ErrProtocolUnavailable, ti.protocol)
 	}
 }
 
+// Clear clears the image from the terminal
 func (ti *TermImg) Clear() error {
+	return ti.ClearTo(os.Stdout)
+}
+
+// ClearTo is like Clear but writes to w
+func (ti *TermImg) ClearTo(w io.Writer) error {
+	switch ti.protocol {
+	case ITerm2:
+		return ti.clearITerm2(w)
+	case Kitty:
+		return ti.clearKitty(w)
+	default:
+		return fmt.Errorf("%w: %s", ErrProtocolUnavailable, ti.protocol)
+	}
+}
+
+// WithFallback sets the protocols to try, in order, when the image's protocol isn't supported by
+// the terminal, and finally Blocks (which works in any terminal). The protocol is resolved (querying
+// the terminal) the first time the image is rendered, see ResolvedProtocol.
+func (ti *TermImg) WithFallback(protocols ...Protocol) *TermImg {
+	ti.fallbacks = append([]Protocol{}, protocols...)
+	ti.resolved = false
+	ti.invalidate()
+	return ti
+}
+
+// ResolvedProtocol returns the protocol the image is rendered with, once resolved with WithFallback
+func (ti *TermImg) ResolvedProtocol() Protocol {
+	return ti.protocol
+}
+
+// resolveProtocol switches the image to the first protocol of its fallback chain the terminal supports
+func (ti *TermImg) resolveProtocol() {
+	if ti.fallbacks == nil || ti.resolved {
+		return
+	}
+	ti.resolved = true
+	for _, p := range append([]Protocol{ti.protocol}, ti.fallbacks...) {
+		if protocolAvailable(p) {
+			ti.protocol = p
+			return
+		}
+	}
+	ti.protocol = Blocks
+}
+
+// PreserveCursor returns the cursor to where it was before the image was printed (or its
+// rendered output written), whatever the protocol, by saving and restoring it around the
+// output (DECSC/DECRC). If printing scrolls the terminal, the cursor is restored to the same
+// screen position rather than the same line.
+func (ti *TermImg) PreserveCursor(preserve bool) *TermImg {
+	ti.preserveCursor = preserve
+	return ti
+}
+
+// Invert inverts the colors of the image (keeping its alpha) before it is rendered
+func (ti *TermImg) Invert(invert bool) *TermImg {
+	ti.invert = invert
+	ti.invalidate()
+	return ti
+}
+
+// AutoInvert inverts the colors of the image only when the terminal is detected to have a
+// light background (via COLORFGBG, or the OSC 11 background color), so light line art on a transparent background stays visible
+func (ti *TermImg) AutoInvert(autoInvert bool) *TermImg {
+	ti.autoInvert = autoInvert
+	ti.invalidate()
+	return ti
+}
+
+// ClearAll clears every image printed by this package (or rendered with Render, for output
+// written by the caller): all Kitty placements and every tracked iTerm2 image region (iTerm2
+// regions are best effort, as they are overwritten in place and will be off if the screen has
+// scrolled since printing)
+func ClearAll() error {
+	return ClearAllTo(os.Stdout)
+}
+
+// ClearAllTo is like ClearAll but writes to w
+func ClearAllTo(w io.Writer) error {
+	if kittyPrinted.Load() {
+		clearAllKitty(w)
+	}
+	clearAllITerm2(w)
+	return nil
+}
+
+// Layer sets the stacking order of the image when it overlaps other images; higher layers are drawn on top.
+//   - Kitty: maps directly to the placement z-index (negative values are drawn below text)
+//   - iTerm2: has no z-index, images are stacked in draw order (the last image printed is on top)
+func (ti *TermImg) Layer(n int) *TermImg {
+	ti.layer = n
+	ti.invalidate()
+	return ti
+}
+
+// PixelOffset offsets the image within its starting cell by x,y pixels, for pixel-perfect
+// alignment with elements that aren't cell aligned. The offsets must be smaller than the
+// font (cell) size. Only supported by Kitty (X= and Y= keys), ignored by iTerm2.
+func (ti *TermImg) PixelOffset(x, y int) *TermImg {
+	ti.offsetX = x
+	ti.offsetY = y
+	ti.invalidate()
+	return ti
+}
+
+// Label draws a text caption (e.g. the file name or dimensions) into a corner of the image's
+// pixels, so it displays the same in every protocol. An empty text removes the label.
+func (ti *TermImg) Label(text string, pos LabelPosition) *TermImg {
+	ti.label = text
+	ti.labelPos = pos
+	ti.invalidate()
+	return ti
+}
+
+// ITerm2ChunkSize sets the number of raw image bytes sent in each part of an iTerm2 multipart
+// file transfer, images larger than this are split into parts (ITERM2_CHUNK_SIZE by default)
+func (ti *TermImg) ITerm2ChunkSize(size int) *TermImg {
+	ti.chunkSize = size
+	ti.invalidate()
+	return ti
+}
+
+// MaxLineLength limits the length of the base64 payload of each iTerm2 escape sequence, for
+// terminal or SSH setups that choke on very long sequences (0 means no limit). Images whose
+// payload would exceed it are sent as a multipart file transfer.
+func (ti *TermImg) MaxLineLength(n int) *TermImg {
+	ti.maxLineLength = n
+	ti.invalidate()
+	return ti
+}
+
+// Background composites the image over a uniform background color before it is rendered, so
+// transparent and translucent pixels blend toward that color, e.g. in Preview, which otherwise
+// blends them toward black. A nil color (the default) leaves the image transparent, so graphics
+// protocols show the terminal's own background through it. QueryBackgroundColor returns the
+// terminal's background, to blend translucent pixels in Preview as the terminal would.
+func (ti *TermImg) Background(c color.Color) *TermImg {
+	ti.background = c
+	ti.invalidate()
+	return ti
+}
+
+// DitherColors reduces the image to a palette of n colors derived from the image itself, with
+// Floyd-Steinberg dithering, for an intentionally retro look (0 keeps all colors). n is capped to
+// the 256 colors of a palette (255 if the image has transparent pixels).
+func (ti *TermImg) DitherColors(n int) *TermImg {
+	ti.colors = n
+	ti.invalidate()
+	return ti
+}
+
+// DitherPalette reduces the image to the colors of p (its first 255 opaque colors, translucent ones
+// are ignored), with dithering, e.g. to only use a brand's colors. It takes precedence over DitherColors;
+// an empty palette keeps all colors.
+func (ti *TermImg) DitherPalette(p color.Palette) *TermImg {
+	ti.palette = append(color.Palette{}, p...)
+	ti.invalidate()
+	return ti
+}
+
+// DitherMode sets the dithering algorithm used by DitherColors (DitherFloydSteinberg by default)
+func (ti *TermImg) DitherMode(mode DitherMode) *TermImg {
+	ti.ditherMode = mode
+	ti.invalidate()
+	return ti
+}
+
+// DitherStrength scales the error diffused by DitherColors and DitherPalette, from 0 (no diffusion,
+// each pixel takes the nearest color) to 1 (full diffusion, the default). Partial strengths reduce
+// the noisy "snow" of error diffusion on gradients while keeping some smoothing. With DitherOrdered
+// it scales the threshold offsets instead. f is clamped to [0, 1].
+func (ti *TermImg) DitherStrength(f float64) *TermImg {
+	f = max(0, min(f, 1))
+	ti.ditherStrength = &f
+	ti.invalidate()
+	return ti
+}
+
+// ditherStrengthFactor returns the strength of the dithering (see DitherStrength)
+func (ti *TermImg) ditherStrengthFactor() float64 {
+	if ti.ditherStrength == nil {
+		return 1
+	}
+	return *ti.ditherStrength
+}
+
+// ColorDepth sets the colors available for text output such as Preview (DepthTrueColor by default),
+// colors are mapped to the nearest color of the 256 color palette or the 16 ANSI colors
+func (ti *TermImg) ColorDepth(depth ColorDepth) *TermImg {
+	ti.depth = depth
+	ti.invalidate()
+	return ti
+}
+
+// FillCells stretches the image to exactly fill cols x rows cells, ignoring its aspect ratio.
+// The scaling is done by the terminal (no pixels are resized), making it the fastest way to fill
+// a known box. It takes precedence over OnOverflow(OverflowDownscale); 0, 0 restores the natural size
+// (a single 0 dimension is computed from the aspect ratio, see FitWidth and FitHeight).
+func (ti *TermImg) FillCells(cols, rows int) *TermImg {
+	ti.fillCols = cols
+	ti.fillRows = rows
+	ti.invalidate()
+	return ti
+}
+
+// FitWidth scales the image to fill cols cells horizontally, with as many rows as its aspect ratio
+// (and the font's cell size) requires. Like FillCells, the scaling is done by the terminal.
+func (ti *TermImg) FitWidth(cols int) *TermImg {
+	return ti.FillCells(max(cols, 0), 0)
+}
+
+// FitHeight scales the image to fill rows cells vertically, with as many columns as its aspect
+// ratio (and the font's cell size) requires. Like FillCells, the scaling is done by the terminal.
+func (ti *TermImg) FitHeight(rows int) *TermImg {
+	return ti.FillCells(0, max(rows, 0))
+}
+
+// fillCells returns the cells the image is scaled to fill (see FillCells, FitWidth and FitHeight),
+// or 0, 0 to display it at its natural size
+func (ti *TermImg) fillCells() (cols, rows int) {
+	cols, rows = ti.fillCols, ti.fillRows
+	switch {
+	case cols > 0 && rows > 0:
+		return cols, rows
+	case cols <= 0 && rows <= 0:
+		return 0, 0
+	}
+	fontWidth, fontHeight, err := ti.fontSize()
+	if err != nil {
+		fontWidth, fontHeight = DEFAULT_FONT_WIDTH, DEFAULT_FONT_HEIGHT
+	}
+	b := ti.source().Bounds()
+	if b.Empty() {
+		return 0, 0
+	}
+	if cols > 0 {
+		return cols, max((b.Dy()*cols*fontWidth+b.Dx()*fontHeight/2)/(b.Dx()*fontHeight), 1)
+	}
+	return max((b.Dx()*rows*fontHeight+b.Dy()*fontWidth/2)/(b.Dy()*fontWidth), 1), rows
+}
+
+// OnOverflow sets what happens when the image is taller than the terminal (OverflowScroll by default)
+func (ti *TermImg) OnOverflow(mode OverflowMode) *TermImg {
+	ti.overflow = mode
+	ti.invalidate()
+	return ti
+}
+
+// Validate returns an error if options were set that the image's protocol doesn't support
+// (and would otherwise be silently ignored when rendering)
+func (ti *TermImg) Validate() error {
+	caps := ti.protocol.Capabilities()
+	var unsupported []string
+	if (ti.offsetX != 0 || ti.offsetY != 0) && !caps.PixelOffset {
+		unsupported = append(unsupported, "PixelOffset")
+	}
+	if len(unsupported) > 0 {
+		return fmt.Errorf("options not supported by the %s protocol: %s", ti.protocol, strings.Join(unsupported, ", "))
+	}
+	return nil
+}
+
+// invalidate drops the encoded escape sequence and anything derived from the options
+func (ti *TermImg) invalidate() {
+	ti.encoded = ""
+	ti.limit = nil
+}
+
+// EncodedBytes returns the processed image data that the image's protocol transmits, without
+// the escape sequences wrapping it, along with its MIME type: JPEG for iTerm2 and PNG for Kitty
+// (the original PNG bytes when the image isn't modified)
+func (ti *TermImg) EncodedBytes() ([]byte, string, error) {
+	if err := ti.load(); err != nil {
+		return nil, "", err
+	}
+	return ti.encodeData()
+}
+
+// encodeData encodes the processed image for the image's protocol, and records its size and dimensions
+func (ti *TermImg) encodeData() ([]byte, string, error) {
+	img := ti.processImage()
+	var data []byte
+	var mime string
+	var err error
 	switch ti.protocol {
 	case ITerm2:
-		return ti.clearITerm2()
+		data, err = encodeJPEG(img)
+		mime = "image/jpeg"
 	case Kitty:
-		return ti.clearKitty()
+		mime = "image/png"
+		if len(ti.raw) > 0 && !ti.transformed() {
+			data = ti.raw // transmit the original PNG as is
+		} else {
+			data, err = encodePNG(img)
+		}
 	default:
-		return fmt.Errorf("unsupported protocol")
+		return nil, "", fmt.Errorf("%w: %s", ErrProtocolUnavailable, ti.protocol)
 	}
+	if err != nil {
+		return nil, "", err
+	}
+	ti.size = len(data)
+	ti.width = img.Bounds().Dx()
+	ti.height = img.Bounds().Dy()
+	return data, mime, nil
 }
 
 func (ti *TermImg) AsPNGBytes() ([]byte, error) {
+	if err := ti.load(); err != nil {
+		return nil, err
+	}
+	return encodePNG(ti.processImage())
+}
+
+func (ti *TermImg) AsJPEGBytes() ([]byte, error) {
+	if err := ti.load(); err != nil {
+		return nil, err
+	}
+	return encodeJPEG(ti.processImage())
+}
+
+// Release frees the memory held by the decoded image and its rendered escape sequence. The image
+// is decoded again from its file (or its original encoded bytes) the next time it is needed,
+// trading decoding time for memory. Images read from a reader whose encoded bytes weren't kept
+// (i.e. not PNG) can't be decoded again, so only their escape sequence is released.
+func (ti *TermImg) Release() {
+	ti.invalidate()
+	if ti.path == "" && len(ti.raw) == 0 {
+		return
+	}
+	ti.img = nil
+	if ti.path != "" {
+		ti.raw = nil // re-read from the file instead
+	}
+}
+
+// Clone returns a copy of the image with the same configuration, sharing its (read-only) pixels,
+// e.g. to render a configured "template" image at several sizes, as the setters modify the image
+// they are called on. The copy is rendered from scratch, and gets its own Kitty image ID unless
+// one was set with KittyImageID or CacheKey. Closing the copy doesn't close the original's file.
+func (ti *TermImg) Clone() *TermImg {
+	if ti.reader != nil {
+		// the reader can only be read once, so decode it now to share the pixels (or the error,
+		// which readErr keeps for the copy to fail with)
+		ti.load()
+	}
+	c := &TermImg{
+		path:     ti.path,
+		readErr:  ti.readErr,
+		protocol: ti.protocol,
+		img:      ti.img,
+		format:   ti.format,
+		raw:      ti.raw,
+		maxW:     ti.maxW,
+		maxH:     ti.maxH,
+
+		invert:     ti.invert,
+		autoInvert: ti.autoInvert,
+		layer:      ti.layer,
+		overflow:   ti.overflow,
+		offsetX:    ti.offsetX,
+		offsetY:    ti.offsetY,
+		label:      ti.label,
+		labelPos:   ti.labelPos,
+		colors:     ti.colors,
+		ditherMode: ti.ditherMode,
+		palette:    slices.Clone(ti.palette),
+		mono:       ti.mono,
+		background: ti.background,
+		depth:      ti.depth,
+		blockRes:   ti.blockRes,
+		fillCols:   ti.fillCols,
+		fillRows:   ti.fillRows,
+		wrap:       ti.wrap,
+		fontWidth:  ti.fontWidth,
+		fontHeight: ti.fontHeight,
+
+		preserveCursor: ti.preserveCursor,
+		onProgress:     ti.onProgress,
+		resizeQuality:  ti.resizeQuality,
+		crop:           ti.crop,
+		cropCenter:     ti.cropCenter,
+		maxPixels:      ti.maxPixels,
+		ditherStrength: ti.ditherStrength,
+
+		fallbacks: slices.Clone(ti.fallbacks),
+		resolved:  ti.resolved,
+
+		chunkSize:     ti.chunkSize,
+		kittyChunk:    ti.kittyChunk,
+		kittyQuiet:    ti.kittyQuiet,
+		kittyNoMove:   ti.kittyNoMove,
+		maxLineLength: ti.maxLineLength,
+		uriFormat:     ti.uriFormat,
+
+		cacheKey: ti.cacheKey,
+	}
+	if ti.kittyIDForced || ti.cacheKey != "" {
+		c.kittyID = ti.kittyID
+		c.kittyIDForced = ti.kittyIDForced
+	}
+	return c
+}
+
+// load decodes the image again if it was released
+func (ti *TermImg) load() (err error) {
+	ti.checkResize()
+	if ti.img != nil {
+		return nil
+	}
+	var r io.Reader
+	switch {
+	case len(ti.raw) > 0:
+		r = bytes.NewReader(ti.raw)
+	case ti.reader != nil:
+		r = ti.reader
+		ti.reader = nil // the data can't be read again
+		defer func() {
+			ti.readErr = err
+		}()
+	case ti.path != "":
+		f, err := os.Open(ti.path)
+		if err != nil {
+			return fmt.Errorf("failed to open image: %s", err)
+		}
+		defer f.Close()
+		r = f
+	case ti.readErr != nil:
+		return ti.readErr
+	default:
+		return fmt.Errorf("no image data")
+	}
+	img, format, raw, err := decodeImage(r)
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrDecode, err)
+	}
+	if err := checkFormat(format); err != nil {
+		return err
+	}
+	ti.img = &img
+	ti.format = format
+	ti.raw = raw
+	ti.scaleDecoded()
+	return nil
+}
+
+func encodePNG(img image.Image) ([]byte, error) {
 	var buf bytes.Buffer
-	if err := png.Encode(&buf, *ti.img); err != nil {
+	if err := png.Encode(&buf, img); err != nil {
 		return nil, fmt.Errorf("failed to encode image as PNG: %s", err)
 	}
 	return buf.Bytes(), nil
 }
 
-func (ti *TermImg) AsJPEGBytes() ([]byte, error) {
+func encodeJPEG(img image.Image) ([]byte, error) {
 	var buf bytes.Buffer
-	if err := jpeg.Encode(&buf, *ti.img, nil); err != nil {
+	if err := jpeg.Encode(&buf, img, nil); err != nil {
 		return nil, fmt.Errorf("failed to encode image as JPEG: %s", err)
 	}
 	return buf.Bytes(), nil
@@ -1,9 +1,33 @@
 package termimg
 
 import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
 	_ "image/jpeg"
-	_ "image/png"
+	"image/png"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	"golang.org/x/term"
 )
 
 func TestDetectProtocol(t *testing.T) {
@@ -32,3 +56,3346 @@ func TestDetectProtocol(t *testing.T) {
 		})
 	}
 }
+
+func TestFontSizeDetectionOrder(t *testing.T) {
+	saved := fontSizeMethods
+	defer func() {
+		fontSizeMethods = saved
+		SetFontSizeDetectionOrder(nil)
+	}()
+
+	var tried []FontSizeMethod
+	fontSizeMethods = map[FontSizeMethod]func() (int, int, error){}
+	for _, m := range DefaultFontSizeDetectionOrder() {
+		fontSizeMethods[m] = func() (int, int, error) {
+			tried = append(tried, m)
+			if m == CSI14t18t {
+				return 9, 18, nil
+			}
+			return 0, 0, ErrFontSizeUnknown
+		}
+	}
+
+	SetFontSizeDetectionOrder([]FontSizeMethod{XTSMGRAPHICS, CSI14t18t, CSI16t})
+	w, h, err := GetTerminalFontSize()
+	if err != nil {
+		t.Fatalf("GetTerminalFontSize() error = %v", err)
+	}
+	if w != 9 || h != 18 {
+		t.Errorf("GetTerminalFontSize() = %dx%d, want 9x18", w, h)
+	}
+	if want := []FontSizeMethod{XTSMGRAPHICS, CSI14t18t}; !slices.Equal(tried, want) {
+		t.Errorf("tried methods = %v, want %v", tried, want)
+	}
+}
+
+func TestParseFontSizeResponses(t *testing.T) {
+	params, err := parseCSIResponse([]byte("\x1b[6;18;9t"), 't')
+	if err != nil || !slices.Equal(params, []int{6, 18, 9}) {
+		t.Errorf("parseCSIResponse() = %v, %v", params, err)
+	}
+	w, h, err := parseITerm2CellSize([]byte("\x1b]1337;ReportCellSize=17.0;8.0;2.0\x1b\\"))
+	if err != nil || w != 16 || h != 34 {
+		t.Errorf("parseITerm2CellSize() = %dx%d, %v", w, h, err)
+	}
+}
+
+func TestInvert(t *testing.T) {
+	src := image.NewNRGBA(image.Rect(0, 0, 1, 1))
+	src.SetNRGBA(0, 0, color.NRGBA{R: 10, G: 20, B: 30, A: 128})
+	img := image.Image(src)
+	ti := &TermImg{protocol: Kitty, img: &img}
+
+	if got := ti.processImage().At(0, 0); got != (color.NRGBA{R: 10, G: 20, B: 30, A: 128}) {
+		t.Errorf("processImage() without Invert = %v", got)
+	}
+	if got := ti.Invert(true).processImage().At(0, 0); got != (color.NRGBA{R: 245, G: 235, B: 225, A: 128}) {
+		t.Errorf("processImage() with Invert = %v", got)
+	}
+}
+
+func TestAutoInvert(t *testing.T) {
+	src := image.NewNRGBA(image.Rect(0, 0, 1, 1))
+	src.SetNRGBA(0, 0, color.NRGBA{A: 255})
+	img := image.Image(src)
+	ti := (&TermImg{protocol: Kitty, img: &img}).AutoInvert(true)
+
+	tests := []struct {
+		colorfgbg string
+		want      color.Color
+	}{
+		{"15;0", color.NRGBA{A: 255}},                                 // dark background
+		{"0;default;15", color.NRGBA{R: 255, G: 255, B: 255, A: 255}}, // light background
+		{"", color.NRGBA{A: 255}},                                     // unknown background
+	}
+	saved := queryTerminal
+	defer func() { queryTerminal = saved; ClearDetectionCache() }()
+	queryTerminal = func(context.Context, string) ([]byte, error) { return nil, ErrEmptyResponse }
+	for _, tt := range tests {
+		ClearDetectionCache()
+		t.Setenv("COLORFGBG", tt.colorfgbg)
+		if got := ti.processImage().At(0, 0); got != tt.want {
+			t.Errorf("COLORFGBG=%q: processImage() = %v, want %v", tt.colorfgbg, got, tt.want)
+		}
+	}
+
+	// without COLORFGBG, the OSC 11 background color decides
+	t.Setenv("COLORFGBG", "")
+	for answer, want := range map[string]color.Color{
+		"\x1b]11;rgb:ffff/ffff/eeee\x1b\\": color.NRGBA{R: 255, G: 255, B: 255, A: 255},
+		"\x1b]11;rgb:1e1e/1e1e/2e2e\x07":   color.NRGBA{A: 255},
+	} {
+		ClearDetectionCache()
+		queryTerminal = func(context.Context, string) ([]byte, error) { return []byte(answer), nil }
+		if got := ti.processImage().At(0, 0); got != want {
+			t.Errorf("OSC 11 %q: processImage() = %v, want %v", answer, got, want)
+		}
+	}
+}
+
+func testImage(width, height int) image.Image {
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.SetNRGBA(x, y, color.NRGBA{R: uint8(x), G: uint8(y), B: uint8(x ^ y), A: 255})
+		}
+	}
+	return img
+}
+
+// noiseImage returns an image of pseudo random pixels, which PNG can't compress much
+func noiseImage(width, height int) image.Image {
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	seed := uint32(1)
+	for i := range img.Pix {
+		seed = seed*1103515245 + 12345
+		img.Pix[i] = uint8(seed>>16) | 0x80
+	}
+	return img
+}
+
+func TestRenderCache(t *testing.T) {
+	EnableRenderCache(2)
+	defer EnableRenderCache(0)
+	defer ClearRenderCache()
+
+	img := testImage(16, 16)
+	cached := &TermImg{protocol: Kitty, img: &img}
+	first, err := cached.Render()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := globalRenderCache.order.Len(); got != 1 {
+		t.Fatalf("render cache has %d entries, want 1", got)
+	}
+	ti := &TermImg{protocol: Kitty, img: &img}
+	if !ti.loadRenderCache() {
+		t.Fatalf("expected a render cache hit")
+	}
+	// each image keeps its own ID, so they don't replace each other in the terminal
+	want := strings.Replace(first, fmt.Sprintf(",i=%d;", cached.KittyID()), fmt.Sprintf(",i=%d;", ti.KittyID()), 1)
+	if ti.KittyID() == cached.KittyID() || ti.encoded != want {
+		t.Errorf("expected the cached output with the image's own ID %d, got %q", ti.KittyID(), ti.encoded[:min(len(ti.encoded), 64)])
+	}
+	if (&TermImg{protocol: ITerm2, img: &img}).loadRenderCache() {
+		t.Errorf("expected a render cache miss for a different protocol")
+	}
+	if (&TermImg{protocol: Kitty, img: &img}).Invert(true).loadRenderCache() {
+		t.Errorf("expected a render cache miss for different options")
+	}
+}
+
+func TestRenderCacheStats(t *testing.T) {
+	EnableRenderCache(2)
+	defer EnableRenderCache(0)
+	ClearRenderCache()
+	defer ClearRenderCache()
+
+	img := testImage(16, 16)
+	for i := range 3 {
+		(&TermImg{protocol: Kitty, img: &img}).Render()
+		if hits, misses, entries := RenderCacheStats(); hits != i || misses != 1 || entries != 1 {
+			t.Errorf("RenderCacheStats() after %d renders = %d, %d, %d, want %d, 1, 1", i+1, hits, misses, entries, i)
+		}
+	}
+	for _, size := range []int{8, 12, 16} {
+		other := testImage(size, size)
+		(&TermImg{protocol: ITerm2, img: &other}).Render()
+	}
+	if hits, misses, entries := RenderCacheStats(); hits != 2 || misses != 4 || entries != 2 {
+		t.Errorf("RenderCacheStats() = %d, %d, %d, want 2, 4, 2", hits, misses, entries)
+	}
+
+	EnableRenderCache(1)
+	if _, _, entries := RenderCacheStats(); entries != 1 {
+		t.Errorf("expected shrinking the cache to evict entries, got %d", entries)
+	}
+	ClearRenderCache()
+	if hits, misses, entries := RenderCacheStats(); hits != 0 || misses != 0 || entries != 0 {
+		t.Errorf("expected ClearRenderCache to reset the statistics")
+	}
+}
+
+func BenchmarkRenderCache(b *testing.B) {
+	img := testImage(512, 512)
+	b.Run("Miss", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := (&TermImg{protocol: Kitty, img: &img}).Render(); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("SameImage", func(b *testing.B) {
+		ti := &TermImg{protocol: Kitty, img: &img}
+		for i := 0; i < b.N; i++ {
+			if _, err := ti.Render(); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("Hit", func(b *testing.B) {
+		EnableRenderCache(1)
+		defer EnableRenderCache(0)
+		defer ClearRenderCache()
+		for i := 0; i < b.N; i++ {
+			if _, err := (&TermImg{protocol: Kitty, img: &img}).Render(); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func TestITerm2RegionClearSequence(t *testing.T) {
+	r := &imageRegion{row: 2, col: 4, cols: 4, rows: 2}
+	want := "\x1b7" + "\x1b[3;5H    " + "\x1b[4;5H    " + "\x1b8"
+	if got := r.clearSequence(); got != want {
+		t.Errorf("clearSequence() = %q, want %q", got, want)
+	}
+}
+
+func TestTrackITerm2Region(t *testing.T) {
+	savedQuery, savedTerminal := queryTerminal, isTerminal
+	defer func() { queryTerminal, isTerminal = savedQuery, savedTerminal }()
+	queries := 0
+	queryTerminal = func(_ context.Context, query string) ([]byte, error) {
+		queries++
+		return []byte("\x1b[5;3R"), nil
+	}
+
+	// the region covers the cells the image is scaled to
+	isTerminal = func(io.Writer) bool { return true }
+	img := testImage(40, 40)
+	ti := (&TermImg{protocol: ITerm2, img: &img}).FillCells(10, 4)
+	if err := ti.PrintTo(io.Discard); err != nil {
+		t.Fatal(err)
+	}
+	if ti.region == nil || *ti.region != (imageRegion{row: 4, col: 2, cols: 10, rows: 4}) {
+		t.Errorf("region = %+v, want 10x4 cells at 4,2", ti.region)
+	}
+
+	// the cursor position isn't queried when the image isn't written to the terminal
+	isTerminal = func(io.Writer) bool { return false }
+	queries = 0
+	ti = (&TermImg{protocol: ITerm2, img: &img}).FillCells(10, 4)
+	if err := ti.PrintTo(io.Discard); err != nil {
+		t.Fatal(err)
+	}
+	if ti.region != nil || queries != 0 {
+		t.Errorf("expected no region tracking, got %+v after %d queries", ti.region, queries)
+	}
+}
+
+func TestLayer(t *testing.T) {
+	img := testImage(4, 4)
+
+	out, err := (&TermImg{protocol: Kitty, img: &img}).Layer(-3).Render()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out, ",z=-3;") {
+		t.Errorf("Kitty output missing z-index: %q", out[:min(len(out), 64)])
+	}
+	out, err = (&TermImg{protocol: Kitty, img: &img}).Render()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(out, "z=") {
+		t.Errorf("Kitty output should not contain a z-index by default")
+	}
+
+	// iTerm2 has no z-index, images are layered in draw order
+	plain, _ := (&TermImg{protocol: ITerm2, img: &img}).Render()
+	layered, _ := (&TermImg{protocol: ITerm2, img: &img}).Layer(5).Render()
+	if plain != layered {
+		t.Errorf("iTerm2 output should not change with Layer")
+	}
+}
+
+func TestDiagnostics(t *testing.T) {
+	t.Setenv("TERM_PROGRAM", "test-terminal")
+	out := Diagnostics()
+	for _, want := range []string{`TERM_PROGRAM="test-terminal"`, "protocol: unsupported", "Kitty graphics"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("Diagnostics() missing %q:\n%s", want, out)
+		}
+	}
+
+	// unanswered and timed out queries are told apart
+	saved := queryTerminal
+	defer func() { queryTerminal = saved }()
+	queryTerminal = func(_ context.Context, query string) ([]byte, error) {
+		switch query {
+		case "\x1b[16t":
+			return []byte("\x1b[6;16;8t"), nil
+		case "\x1b[14t":
+			return nil, ErrQueryTimeout
+		default:
+			return nil, ErrEmptyResponse
+		}
+	}
+	out = Diagnostics()
+	for _, want := range []string{
+		`Cell size (CSI 16t) "\x1b[16t": "\x1b[6;16;8t" (`,
+		`Window size in pixels (CSI 14t) "\x1b[14t": timed out after `,
+		`Window size in cells (CSI 18t) "\x1b[18t": no answer (`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("Diagnostics() missing %q:\n%s", want, out)
+		}
+	}
+}
+
+func TestOnOverflow(t *testing.T) {
+	savedSize := terminalSize
+	defer func() {
+		terminalSize = savedSize
+		SetFontSizeDetectionOrder(nil)
+	}()
+	// 4 rows of 16px high cells: 64px
+	terminalSize = func() (int, int, error) { return 80, 4, nil }
+	SetFontSizeDetectionOrder([]FontSizeMethod{Fallback})
+
+	img := testImage(10, 100)
+	tests := []struct {
+		name     string
+		protocol Protocol
+		mode     OverflowMode
+		want     []string
+		notWant  []string
+	}{
+		{"Kitty/Scroll", Kitty, OverflowScroll, []string{"_Gs=10,v=100,"}, []string{",r="}},
+		{"Kitty/Clip", Kitty, OverflowClip, []string{"_Gs=10,v=64,"}, []string{",r="}},
+		{"Kitty/Downscale", Kitty, OverflowDownscale, []string{"_Gs=10,v=100,", ",r=4;"}, nil},
+		{"iTerm2/Scroll", ITerm2, OverflowScroll, []string{"width=10px;height=100px"}, nil},
+		{"iTerm2/Clip", ITerm2, OverflowClip, []string{"width=10px;height=64px"}, nil},
+		{"iTerm2/Downscale", ITerm2, OverflowDownscale, []string{"width=6px;height=64px"}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, err := (&TermImg{protocol: tt.protocol, img: &img}).OnOverflow(tt.mode).Render()
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(out, want) {
+					t.Errorf("output missing %q", want)
+				}
+			}
+			for _, notWant := range tt.notWant {
+				if strings.Contains(out, notWant) {
+					t.Errorf("output should not contain %q", notWant)
+				}
+			}
+		})
+	}
+
+	// images that already fit are left untouched
+	small := testImage(10, 20)
+	out, _ := (&TermImg{protocol: Kitty, img: &small}).OnOverflow(OverflowDownscale).Render()
+	if !strings.Contains(out, "_Gs=10,v=20,") || strings.Contains(out, ",r=") {
+		t.Errorf("image that fits should not be downscaled")
+	}
+}
+
+func TestPixelOffset(t *testing.T) {
+	img := testImage(4, 4)
+	out, err := (&TermImg{protocol: Kitty, img: &img}).PixelOffset(3, 5).Render()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out, ",X=3,Y=5;") {
+		t.Errorf("Kitty output missing pixel offset: %q", out[:min(len(out), 64)])
+	}
+	out, _ = (&TermImg{protocol: Kitty, img: &img}).Render()
+	if strings.Contains(out, ",X=") || strings.Contains(out, ",Y=") {
+		t.Errorf("Kitty output should not contain a pixel offset by default")
+	}
+}
+
+func TestKittyResponseOK(t *testing.T) {
+	tests := []struct {
+		resp string
+		want bool
+	}{
+		{"\x1b_Gi=43;OK\x1b\\", true},
+		{"\x1b_Gi=43;EINVAL:Unknown format specified\x1b\\", false},
+		{"\x1b_Gi=42;OK\x1b\\", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := kittyResponseOK([]byte(tt.resp), "43"); got != tt.want {
+			t.Errorf("kittyResponseOK(%q) = %t, want %t", tt.resp, got, tt.want)
+		}
+	}
+}
+
+func TestLabel(t *testing.T) {
+	src := image.NewNRGBA(image.Rect(0, 0, 64, 32))
+	draw.Draw(src, src.Bounds(), image.NewUniform(color.NRGBA{R: 128, G: 128, B: 128, A: 255}), image.Point{}, draw.Src)
+	img := image.Image(src)
+	ti := (&TermImg{protocol: Kitty, img: &img}).Label("hi", LabelTopLeft)
+
+	out := ti.processImage()
+	white := func(r image.Rectangle) bool {
+		for y := r.Min.Y; y < r.Max.Y; y++ {
+			for x := r.Min.X; x < r.Max.X; x++ {
+				if out.At(x, y) == (color.NRGBA{R: 255, G: 255, B: 255, A: 255}) {
+					return true
+				}
+			}
+		}
+		return false
+	}
+	if !white(image.Rect(0, 0, 20, 17)) {
+		t.Errorf("expected label pixels in the top left corner")
+	}
+	if white(image.Rect(20, 17, 64, 32)) {
+		t.Errorf("expected no label pixels outside of the label box")
+	}
+	if got := (*ti.img).At(0, 0); got != (color.NRGBA{R: 128, G: 128, B: 128, A: 255}) {
+		t.Errorf("Label should not modify the source image, got %v", got)
+	}
+}
+
+// panicImage is a malformed image that panics when its pixels are read
+type panicImage struct{ image.Image }
+
+func (panicImage) At(x, y int) color.Color { panic("malformed image") }
+
+func TestSafeRender(t *testing.T) {
+	bad := image.Image(panicImage{testImage(2, 2)})
+	for _, protocol := range []Protocol{ITerm2, Kitty} {
+		if _, err := SafeRender(&TermImg{protocol: protocol, img: &bad}); !errors.Is(err, ErrRenderPanic) {
+			t.Errorf("SafeRender(%s) error = %v, want ErrRenderPanic", protocol, err)
+		}
+		if err := SafePrint(&TermImg{protocol: protocol, img: &bad}); !errors.Is(err, ErrRenderPanic) {
+			t.Errorf("SafePrint(%s) error = %v, want ErrRenderPanic", protocol, err)
+		}
+	}
+	img := testImage(2, 2)
+	if _, err := SafeRender(&TermImg{protocol: Kitty, img: &img}); err != nil {
+		t.Errorf("SafeRender() error = %v", err)
+	}
+}
+
+func TestITerm2MaxLineLength(t *testing.T) {
+	img := testImage(64, 64)
+	out, err := (&TermImg{protocol: ITerm2, img: &img}).MaxLineLength(1000).Render()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out, "]1337;MultipartFile=") || !strings.Contains(out, "]1337;FileEnd") {
+		t.Fatalf("expected a multipart file transfer")
+	}
+	segments := strings.Split(out, "\x07")
+	for _, seg := range segments {
+		if i := strings.LastIndexByte(seg, ':'); i >= 0 {
+			if payload := seg[i+1:]; len(payload) > 1000 {
+				t.Errorf("segment payload length %d exceeds the maximum of 1000", len(payload))
+			}
+		}
+	}
+
+	single, _ := (&TermImg{protocol: ITerm2, img: &img}).Render()
+	if !strings.Contains(single, "]1337;File=") {
+		t.Errorf("expected a single file transfer by default")
+	}
+	chunked, _ := (&TermImg{protocol: ITerm2, img: &img}).ITerm2ChunkSize(300).Render()
+	if n := strings.Count(chunked, "]1337;FilePart="); n < 2 {
+		t.Errorf("expected several file parts with a small chunk size, got %d", n)
+	}
+}
+
+func TestParseDECRPM(t *testing.T) {
+	tests := []struct {
+		resp      string
+		supported bool
+		enabled   bool
+		wantErr   bool
+	}{
+		{"\x1b[?80;1$y", true, true, false},
+		{"\x1b[?80;2$y", true, false, false},
+		{"\x1b[?80;4$y", true, false, false},
+		{"\x1b[?80;0$y", false, false, false},
+		{"\x1b[?1070;1$y", false, false, true},
+		{"\x1b[0n", false, false, true},
+	}
+	for _, tt := range tests {
+		supported, enabled, err := parseDECRPM([]byte(tt.resp), MODE_SIXEL_SCROLLING)
+		if (err != nil) != tt.wantErr || supported != tt.supported || enabled != tt.enabled {
+			t.Errorf("parseDECRPM(%q) = %t, %t, %v", tt.resp, supported, enabled, err)
+		}
+	}
+}
+
+func captureStdout(t *testing.T, fn func()) string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = stdout }()
+
+	done := make(chan string)
+	go func() {
+		out, _ := io.ReadAll(r)
+		done <- string(out)
+	}()
+	fn()
+	w.Close()
+	return <-done
+}
+
+func TestHidePlacement(t *testing.T) {
+	img := testImage(4, 4)
+	ti := &TermImg{protocol: Kitty, img: &img}
+	if err := ti.HidePlacement(); err == nil {
+		t.Errorf("HidePlacement() on an image that was never rendered should fail")
+	}
+	if _, err := ti.Render(); err != nil {
+		t.Fatal(err)
+	}
+
+	out := captureStdout(t, func() {
+		if err := ti.HidePlacement(); err != nil {
+			t.Error(err)
+		}
+	})
+	if want := fmt.Sprintf("_Ga=d,d=i,i=%d,", ti.kittyID); !strings.Contains(out, want) {
+		t.Errorf("HidePlacement() = %q, want it to contain %q", out, want)
+	}
+	out = captureStdout(t, func() {
+		if err := ti.ShowPlacement(); err != nil {
+			t.Error(err)
+		}
+	})
+	if want := fmt.Sprintf("_Ga=p,q=2,i=%d", ti.kittyID); !strings.Contains(out, want) {
+		t.Errorf("ShowPlacement() = %q, want it to contain %q", out, want)
+	}
+}
+
+func TestProtocolText(t *testing.T) {
+	for _, p := range []Protocol{Unsupported, ITerm2, Kitty} {
+		text, err := p.MarshalText()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got Protocol
+		if err := got.UnmarshalText(text); err != nil || got != p {
+			t.Errorf("round trip of %s = %s, %v", p, got, err)
+		}
+	}
+	if p, err := ParseProtocol("KITTY"); err != nil || p != Kitty {
+		t.Errorf("ParseProtocol(KITTY) = %s, %v", p, err)
+	}
+	if _, err := ParseProtocol("sixel"); err == nil {
+		t.Errorf("ParseProtocol(sixel) should fail")
+	}
+	var cfg struct{ Protocol Protocol }
+	if err := json.Unmarshal([]byte(`{"Protocol":"iterm2"}`), &cfg); err != nil || cfg.Protocol != ITerm2 {
+		t.Errorf("json.Unmarshal() = %s, %v", cfg.Protocol, err)
+	}
+}
+
+func TestOverflowModeText(t *testing.T) {
+	for _, m := range []OverflowMode{OverflowScroll, OverflowClip, OverflowDownscale} {
+		text, err := m.MarshalText()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got OverflowMode
+		if err := got.UnmarshalText(text); err != nil || got != m {
+			t.Errorf("round trip of %s = %s, %v", m, got, err)
+		}
+	}
+	if _, err := ParseOverflowMode("wrap"); err == nil {
+		t.Errorf("ParseOverflowMode(wrap) should fail")
+	}
+}
+
+func TestDitherColors(t *testing.T) {
+	img := testImage(64, 64)
+	for _, mode := range []DitherMode{DitherFloydSteinberg, DitherAtkinson, DitherOrdered} {
+		for _, n := range []int{2, 4, 8, 16} {
+			out := (&TermImg{protocol: Kitty, img: &img}).DitherColors(n).DitherMode(mode).processImage()
+			if out.Bounds() != img.Bounds() {
+				t.Errorf("DitherColors(%d) %s bounds = %v, want %v", n, mode, out.Bounds(), img.Bounds())
+			}
+			colors := make(map[color.Color]struct{})
+			for y := 0; y < 64; y++ {
+				for x := 0; x < 64; x++ {
+					colors[out.At(x, y)] = struct{}{}
+				}
+			}
+			if len(colors) != n {
+				t.Errorf("DitherColors(%d) %s produced %d distinct colors", n, mode, len(colors))
+			}
+		}
+	}
+
+	// transparent pixels stay transparent in every mode
+	src := image.NewNRGBA(image.Rect(0, 0, 8, 8))
+	draw.Draw(src, image.Rect(0, 0, 4, 8), image.NewUniform(color.NRGBA{R: 200, G: 100, B: 50, A: 255}), image.Point{}, draw.Src)
+	for _, mode := range []DitherMode{DitherFloydSteinberg, DitherAtkinson, DitherOrdered} {
+		out := ditherColors(src, 4, mode, 1)
+		if _, _, _, a := out.At(6, 6).RGBA(); a != 0 {
+			t.Errorf("%s: expected transparent pixels to be kept", mode)
+		}
+	}
+
+	// n is capped to the size of a palette, including the transparent color
+	noise := noiseImage(64, 64)
+	translucent := image.Image(image.NewNRGBA(image.Rect(0, 0, 64, 64)))
+	draw.Draw(translucent.(*image.NRGBA), image.Rect(0, 0, 64, 60), noise, image.Point{}, draw.Src)
+	for _, src := range []image.Image{noise, translucent} {
+		for _, n := range []int{256, 300} {
+			ti := &TermImg{protocol: Kitty, img: &src}
+			if p, ok := ti.DitherColors(n).processImage().(*image.Paletted); !ok || len(p.Palette) > 256 {
+				t.Errorf("DitherColors(%d) palette is too large", n)
+			}
+			if _, err := ti.Render(); err != nil {
+				t.Errorf("DitherColors(%d): %v", n, err)
+			}
+		}
+	}
+}
+
+func TestDitherStrength(t *testing.T) {
+	// a horizontal gray gradient, dithered to black and white
+	src := image.NewNRGBA(image.Rect(0, 0, 64, 16))
+	for y := 0; y < 16; y++ {
+		for x := 0; x < 64; x++ {
+			v := uint8(x * 4)
+			src.SetNRGBA(x, y, color.NRGBA{R: v, G: v, B: v, A: 255})
+		}
+	}
+	img := image.Image(src)
+	bw := color.Palette{color.Black, color.White}
+	// the noise is the number of neighbouring pixels of different colors
+	noise := func(ti *TermImg) int {
+		out := ti.processImage()
+		n := 0
+		for y := 0; y < 16; y++ {
+			for x := 1; x < 64; x++ {
+				if out.At(x, y) != out.At(x-1, y) {
+					n++
+				}
+			}
+		}
+		return n
+	}
+	for _, mode := range []DitherMode{DitherFloydSteinberg, DitherAtkinson, DitherOrdered} {
+		full := noise((&TermImg{protocol: Kitty, img: &img}).DitherPalette(bw).DitherMode(mode))
+		half := noise((&TermImg{protocol: Kitty, img: &img}).DitherPalette(bw).DitherMode(mode).DitherStrength(0.5))
+		none := noise((&TermImg{protocol: Kitty, img: &img}).DitherPalette(bw).DitherMode(mode).DitherStrength(0))
+		if !(none < half && half < full) {
+			t.Errorf("%s: expected less noise at lower strengths, got %d (0), %d (0.5), %d (1)", mode, none, half, full)
+		}
+		// without diffusion, each row is thresholded once, from black to white
+		if none != 16 {
+			t.Errorf("%s: expected a plain threshold at strength 0, got %d color changes", mode, none)
+		}
+	}
+	if got := (&TermImg{}).DitherStrength(3).ditherStrengthFactor(); got != 1 {
+		t.Errorf("DitherStrength(3) = %v, want it clamped to 1", got)
+	}
+}
+
+func TestPreview(t *testing.T) {
+	// 4 solid quadrants
+	src := image.NewNRGBA(image.Rect(0, 0, 8, 8))
+	quadrants := []color.NRGBA{{R: 255, A: 255}, {G: 255, A: 255}, {B: 255, A: 255}, {R: 255, G: 255, B: 255, A: 255}}
+	for i, c := range quadrants {
+		x, y := i%2*4, i/2*4
+		draw.Draw(src, image.Rect(x, y, x+4, y+4), image.NewUniform(c), image.Point{}, draw.Src)
+	}
+	img := image.Image(src)
+	out, err := (&TermImg{protocol: Kitty, img: &img}).Preview(2, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "\x1b[48;2;255;0;0m \x1b[48;2;0;255;0m \x1b[0m\n" +
+		"\x1b[48;2;0;0;255m \x1b[48;2;255;255;255m \x1b[0m\n"
+	if out != want {
+		t.Errorf("Preview(2, 2) = %q, want %q", out, want)
+	}
+
+	// a single cell is the average of the whole image
+	out, _ = (&TermImg{protocol: Kitty, img: &img}).Preview(1, 1)
+	if want := "\x1b[48;2;127;127;127m \x1b[0m\n"; out != want {
+		t.Errorf("Preview(1, 1) = %q, want %q", out, want)
+	}
+}
+
+func TestRemoteSessionDisablesFileTransfer(t *testing.T) {
+	for _, key := range []string{"SSH_CONNECTION", "SSH_TTY", "SSH_CLIENT"} {
+		t.Setenv(key, "")
+	}
+	if IsRemoteSession() {
+		t.Fatalf("IsRemoteSession() = true without SSH env vars")
+	}
+
+	img := testImage(4, 4)
+	ti := &TermImg{path: "/tmp/image.png", protocol: Kitty, img: &img}
+	out := captureStdout(t, func() { ti.Print() })
+	if !strings.Contains(out, TRANSFER_FILE) {
+		t.Errorf("expected a local file transfer, got %q", out)
+	}
+
+	t.Setenv("SSH_CONNECTION", "10.0.0.1 51234 10.0.0.2 22")
+	if !IsRemoteSession() {
+		t.Fatalf("IsRemoteSession() = false with SSH_CONNECTION set")
+	}
+	out = captureStdout(t, func() { ti.Print() })
+	if strings.Contains(out, TRANSFER_FILE) || !strings.Contains(out, TRANSFER_DIRECT+","+SUPPRESS_OK) {
+		t.Errorf("expected a direct transfer in a remote session, got %q", out[:min(len(out), 64)])
+	}
+}
+
+func TestPreviewColorDepth(t *testing.T) {
+	img := testImage(32, 32)
+	out, err := (&TermImg{protocol: Kitty, img: &img}).ColorDepth(Depth16).Preview(8, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	re := regexp.MustCompile(`\x1b\[([0-9;]*)m`)
+	for _, m := range re.FindAllStringSubmatch(out, -1) {
+		code, err := strconv.Atoi(m[1])
+		if err != nil || !(code == 0 || (code >= 40 && code <= 47) || (code >= 100 && code <= 107)) {
+			t.Errorf("unexpected SGR code %q in 16 color output", m[1])
+		}
+	}
+
+	red := color.RGBA{R: 250, G: 10, B: 10, A: 255}
+	if got := Depth16.background(red); got != "\x1b[101m" {
+		t.Errorf("Depth16 background = %q", got)
+	}
+	if got := Depth256.background(red); got != "\x1b[48;5;9m" {
+		t.Errorf("Depth256 background = %q", got)
+	}
+}
+
+func TestFitDimensions(t *testing.T) {
+	defer SetFontSizeDetectionOrder(nil)
+	SetFontSizeDetectionOrder([]FontSizeMethod{Fallback}) // 8x16 cells
+
+	tests := []struct {
+		name             string
+		width, height    int
+		maxCols, maxRows int
+		cols, rows       int
+	}{
+		{"landscape/square box", 320, 80, 20, 20, 20, 3},
+		{"landscape/wide box", 320, 80, 40, 2, 16, 2},
+		{"portrait/square box", 80, 640, 20, 20, 5, 20},
+		{"portrait/tall box", 80, 640, 10, 30, 8, 30},
+		{"fits", 40, 40, 20, 20, 5, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			img := testImage(tt.width, tt.height)
+			cols, rows := (&TermImg{protocol: Kitty, img: &img}).FitDimensions(tt.maxCols, tt.maxRows)
+			if cols != tt.cols || rows != tt.rows {
+				t.Errorf("FitDimensions(%d, %d) = %dx%d, want %dx%d", tt.maxCols, tt.maxRows, cols, rows, tt.cols, tt.rows)
+			}
+		})
+	}
+}
+
+func TestKittyTransmitsOriginalPNG(t *testing.T) {
+	t.Setenv("TERM_PROGRAM", "")
+	t.Setenv("KITTY_WINDOW_ID", "1")
+
+	var buf bytes.Buffer
+	enc := png.Encoder{CompressionLevel: png.BestCompression}
+	if err := enc.Encode(&buf, testImage(32, 32)); err != nil {
+		t.Fatal(err)
+	}
+	original := buf.Bytes()
+
+	ti, err := NewTermImg(bytes.NewReader(original))
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := ti.Render()
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload := out[strings.IndexByte(out, ';')+1 : strings.LastIndex(out, ESCAPE)]
+	data, err := base64.StdEncoding.DecodeString(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, original) {
+		t.Errorf("expected the original PNG bytes to be transmitted unmodified")
+	}
+
+	// options that modify the pixels require re-encoding
+	out, _ = ti.Invert(true).Render()
+	if strings.Contains(out, base64.StdEncoding.EncodeToString(original)) {
+		t.Errorf("expected an inverted image to be re-encoded")
+	}
+}
+
+// countingReader counts the reads of the underlying reader
+type countingReader struct {
+	io.Reader
+	reads int
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	r.reads++
+	return r.Reader.Read(p)
+}
+
+func TestLazy(t *testing.T) {
+	t.Setenv("TERM_PROGRAM", "")
+	t.Setenv("KITTY_WINDOW_ID", "1")
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, testImage(16, 16)); err != nil {
+		t.Fatal(err)
+	}
+	r := &countingReader{Reader: bytes.NewReader(buf.Bytes())}
+	ti, err := NewTermImgLazy(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ti.Layer(1) // configuring the image doesn't decode it
+	if r.reads != 0 || ti.img != nil {
+		t.Fatalf("expected no read before rendering, got %d reads", r.reads)
+	}
+	out, err := ti.Render()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.reads == 0 || ti.format != "png" || !strings.Contains(out, "_Gs=16,v=16,") {
+		t.Errorf("expected the image to be decoded by Render, got %d reads", r.reads)
+	}
+	reads := r.reads
+	ti.Release()
+	if _, err := ti.Render(); err != nil || r.reads != reads {
+		t.Errorf("expected a released image to be decoded again from its PNG bytes, not the reader: %v", err)
+	}
+
+	path := filepath.Join(t.TempDir(), "image.png")
+	if err := os.WriteFile(path, buf.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	ti, err = OpenLazy(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ti.img != nil || ti.closer != nil {
+		t.Errorf("expected OpenLazy not to decode or keep the file open")
+	}
+	if _, err := ti.Render(); err != nil || ti.img == nil {
+		t.Errorf("expected the file to be decoded by Render: %v", err)
+	}
+	if _, err := OpenLazy(filepath.Join(t.TempDir(), "missing.png")); err == nil {
+		t.Errorf("expected an error opening a missing file")
+	}
+
+	ti, err = NewTermImgLazy(strings.NewReader("not an image"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ti.Render(); !errors.Is(err, ErrDecode) {
+		t.Errorf("expected the decoding error to be returned by Render, got %v", err)
+	}
+	if _, err := ti.Render(); !errors.Is(err, ErrDecode) {
+		t.Errorf("expected the decoding error to be returned again, got %v", err)
+	}
+
+	// a clone of an image that fails to decode fails with the same error
+	ti, err = NewTermImgLazy(strings.NewReader("not an image"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ti.Clone().Render(); !errors.Is(err, ErrDecode) {
+		t.Errorf("expected the clone to fail with the decoding error, got %v", err)
+	}
+	if _, err := ti.Render(); !errors.Is(err, ErrDecode) {
+		t.Errorf("expected the original to fail with the decoding error, got %v", err)
+	}
+}
+
+func TestFromBytes(t *testing.T) {
+	t.Setenv("TERM_PROGRAM", "")
+	t.Setenv("KITTY_WINDOW_ID", "1")
+
+	var buf bytes.Buffer
+	enc := png.Encoder{CompressionLevel: png.BestCompression}
+	if err := enc.Encode(&buf, testImage(32, 32)); err != nil {
+		t.Fatal(err)
+	}
+	original := buf.Bytes()
+
+	ti, err := FromBytes(original)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ti.format != "png" || &ti.raw[0] != &original[0] {
+		t.Errorf("expected the PNG bytes to be retained")
+	}
+	out, err := ti.Render()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if payload := out[strings.IndexByte(out, ';')+1 : strings.LastIndex(out, ESCAPE)]; payload != base64.StdEncoding.EncodeToString(original) {
+		t.Errorf("expected the original PNG bytes to be transmitted without re-encoding")
+	}
+
+	if _, err := FromBytes([]byte("not an image")); err == nil {
+		t.Errorf("expected an error decoding invalid data")
+	}
+}
+
+func TestRelease(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "image.png")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := png.Encode(f, testImage(16, 16)); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	ti := &TermImg{path: path, protocol: Kitty}
+	if err := ti.load(); err != nil {
+		t.Fatal(err)
+	}
+	want, err := ti.Render()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ti.Release()
+	if ti.img != nil || ti.encoded != "" {
+		t.Fatalf("Release() should drop the decoded image and escape sequence")
+	}
+	got, err := ti.Render()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != want {
+		t.Errorf("Render() after Release() differs from the original render")
+	}
+}
+
+func TestDetectProtocolWithoutTermProgram(t *testing.T) {
+	t.Setenv("TERM_PROGRAM", "")
+	t.Setenv("TERM", "xterm-256color")
+	t.Setenv("KITTY_WINDOW_ID", "")
+	saved := queryTerminal
+	defer func() {
+		queryTerminal = saved
+		ClearDetectionCache()
+	}()
+
+	tests := []struct {
+		name      string
+		responses map[string]string
+		want      Protocol
+	}{
+		{
+			name:      "iTerm2",
+			responses: map[string]string{"\x1b[>0q": "\x1bP>|iTerm2 3.5.0\x1b\\"},
+			want:      ITerm2,
+		},
+		{
+			name: "Kitty",
+			responses: map[string]string{
+				"\x1b[>0q": "\x1bP>|kitty(0.35.2)\x1b\\",
+				"a=q":      "\x1b_Gi=42;OK\x1b\\",
+				"a=t":      "\x1b_Gi=43;OK\x1b\\",
+			},
+			want: Kitty,
+		},
+		{
+			name:      "no response",
+			responses: map[string]string{},
+			want:      Unsupported,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ClearDetectionCache()
+			queryTerminal = func(_ context.Context, query string) ([]byte, error) {
+				for key, resp := range tt.responses {
+					if strings.Contains(query, key) {
+						return []byte(resp), nil
+					}
+				}
+				return nil, ErrEmptyResponse
+			}
+			var got Protocol
+			captureStdout(t, func() { got = DetectProtocol() })
+			if got != tt.want {
+				t.Errorf("DetectProtocol() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCapabilities(t *testing.T) {
+	tests := []struct {
+		protocol Protocol
+		want     Capabilities
+	}{
+		{ITerm2, Capabilities{}},
+		{Kitty, Capabilities{ZIndex: true, PixelOffset: true, Transparency: true, FileTransfer: true, PreciseClear: true, HidePlacement: true}},
+		{Unsupported, Capabilities{}},
+	}
+	for _, tt := range tests {
+		if got := tt.protocol.Capabilities(); got != tt.want {
+			t.Errorf("%s.Capabilities() = %+v, want %+v", tt.protocol, got, tt.want)
+		}
+	}
+
+	img := testImage(2, 2)
+	if err := (&TermImg{protocol: Kitty, img: &img}).PixelOffset(1, 1).Validate(); err != nil {
+		t.Errorf("Validate() error = %v", err)
+	}
+	if err := (&TermImg{protocol: ITerm2, img: &img}).PixelOffset(1, 1).Validate(); err == nil {
+		t.Errorf("Validate() should fail for PixelOffset with iTerm2")
+	}
+}
+
+func TestDataURI(t *testing.T) {
+	img := testImage(8, 8)
+	for _, tt := range []struct{ format, prefix string }{{"", "data:image/png;base64,"}, {"jpeg", "data:image/jpeg;base64,"}} {
+		uri, err := (&TermImg{protocol: Kitty, img: &img}).DataURIFormat(tt.format).DataURI()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(uri, tt.prefix) {
+			t.Fatalf("DataURI() = %q, want prefix %q", uri[:min(len(uri), 32)], tt.prefix)
+		}
+		data, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(uri, tt.prefix))
+		if err != nil {
+			t.Fatal(err)
+		}
+		decoded, _, err := image.Decode(bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if decoded.Bounds() != img.Bounds() {
+			t.Errorf("decoded bounds = %v, want %v", decoded.Bounds(), img.Bounds())
+		}
+		if got := color.NRGBAModel.Convert(decoded.At(3, 5)); tt.format == "" && got != img.At(3, 5) {
+			t.Errorf("decoded PNG pixel = %v, want %v", got, img.At(3, 5))
+		}
+	}
+	if _, err := (&TermImg{protocol: Kitty, img: &img}).DataURIFormat("gif").DataURI(); err == nil {
+		t.Errorf("DataURI() should fail for an unsupported format")
+	}
+}
+
+func TestWatchResize(t *testing.T) {
+	savedSize := terminalSize
+	defer func() {
+		terminalSize = savedSize
+		SetFontSizeDetectionOrder(nil)
+	}()
+	rows := 4
+	terminalSize = func() (int, int, error) { return 80, rows, nil }
+	SetFontSizeDetectionOrder([]FontSizeMethod{Fallback})
+
+	img := testImage(10, 200)
+	ti := (&TermImg{protocol: Kitty, img: &img}).OnOverflow(OverflowDownscale)
+	ch := make(chan os.Signal)
+	defer close(ch)
+	ti.WatchResize(ch)
+
+	out, _ := ti.Render()
+	if !strings.Contains(out, ",r=4;") {
+		t.Fatalf("expected the image to be downscaled to 4 rows")
+	}
+
+	rows = 8
+	ch <- os.Interrupt // any signal, as sent by signal.Notify on SIGWINCH
+	deadline := time.Now().Add(time.Second)
+	for !ti.resized.Load() && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	out, _ = ti.Render()
+	if !strings.Contains(out, ",r=8;") {
+		t.Errorf("expected the image to be rendered again for 8 rows after a resize")
+	}
+}
+
+func TestPreload(t *testing.T) {
+	img := testImage(4, 4)
+	ti := &TermImg{protocol: Kitty, img: &img}
+	var id uint32
+	out := captureStdout(t, func() {
+		var err error
+		if id, err = ti.Preload(); err != nil {
+			t.Error(err)
+		}
+	})
+	if !strings.Contains(out, ACTION_TRANSMIT+",") || strings.Contains(out, ACTION_TRANSFER) || strings.Contains(out, ACTION_PLACEMENT) {
+		t.Errorf("Preload() should only transmit the image: %q", out[:min(len(out), 64)])
+	}
+	if want := fmt.Sprintf(",i=%d", id); id == 0 || !strings.Contains(out, want) {
+		t.Errorf("Preload() returned ID %d, output %q", id, out[:min(len(out), 64)])
+	}
+
+	out = captureStdout(t, func() {
+		if err := PlaceByID(id, 2, 3); err != nil {
+			t.Error(err)
+		}
+	})
+	if want := fmt.Sprintf("\x1b7\x1b[4;3H\x1b_Ga=p,i=%d,q=2\x1b\\\x1b8", id); out != want {
+		t.Errorf("PlaceByID() = %q, want %q", out, want)
+	}
+}
+
+func TestFillCells(t *testing.T) {
+	img := testImage(30, 10)
+	out, err := (&TermImg{protocol: Kitty, img: &img}).FillCells(12, 7).Render()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out, "_Gs=30,v=10,") || !strings.Contains(out, ",c=12,r=7;") {
+		t.Errorf("Kitty output should contain the original size and the exact cells: %q", out[:min(len(out), 80)])
+	}
+	out, err = (&TermImg{protocol: ITerm2, img: &img}).FillCells(12, 7).Render()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out, ";width=12;height=7;preserveAspectRatio=0;") {
+		t.Errorf("iTerm2 output should contain the exact cells: %q", out[:min(len(out), 80)])
+	}
+}
+
+func TestWrapForMultiplexer(t *testing.T) {
+	seq := "\x1b]11;?\x07"
+	tests := []struct {
+		multiplexer string
+		want        string
+	}{
+		{"tmux", "\x1bPtmux;\x1b\x1b]11;?\x07\x1b\\"},
+		{"screen", "\x1bP\x1b]11;?\x07\x1b\\"},
+		{"", seq},
+	}
+	for _, tt := range tests {
+		if got := wrapForMultiplexer(seq, tt.multiplexer); got != tt.want {
+			t.Errorf("wrapForMultiplexer(%q) = %q, want %q", tt.multiplexer, got, tt.want)
+		}
+	}
+
+	t.Setenv("TMUX", "")
+	t.Setenv("TERM_PROGRAM", "")
+	t.Setenv("STY", "")
+	if got := WrapForMultiplexer(seq); got != seq {
+		t.Errorf("WrapForMultiplexer() outside a multiplexer = %q, want %q", got, seq)
+	}
+	t.Setenv("TMUX", "/tmp/tmux-1000/default,1234,0")
+	if got := WrapForMultiplexer(seq); got != tests[0].want {
+		t.Errorf("WrapForMultiplexer() in tmux = %q, want %q", got, tests[0].want)
+	}
+}
+
+func TestCursorTo(t *testing.T) {
+	tests := []struct {
+		x, y int
+		want string
+	}{
+		{0, 0, "\x1b[1;1H"},
+		{9, 0, "\x1b[1;10H"},
+		{0, 4, "\x1b[5;1H"},
+		{79, 23, "\x1b[24;80H"},
+	}
+	for _, tt := range tests {
+		if got := cursorTo(tt.x, tt.y); got != tt.want {
+			t.Errorf("cursorTo(%d, %d) = %q, want %q", tt.x, tt.y, got, tt.want)
+		}
+	}
+}
+
+func TestWrap(t *testing.T) {
+	savedSize := terminalSize
+	defer func() {
+		terminalSize = savedSize
+		SetFontSizeDetectionOrder(nil)
+	}()
+	// 10 columns of 8px wide cells: 80px
+	terminalSize = func() (int, int, error) { return 10, 24, nil }
+	SetFontSizeDetectionOrder([]FontSizeMethod{Fallback})
+
+	img := testImage(240, 16)
+	for protocol, marker := range map[Protocol]string{Kitty: ACTION_TRANSFER, ITerm2: "]1337;File="} {
+		out, err := (&TermImg{protocol: protocol, img: &img}).Wrap(true).Render()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n := strings.Count(out, marker); n != 3 {
+			t.Errorf("%s: rendered %d strips, want 3", protocol, n)
+		}
+		out, _ = (&TermImg{protocol: protocol, img: &img}).Render()
+		if n := strings.Count(out, marker); n != 1 {
+			t.Errorf("%s: rendered %d images without Wrap, want 1", protocol, n)
+		}
+	}
+	out, _ := (&TermImg{protocol: Kitty, img: &img}).Wrap(true).Render()
+	if !strings.Contains(out, "_Gs=80,v=16,") {
+		t.Errorf("strips should be as wide as the terminal")
+	}
+}
+
+func TestCacheKey(t *testing.T) {
+	img := testImage(4, 4)
+	a, _ := (&TermImg{protocol: Kitty, img: &img}).CacheKey("icons/folder").Render()
+	b, _ := (&TermImg{protocol: Kitty, img: &img}).CacheKey("icons/folder").Render()
+	c, _ := (&TermImg{protocol: Kitty, img: &img}).CacheKey("icons/file").Render()
+	id := func(out string) string {
+		m := regexp.MustCompile(`,i=(\d+)`).FindStringSubmatch(out)
+		if m == nil {
+			t.Fatalf("missing image ID in %q", out[:min(len(out), 64)])
+		}
+		return m[1]
+	}
+	if id(a) != id(b) {
+		t.Errorf("the same cache key should yield the same image ID: %s != %s", id(a), id(b))
+	}
+	if id(a) == id(c) {
+		t.Errorf("different cache keys should yield different image IDs")
+	}
+
+	saved := queryTerminal
+	defer func() { queryTerminal = saved }()
+	var queries []string
+	queryTerminal = func(_ context.Context, query string) ([]byte, error) {
+		queries = append(queries, query)
+		return []byte(fmt.Sprintf("\x1b_Gi=%s;OK\x1b\\", id(a))), nil
+	}
+	out := captureStdout(t, func() {
+		if err := (&TermImg{protocol: Kitty, img: &img}).CacheKey("icons/folder").Print(); err != nil {
+			t.Error(err)
+		}
+	})
+	if len(queries) != 1 || !strings.Contains(queries[0], ACTION_PLACEMENT) {
+		t.Errorf("expected a single placement of the cached image, got %q", queries)
+	}
+	if strings.Contains(out, ACTION_TRANSFER) {
+		t.Errorf("a cached image should not be transmitted again")
+	}
+}
+
+// graphicsSequence matches an APC (Kitty) or OSC (iTerm2) sequence up to its terminator
+var graphicsSequence = regexp.MustCompile(`\x1b(_G|\]1337;)[^\x1b\x07]*(\x1b\\|\x07)?`)
+
+func TestSequenceTerminators(t *testing.T) {
+	img := testImage(64, 64)
+	var out strings.Builder
+	for _, ti := range []*TermImg{
+		{protocol: Kitty, img: &img},
+		{protocol: ITerm2, img: &img},
+		(&TermImg{protocol: ITerm2, img: &img}).ITerm2ChunkSize(300),
+	} {
+		s, err := ti.Render()
+		if err != nil {
+			t.Fatal(err)
+		}
+		out.WriteString(s)
+	}
+	ti := &TermImg{protocol: Kitty, img: &img}
+	ti.Render()
+	out.WriteString(captureStdout(t, func() {
+		ti.HidePlacement()
+		ti.ShowPlacement()
+		ti.Clear()
+		clearAllKitty(os.Stdout)
+	}))
+
+	seqs := graphicsSequence.FindAllStringSubmatch(out.String(), -1)
+	if len(seqs) == 0 {
+		t.Fatal("no graphics sequences found")
+	}
+	for _, m := range seqs {
+		want := "\x1b\\"
+		if m[1] != "_G" {
+			want = "\x07"
+		}
+		if m[2] != want {
+			t.Errorf("sequence %q... terminated by %q, want %q", m[0][:min(len(m[0]), 32)], m[2], want)
+		}
+	}
+	// no stray terminators between sequences
+	if rest := graphicsSequence.ReplaceAllString(out.String(), ""); strings.ContainsAny(rest, "\x1b\x07") {
+		t.Errorf("stray escape bytes outside of graphics sequences: %q", rest)
+	}
+}
+
+func TestWriterVariants(t *testing.T) {
+	SetFontSizeDetectionOrder([]FontSizeMethod{Fallback})
+	defer SetFontSizeDetectionOrder(nil)
+
+	img := testImage(8, 8)
+	ti := &TermImg{protocol: Kitty, img: &img}
+	g := &gif.GIF{
+		Image:  []*image.Paletted{image.NewPaletted(image.Rect(0, 0, 2, 2), color.Palette{color.Black}), image.NewPaletted(image.Rect(0, 0, 2, 2), color.Palette{color.White})},
+		Delay:  []int{10, 10},
+		Config: image.Config{Width: 2, Height: 2},
+	}
+	ai := newAnimatedImage(g)
+	ai.protocol = Kitty
+
+	var buf bytes.Buffer
+	// in order, so ClearAllTo has Kitty images to clear
+	for _, tt := range []struct {
+		name  string
+		write func(w io.Writer) error
+		want  string
+	}{
+		{"PreloadTo", func(w io.Writer) error { _, err := ti.PreloadTo(w); return err }, ",a=t,"},
+		{"HidePlacementTo", func(w io.Writer) error { return ti.HidePlacementTo(w) }, "_Ga=d,d=i,"},
+		{"ShowPlacementTo", func(w io.Writer) error { return ti.ShowPlacementTo(w) }, "_Ga=p,"},
+		{"FlashTo", func(w io.Writer) error { return ti.FlashTo(w, time.Millisecond) }, ",a=T,"},
+		{"PlayAnimationTo", func(w io.Writer) error { return ai.PlayAnimationTo(w) }, "_Ga=a,"},
+		{"ClearAllTo", func(w io.Writer) error { return ClearAllTo(w) }, "_Ga=d,q=1"},
+	} {
+		buf.Reset()
+		var err error
+		if out := captureStdout(t, func() { err = tt.write(&buf) }); err != nil || out != "" {
+			t.Errorf("%s: error %v, wrote %q to stdout", tt.name, err, out)
+		}
+		if !strings.Contains(buf.String(), tt.want) {
+			t.Errorf("%s wrote %q, want it to contain %q", tt.name, buf.String(), tt.want)
+		}
+	}
+}
+
+func TestClearAllRendered(t *testing.T) {
+	clearAll := START + "_G" + ACTION_DELETE + "," + SUPPRESS_OK + "," + SUPPRESS_ERR + ESCAPE + CLOSE
+	captureStdout(t, func() { ClearAll() }) // forget the images printed by other tests
+	if out := captureStdout(t, func() { ClearAll() }); strings.Contains(out, clearAll) {
+		t.Errorf("expected no Kitty delete without Kitty images, got %q", out)
+	}
+
+	// images rendered for the caller to write are cleared too
+	img := testImage(4, 4)
+	if _, err := (&TermImg{protocol: Kitty, img: &img}).Render(); err != nil {
+		t.Fatal(err)
+	}
+	if out := captureStdout(t, func() { ClearAll() }); !strings.Contains(out, clearAll) {
+		t.Errorf("ClearAll() = %q after Render, want it to delete all Kitty images", out)
+	}
+}
+
+func TestClearImages(t *testing.T) {
+	out := captureStdout(t, func() {
+		if err := ClearImages(nil); err != nil {
+			t.Error(err)
+		}
+	})
+	if out != "" {
+		t.Errorf("clearing no images should write nothing, got %q", out)
+	}
+	ids := []uint32{7, 42, 1 << 31}
+	out = captureStdout(t, func() {
+		if err := ClearImages(ids); err != nil {
+			t.Error(err)
+		}
+	})
+	for _, id := range ids {
+		want := START + fmt.Sprintf("_Ga=d,d=I,i=%d,q=2", id) + ESCAPE + CLOSE
+		if !strings.Contains(out, want) {
+			t.Errorf("missing delete command %q", want)
+		}
+	}
+	if n := strings.Count(out, "_Ga=d"); n != len(ids) {
+		t.Errorf("expected %d delete commands, got %d", len(ids), n)
+	}
+}
+
+func TestScaleDecoded(t *testing.T) {
+	t.Setenv(BYPASS_DETECTION_ENV, "kitty")
+	path := filepath.Join(t.TempDir(), "large.jpg")
+	data, err := encodeJPEG(testImage(1200, 800))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	ti, err := OpenDownscaled(path, 120, 120)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ti.Close()
+	if b := (*ti.img).Bounds(); b.Dx() != 120 || b.Dy() != 80 {
+		t.Errorf("expected the image to be downscaled to 120x80, got %dx%d", b.Dx(), b.Dy())
+	}
+	// only the downscaled pixels are kept
+	if pix := (*ti.img).(*image.NRGBA).Pix; len(pix) != 120*80*4 || cap(pix) != 120*80*4 {
+		t.Errorf("expected a 120x80 pixel buffer, got %d bytes", cap(pix))
+	}
+	if len(ti.raw) != 0 {
+		t.Errorf("expected the full resolution encoded bytes to be dropped")
+	}
+	// the size limit still applies when the image is decoded again
+	ti.Release()
+	out, err := ti.Render()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ti.width != 120 || ti.height != 80 {
+		t.Errorf("expected a 120x80 render after Release, got %dx%d", ti.width, ti.height)
+	}
+	full, _ := (&TermImg{path: path, protocol: Kitty}).Render()
+	if len(out) >= len(full) {
+		t.Errorf("expected the scaled render (%d bytes) to be smaller than the full one (%d bytes)", len(out), len(full))
+	}
+
+	// images that already fit are left untouched
+	small := testImage(50, 40)
+	ti = &TermImg{img: &small, maxW: 120, maxH: 120}
+	ti.scaleDecoded()
+	if *ti.img != small {
+		t.Errorf("an image within the size limit should not be rescaled")
+	}
+}
+
+func TestResizeQuality(t *testing.T) {
+	img := noiseImage(200, 200)
+	scaled := make(map[ResizeQuality][]byte)
+	for _, q := range []ResizeQuality{ResizeFast, ResizeBalanced, ResizeHigh} {
+		ti := (&TermImg{img: &img, maxW: 30, maxH: 30}).ResizeQuality(q)
+		ti.scaleDecoded()
+		scaled[q] = (*ti.img).(*image.NRGBA).Pix
+	}
+	if bytes.Equal(scaled[ResizeFast], scaled[ResizeBalanced]) || bytes.Equal(scaled[ResizeBalanced], scaled[ResizeHigh]) || bytes.Equal(scaled[ResizeFast], scaled[ResizeHigh]) {
+		t.Errorf("expected each resize quality to use a different interpolation")
+	}
+
+	// images opened with OpenDownscaled are downscaled again with the new quality
+	path := filepath.Join(t.TempDir(), "noise.png")
+	data, err := encodePNG(img)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	ti := &TermImg{path: path, protocol: Kitty, maxW: 30, maxH: 30}
+	if err := ti.load(); err != nil {
+		t.Fatal(err)
+	}
+	ti.ResizeQuality(ResizeHigh)
+	if err := ti.load(); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal((*ti.img).(*image.NRGBA).Pix, scaled[ResizeHigh]) {
+		t.Errorf("expected the image to be downscaled again with the high quality interpolation")
+	}
+}
+
+func BenchmarkResizeQuality(b *testing.B) {
+	img := noiseImage(1024, 1024)
+	for _, q := range []ResizeQuality{ResizeFast, ResizeBalanced, ResizeHigh} {
+		b.Run(q.String(), func(b *testing.B) {
+			for range b.N {
+				ti := (&TermImg{img: &img, maxW: 256, maxH: 256}).ResizeQuality(q)
+				ti.scaleDecoded()
+			}
+		})
+	}
+}
+
+func TestCrop(t *testing.T) {
+	img := testImage(100, 60)
+	ti := (&TermImg{protocol: Kitty, img: &img}).Crop(image.Rect(10, 20, 50, 40))
+	if b := ti.processImage().Bounds(); b != image.Rect(10, 20, 50, 40) {
+		t.Errorf("expected the image to be cropped to the rectangle, got %v", b)
+	}
+	out, err := ti.Render()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out, "_Gs=40,v=20,") {
+		t.Errorf("expected a 40x20 image to be transmitted")
+	}
+
+	// the crop is applied before the image is downscaled
+	attempt, err := ti.budgetAttempt(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b := attempt.processImage().Bounds(); b.Dx() != 20 || b.Dy() != 10 {
+		t.Errorf("expected the cropped image to be downscaled to 20x10, got %dx%d", b.Dx(), b.Dy())
+	}
+
+	// rectangles beyond the image bounds are clamped
+	if b := ti.Crop(image.Rect(80, 50, 300, -20)).processImage().Bounds(); b != image.Rect(80, 0, 100, 50) {
+		t.Errorf("expected the crop to be clamped to the image, got %v", b)
+	}
+	if _, err := ti.Crop(image.Rect(200, 200, 300, 300)).Render(); err == nil {
+		t.Errorf("expected an error for a crop outside of the image")
+	}
+
+	if b := ti.CropCenter(40, 80).processImage().Bounds(); b != image.Rect(30, 0, 70, 60) {
+		t.Errorf("CropCenter(40, 80) = %v, want the centered 40 columns", b)
+	}
+	if b := ti.Crop(image.Rectangle{}).processImage().Bounds(); b != img.Bounds() {
+		t.Errorf("expected an empty rectangle to display the whole image, got %v", b)
+	}
+}
+
+func TestMonochrome(t *testing.T) {
+	img := testImage(32, 32)
+	fg := color.NRGBA{R: 0x20, G: 0x40, B: 0x20, A: 0xff}
+	bg := color.NRGBA{R: 0xe0, G: 0xf0, B: 0xd0, A: 0xff}
+	ti := (&TermImg{protocol: Kitty, img: &img}).Monochrome(16, fg, bg)
+	out := ti.processImage()
+	seen := map[color.NRGBA]bool{}
+	b := out.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			seen[color.NRGBAModel.Convert(out.At(x, y)).(color.NRGBA)] = true
+		}
+	}
+	if len(seen) != 2 || !seen[fg] || !seen[bg] {
+		t.Errorf("expected only the fg and bg colors, got %v", seen)
+	}
+
+	// nil colors leave the pixels transparent
+	out = (&TermImg{img: &img}).Monochrome(16, fg, nil).processImage()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			if c := color.NRGBAModel.Convert(out.At(x, y)).(color.NRGBA); c != fg && c.A != 0 {
+				t.Fatalf("unexpected color %v at %d,%d", c, x, y)
+			}
+		}
+	}
+
+	if ti.Monochrome(0, fg, bg).transformed() {
+		t.Errorf("a threshold of 0 should disable monochrome")
+	}
+}
+
+func TestTmuxPassthroughMode(t *testing.T) {
+	saved := tmuxCommand
+	defer func() { tmuxCommand = saved }()
+	var calls []string
+	options := map[string]string{"-pv": "", "-gv": "all"}
+	tmuxCommand = func(args ...string) ([]byte, error) {
+		calls = append(calls, strings.Join(args, " "))
+		if args[0] == "show" {
+			return []byte(options[args[1]] + "\n"), nil
+		}
+		return nil, nil
+	}
+
+	for _, mode := range []string{"on", "all"} {
+		calls = nil
+		if err := SetTmuxPassthroughMode(mode); err != nil {
+			t.Fatal(err)
+		}
+		if want := "set -p allow-passthrough " + mode; len(calls) != 1 || calls[0] != want {
+			t.Errorf("SetTmuxPassthroughMode(%q) ran %q, want %q", mode, calls, want)
+		}
+	}
+	if err := SetTmuxPassthroughMode("off"); err == nil {
+		t.Errorf("expected an error for an invalid mode")
+	}
+
+	if mode, err := TmuxPassthroughMode(); err != nil || mode != "all" {
+		t.Errorf("TmuxPassthroughMode() = %q, %v; want the global option %q", mode, err, "all")
+	}
+	// `all` is not downgraded to `on`
+	calls = nil
+	tmuxPassthrough()
+	if slices.ContainsFunc(calls, func(c string) bool { return strings.HasPrefix(c, "set") }) {
+		t.Errorf("tmuxPassthrough() should keep `all`, ran %q", calls)
+	}
+	options["-pv"] = "off"
+	calls = nil
+	tmuxPassthrough()
+	if !slices.Contains(calls, "set -p allow-passthrough on") {
+		t.Errorf("tmuxPassthrough() should enable passthrough, ran %q", calls)
+	}
+}
+
+func TestRenderBeside(t *testing.T) {
+	SetFontSizeDetectionOrder([]FontSizeMethod{Fallback})
+	defer SetFontSizeDetectionOrder(nil)
+
+	img := testImage(20, 40) // 3x3 cells with the 8x16 fallback font
+	out, err := (&TermImg{protocol: Kitty, img: &img}).RenderBeside("a short description of the image", 12)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(out, "\x1b[4C"); n != 3 {
+		t.Errorf("expected 3 lines offset by the 3 image columns and a gap, got %d", n)
+	}
+	for _, line := range []string{"a short", "description", "of the image"} {
+		if !strings.Contains(out, "\x1b[4C"+line+"\n") {
+			t.Errorf("missing text line %q", line)
+		}
+	}
+	if !strings.Contains(out, "\x1b[3A\r\x1b7"+START+"_G") || !strings.HasSuffix(out, "\x1b8\x1b[3B") {
+		t.Errorf("expected the image to be drawn at the start of the first row")
+	}
+
+	// an image taller than the text reserves all of its rows
+	out, _ = (&TermImg{protocol: ITerm2, img: &img}).FillCells(5, 6).RenderBeside("caption", 20)
+	if n := strings.Count(out, "\x1b[6C"); n != 6 {
+		t.Errorf("expected 6 rows for a 5x6 cell image, got %d", n)
+	}
+
+	if got := wrapText("abcdefgh ij\n\nk", 4); !slices.Equal(got, []string{"abcd", "efgh", "ij", "", "k"}) {
+		t.Errorf("wrapText() = %q", got)
+	}
+}
+
+func TestRenderWithinBudget(t *testing.T) {
+	saved := renderAttempt
+	defer func() { renderAttempt = saved }()
+	SetFontSizeDetectionOrder([]FontSizeMethod{Fallback})
+	defer SetFontSizeDetectionOrder(nil)
+
+	// an artificially slow encoder, only fast enough for small images
+	renderAttempt = func(ti *TermImg) (string, error) {
+		w := (*ti.img).Bounds().Dx()
+		if w > 16 {
+			time.Sleep(time.Second)
+		}
+		return fmt.Sprintf("%dpx in %dx%d cells", w, ti.fillCols, ti.fillRows), nil
+	}
+	img := testImage(64, 64)
+	ti := &TermImg{protocol: Kitty, img: &img}
+	start := time.Now()
+	out, err := ti.RenderWithinBudget(200 * time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 400*time.Millisecond {
+		t.Errorf("expected to return within the budget, took %s", elapsed)
+	}
+	if out != "16px in 8x4 cells" {
+		t.Errorf("expected a degraded render displayed in the same cells, got %q", out)
+	}
+
+	renderAttempt = func(ti *TermImg) (string, error) {
+		time.Sleep(time.Second)
+		return "", nil
+	}
+	if _, err := ti.RenderWithinBudget(50 * time.Millisecond); !errors.Is(err, ErrRenderBudget) {
+		t.Errorf("expected ErrRenderBudget, got %v", err)
+	}
+
+	renderAttempt = saved
+	out, err = ti.RenderWithinBudget(time.Minute)
+	if err != nil || !strings.Contains(out, "s=64,v=64") {
+		t.Errorf("expected a full quality render with a generous budget, got %v", err)
+	}
+
+	// the attempts keep all the options, and the image gets the Kitty ID they were given
+	progress := func(int, int) {}
+	ti = (&TermImg{protocol: Kitty, img: &img}).Wrap(true).OnProgress(progress).WithFallback(Blocks)
+	renderAttempt = func(sti *TermImg) (string, error) {
+		if !sti.wrap || sti.onProgress == nil || !slices.Equal(sti.fallbacks, ti.fallbacks) {
+			t.Errorf("budget attempt lost options: wrap=%v onProgress=%v fallbacks=%v", sti.wrap, sti.onProgress != nil, sti.fallbacks)
+		}
+		return fmt.Sprintf("i=%d", sti.kittyImageID()), nil
+	}
+	out, err = ti.RenderWithinBudget(time.Minute)
+	if err != nil || ti.kittyID == 0 || out != fmt.Sprintf("i=%d", ti.kittyID) {
+		t.Errorf("RenderWithinBudget() = %q, %v; want the image to get ID %d", out, err, ti.kittyID)
+	}
+}
+
+func TestAnimatedImage(t *testing.T) {
+	pal := color.Palette{color.Transparent, color.NRGBA{R: 255, A: 255}, color.NRGBA{B: 255, A: 255}}
+	frame := func(r image.Rectangle, idx uint8) *image.Paletted {
+		p := image.NewPaletted(r, pal)
+		for i := range p.Pix {
+			p.Pix[i] = idx
+		}
+		return p
+	}
+	g := &gif.GIF{
+		Image: []*image.Paletted{
+			frame(image.Rect(0, 0, 8, 8), 1),
+			frame(image.Rect(0, 0, 4, 4), 2),
+			frame(image.Rect(4, 4, 8, 8), 2),
+		},
+		Delay:    []int{0, 20, 30},
+		Disposal: []byte{gif.DisposalNone, gif.DisposalBackground, gif.DisposalNone},
+		Config:   image.Config{Width: 8, Height: 8},
+	}
+	ai := newAnimatedImage(g)
+	ai.protocol = Kitty
+	if ai.Frames() != 3 {
+		t.Fatalf("expected 3 frames, got %d", ai.Frames())
+	}
+	// frames are composited over the previous ones, disposing of the background when asked to
+	last := ai.frames[2]
+	if c := color.NRGBAModel.Convert(last.At(1, 1)); c != (color.NRGBA{}) {
+		t.Errorf("expected the disposed area to be transparent, got %v", c)
+	}
+	if c := color.NRGBAModel.Convert(last.At(6, 1)); c != pal[1] {
+		t.Errorf("expected the first frame to show through, got %v", c)
+	}
+
+	out, err := ai.renderAnimation()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(out, "_Ga=f,"); n != 2 {
+		t.Errorf("expected 2 additional frames, got %d", n)
+	}
+	for _, want := range []string{",z=200;", ",z=300;", "_Ga=a,i=" + strconv.Itoa(int(ai.kittyID)) + ",r=1,z=100,", ",s=3,v=1,"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("missing %q in the animation", want)
+		}
+	}
+	if _, err := ai.Loops(-1).renderAnimation(); err != nil || ai.kittyLoops() != 2 {
+		t.Errorf("a loop count of -1 should play the animation once")
+	}
+	if (*ai.img).Bounds().Dx() != 8 {
+		t.Errorf("expected the first frame to be kept as the image")
+	}
+
+	t.Setenv(BYPASS_DETECTION_ENV, "kitty")
+	var buf bytes.Buffer
+	if err := gif.EncodeAll(&buf, g); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "anim.gif")
+	if err := os.WriteFile(path, buf.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	ti, err := OpenLazy(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	anim, err := ti.Layer(2).Animate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if anim.Frames() != 3 || anim.layer != 2 || anim.format != "gif" {
+		t.Errorf("expected Animate to decode all frames and keep the options, got %d frames, layer %d", anim.Frames(), anim.layer)
+	}
+	// the setters return the animation, so they can be chained with Loops
+	if anim.FillCells(4, 4).PixelOffset(1, 1).Loops(0) != anim || anim.fillCols != 4 || anim.offsetX != 1 {
+		t.Errorf("expected the chained setters to apply to the animation")
+	}
+	img := testImage(4, 4)
+	if _, err := (&TermImg{protocol: Kitty, img: &img}).Animate(); err == nil {
+		t.Errorf("expected Animate to fail for an image not opened from a file")
+	}
+}
+
+func TestPrintTo(t *testing.T) {
+	img := testImage(8, 8)
+	var buf bytes.Buffer
+	out := captureStdout(t, func() {
+		ti := &TermImg{protocol: Kitty, img: &img}
+		if err := ti.PrintTo(&buf); err != nil {
+			t.Fatal(err)
+		}
+		want, _ := ti.Render()
+		if buf.String() != want+"\n" {
+			t.Errorf("PrintTo() wrote %q, want %q", buf.String(), want+"\n")
+		}
+		buf.Reset()
+		if err := ti.ClearTo(&buf); err != nil || !strings.Contains(buf.String(), "_Ga=d") {
+			t.Errorf("ClearTo() wrote %q, err = %v", buf.String(), err)
+		}
+		buf.Reset()
+		if err := ClearImagesTo(&buf, []uint32{1, 2}); err != nil || strings.Count(buf.String(), "_Ga=d") != 2 {
+			t.Errorf("ClearImagesTo() wrote %q, err = %v", buf.String(), err)
+		}
+		buf.Reset()
+		if err := PlaceByIDTo(&buf, 9, 0, 0); err != nil || !strings.Contains(buf.String(), "_Ga=p,i=9,") {
+			t.Errorf("PlaceByIDTo() wrote %q, err = %v", buf.String(), err)
+		}
+	})
+	if out != "" {
+		t.Errorf("nothing should be written to stdout, got %q", out)
+	}
+}
+
+// gopher-doc.1bpp.lossless.webp from golang.org/x/image/testdata
+const testWebP = "UklGRrIBAABXRUJQVlA4TKUBAAAvSsAYAA8w//M///MfeJAkbXvaSG7m8Q3GfYSBJekwQztm/IcZlgwnmWImn2BK7aFmBtnVir6q//8VOkFE/xm4baTIu8c48ArEo6+B3zFKYln3pqClSCKX0begFTAXFOLXHSyF8cCNcZEG4OywuA4KVVfJCiArU7GAgJI8+lJP/OKMT/fBAjevg1cYB7YVkFuWga2lyPi5I0HFy5YTpWIHg0RZpkniRVW9odHAKOwosWuOGdxIyn2OvaCDvhg/we6TwadPBPbqBV58MsLmMJ8yZnOWk8SRz4N+QoyPL+MnamzMvcE1rHNEr91F9GKZPVUcS9w7PhhH36suB9qPeYb/oLk6cuTiJ0wOK3m5h1cKjW6EVZCYMK7dxcKCBdgP9HkKr9gkAO2P8GKZGWVdIAatQa+1IDpt6qyorVwdy01xdW8Jkfk6xjEXmVQQ+HQdFr6OKhIN34dXWq0+0qr6EJSCeeVLH9+gvGTLyqM65PQ44ihzlTXxQKjKbAvshXgir7Lil9w4L2bvMycmjQcqXaMCO6BlY28i+FOLzbfI1vEqxAhotocAAA=="
+
+func TestDecodeWebP(t *testing.T) {
+	data, err := base64.StdEncoding.DecodeString(testWebP)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, format, raw, err := decodeImage(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if format != "webp" || img.Bounds().Empty() || raw != nil {
+		t.Errorf("decodeImage() = %s %v, want a non-empty webp image", format, img.Bounds())
+	}
+
+	_, _, _, err = decodeImage(strings.NewReader("BM6\x00\x00\x00not an image"))
+	if err == nil || !strings.Contains(err.Error(), "unknown image format") || !strings.Contains(err.Error(), "BM6") {
+		t.Errorf("expected an unknown format error naming the header, got %v", err)
+	}
+}
+
+func TestKittyChunkSize(t *testing.T) {
+	img := noiseImage(64, 64) // doesn't compress below a few chunks
+	data, err := encodePNG(img)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, size := range []int{0, 1000, 1001, 4096} {
+		ti := (&TermImg{protocol: Kitty, img: &img}).KittyChunkSize(size)
+		out, err := ti.Render()
+		if err != nil {
+			t.Fatal(err)
+		}
+		chunkSize := ti.kittyChunkSize()
+		if chunkSize%3 != 0 || (size == 0 && chunkSize != KITTY_CHUNK_SIZE) {
+			t.Errorf("KittyChunkSize(%d) = %d", size, chunkSize)
+		}
+		if n, want := strings.Count(out, "m=1;"), ceilDiv(len(data), chunkSize)-1; n != want {
+			t.Errorf("KittyChunkSize(%d): expected %d continuation chunks, got %d", size, want, n)
+		}
+		if !strings.Contains(out, "_Gm=0;") {
+			t.Errorf("KittyChunkSize(%d): missing the final chunk", size)
+		}
+		// reassemble the payload
+		var payload strings.Builder
+		for _, seq := range strings.Split(out, ESCAPE+CLOSE) {
+			if i := strings.IndexByte(seq, ';'); i >= 0 {
+				payload.WriteString(seq[i+1:])
+			}
+		}
+		if got, _ := base64.StdEncoding.DecodeString(payload.String()); !bytes.Equal(got, data) {
+			t.Errorf("KittyChunkSize(%d): reassembled payload doesn't match the image", size)
+		}
+	}
+}
+
+func TestClearKittyImage(t *testing.T) {
+	img := testImage(8, 8)
+	ti := &TermImg{protocol: Kitty, img: &img}
+	var id uint32
+	out := captureStdout(t, func() {
+		if err := ti.Print(); err != nil {
+			t.Fatal(err)
+		}
+		id = ti.kittyID
+		if err := ti.Clear(); err != nil {
+			t.Fatal(err)
+		}
+	})
+	if want := fmt.Sprintf("_Ga=d,d=i,i=%d,", id); id == 0 || !strings.Contains(out, want) {
+		t.Errorf("expected Clear() to delete the printed image with %q", want)
+	}
+	if strings.Contains(out, "_Ga=d,q=1") {
+		t.Errorf("expected Clear() not to delete all images")
+	}
+
+	// images that were never printed fall back to clearing all images
+	out = captureStdout(t, func() { (&TermImg{protocol: Kitty, img: &img}).Clear() })
+	if !strings.Contains(out, "_Ga=d,q=1,q=2") {
+		t.Errorf("expected Clear() to delete all images, got %q", out)
+	}
+}
+
+func TestPlaceByIDWithSize(t *testing.T) {
+	var buf bytes.Buffer
+	if err := PlaceByIDWithSizeTo(&buf, 7, 2, 1, -1, 10, 5); err != nil {
+		t.Fatal(err)
+	}
+	want := "\x1b7" + cursorTo(2, 1) + START + "_Ga=p,i=7,c=10,r=5,z=-1,q=2" + ESCAPE + CLOSE + "\x1b8"
+	if buf.String() != want {
+		t.Errorf("PlaceByIDWithSizeTo() = %q, want %q", buf.String(), want)
+	}
+	buf.Reset()
+	if err := PlaceByIDWithSizeTo(&buf, 7, 0, 0, 0, 0, 3); err != nil {
+		t.Fatal(err)
+	}
+	if got := buf.String(); !strings.Contains(got, "_Ga=p,i=7,r=3,q=2"+ESCAPE) {
+		t.Errorf("PlaceByIDWithSizeTo() with only rows = %q", got)
+	}
+	if err := PlaceByIDWithSizeTo(&buf, 7, 0, 0, 0, -1, 0); err == nil {
+		t.Errorf("expected an error for a negative size")
+	}
+
+	img := testImage(8, 8)
+	ti := &TermImg{protocol: Kitty, img: &img}
+	out, err := ti.Render()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id := ti.KittyID(); !strings.Contains(out, fmt.Sprintf(",i=%d;", id)) {
+		t.Errorf("KittyID() = %d, not the ID the image was rendered with", id)
+	}
+}
+
+func TestPlaceRelative(t *testing.T) {
+	var buf bytes.Buffer
+	if err := PlaceRelativeTo(&buf, 12, 3, -2, 4, 0, 5); err != nil {
+		t.Fatal(err)
+	}
+	want := "\x1b7\x1b[3C\x1b[2A" + START + "_Ga=p,i=12,X=4,z=5,C=1,q=2" + ESCAPE + CLOSE + "\x1b8"
+	if buf.String() != want {
+		t.Errorf("PlaceRelativeTo() = %q, want %q", buf.String(), want)
+	}
+	if err := PlaceRelativeTo(&buf, 12, 0, 0, -1, 0, 0); err == nil {
+		t.Errorf("expected an error for a negative pixel offset")
+	}
+	if got := cursorMove(-1, 2); got != "\x1b[1D\x1b[2B" {
+		t.Errorf("cursorMove(-1, 2) = %q", got)
+	}
+}
+
+func TestKittyQuiet(t *testing.T) {
+	img := testImage(8, 8)
+	for _, tt := range []struct {
+		quiet int
+		want  string
+	}{
+		{0, ",t=d,i="},
+		{1, ",t=d,q=1,i="},
+		{2, ",t=d,q=2,i="},
+	} {
+		out, err := (&TermImg{protocol: Kitty, img: &img}).KittyQuiet(tt.quiet).Render()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(out, tt.want) {
+			t.Errorf("KittyQuiet(%d) = %q, want it to contain %q", tt.quiet, out[:min(len(out), 64)], tt.want)
+		}
+	}
+	if out, _ := (&TermImg{protocol: Kitty, img: &img}).Render(); !strings.Contains(out, ",t=d,q=1,q=2,i=") {
+		t.Errorf("expected all responses to be suppressed by default")
+	}
+
+	saved := queryTerminal
+	defer func() { queryTerminal = saved }()
+	ti := (&TermImg{protocol: Kitty, img: &img}).KittyQuiet(0)
+	queryTerminal = func(_ context.Context, query string) ([]byte, error) {
+		return []byte(fmt.Sprintf("\x1b_Gi=%d;ENOSPC:out of storage\x1b\\", ti.kittyImageID())), nil
+	}
+	var resp *KittyResponse
+	captureStdout(t, func() {
+		var err error
+		if resp, err = ti.PrintWithResponse(); err != nil {
+			t.Fatal(err)
+		}
+	})
+	if resp.Message != "ENOSPC:out of storage" || resp.ID != strconv.Itoa(int(ti.kittyID)) {
+		t.Errorf("PrintWithResponse() = %+v", resp)
+	}
+}
+
+func TestEncodedBytes(t *testing.T) {
+	img := testImage(16, 16)
+	data, mime, err := (&TermImg{protocol: ITerm2, img: &img}).EncodedBytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mime != "image/jpeg" || !bytes.HasPrefix(data, []byte{0xff, 0xd8}) {
+		t.Errorf("EncodedBytes() for iTerm2 = %s %x..., want JPEG data", mime, data[:2])
+	}
+	ti := &TermImg{protocol: Kitty, img: &img}
+	data, mime, err = ti.EncodedBytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mime != "image/png" || !bytes.HasPrefix(data, []byte("\x89PNG")) || ti.size != len(data) {
+		t.Errorf("EncodedBytes() for Kitty = %s (%d bytes), want PNG data", mime, len(data))
+	}
+	out, _ := ti.Render()
+	if !strings.Contains(out, base64.StdEncoding.EncodeToString(data)) {
+		t.Errorf("expected the encoded bytes to be the transmitted payload")
+	}
+}
+
+func TestBackground(t *testing.T) {
+	src := image.NewNRGBA(image.Rect(0, 0, 4, 4))
+	draw.Draw(src, src.Bounds(), image.NewUniform(color.NRGBA{R: 255, A: 128}), image.Point{}, draw.Src)
+	var img image.Image = src
+
+	white := color.NRGBA{R: 255, G: 255, B: 255, A: 255}
+	out := (&TermImg{protocol: Kitty, img: &img}).Background(white).processImage()
+	c := color.NRGBAModel.Convert(out.At(1, 1)).(color.NRGBA)
+	if c.A != 255 || c.R != 255 || c.G < 120 || c.G > 135 || c.G != c.B {
+		t.Errorf("expected red at 50%% alpha to blend toward white, got %v", c)
+	}
+
+	preview, err := (&TermImg{protocol: Kitty, img: &img}).Background(white).Preview(1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blended := fmt.Sprintf("\x1b[48;2;255;%d;%dm", c.G, c.B)
+	if !strings.HasPrefix(preview, blended) {
+		t.Errorf("Preview() = %q, want the blended color %q", preview, blended)
+	}
+	if plain, _ := (&TermImg{protocol: Kitty, img: &img}).Preview(1, 1); plain == preview {
+		t.Errorf("expected the default to differ from a white background")
+	}
+}
+
+func TestFontSizeOverride(t *testing.T) {
+	saved := fontSizeMethods
+	defer func() { fontSizeMethods = saved }()
+	queries := 0
+	fontSizeMethods = map[FontSizeMethod]func() (int, int, error){
+		Fallback: func() (int, int, error) { queries++; return 7, 14, nil },
+	}
+	SetFontSizeDetectionOrder([]FontSizeMethod{Fallback})
+	defer SetFontSizeDetectionOrder(nil)
+
+	img := testImage(40, 40)
+	ti := (&TermImg{protocol: Kitty, img: &img}).FontSize(10, 20)
+	out, err := ti.RenderBeside("text", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out, "\x1b[5C") || queries != 0 {
+		t.Errorf("expected the 10x20 override to be used without queries (%d queries)", queries)
+	}
+
+	SetDefaultFontSize(9, 18)
+	if w, h, err := GetTerminalFontSize(); err != nil || w != 9 || h != 18 || queries != 0 {
+		t.Errorf("GetTerminalFontSize() = %d, %d, %v with %d queries, want the 9x18 default", w, h, err, queries)
+	}
+	if w, h, _ := ti.fontSize(); w != 10 || h != 20 {
+		t.Errorf("expected the image override to take precedence, got %dx%d", w, h)
+	}
+	SetDefaultFontSize(0, 0)
+	if w, h, _ := GetTerminalFontSize(); w != 7 || h != 14 || queries != 1 {
+		t.Errorf("expected detection to be restored, got %dx%d with %d queries", w, h, queries)
+	}
+}
+
+func TestWithFallback(t *testing.T) {
+	saved := protocolAvailable
+	defer func() { protocolAvailable = saved }()
+	available := map[Protocol]bool{Blocks: true}
+	protocolAvailable = func(p Protocol) bool { return available[p] }
+	SetDefaultFontSize(8, 16)
+	defer SetDefaultFontSize(0, 0)
+
+	img := testImage(32, 32)
+	ti := (&TermImg{protocol: Kitty, img: &img}).WithFallback(ITerm2)
+	out, err := ti.Render()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ti.ResolvedProtocol() != Blocks {
+		t.Errorf("ResolvedProtocol() = %s, want %s", ti.ResolvedProtocol(), Blocks)
+	}
+	if rows := strings.Count(out, "\x1b[0m\n"); rows != 2 || strings.Count(out, " ") != 8 {
+		t.Errorf("expected a 4x2 cell text rendering, got %q", out)
+	}
+
+	available[ITerm2] = true
+	ti = (&TermImg{protocol: Kitty, img: &img}).WithFallback(ITerm2)
+	if out, _ := ti.Render(); ti.ResolvedProtocol() != ITerm2 || !strings.Contains(out, "]1337;File=") {
+		t.Errorf("expected the iTerm2 fallback, got %s", ti.ResolvedProtocol())
+	}
+
+	// without fallbacks the protocol is used as is
+	ti = &TermImg{protocol: Kitty, img: &img}
+	if ti.Render(); ti.ResolvedProtocol() != Kitty {
+		t.Errorf("ResolvedProtocol() = %s, want %s", ti.ResolvedProtocol(), Kitty)
+	}
+}
+
+func TestBypassDetection(t *testing.T) {
+	saved := queryTerminal
+	defer func() { queryTerminal = saved }()
+	queryTerminal = func(_ context.Context, query string) ([]byte, error) {
+		t.Errorf("unexpected terminal query %q", query)
+		return nil, ErrEmptyResponse
+	}
+	t.Setenv("TERM_PROGRAM", "")
+	t.Setenv("KITTY_WINDOW_ID", "")
+
+	for _, tt := range []struct {
+		value string
+		want  Protocol
+	}{
+		{"kitty", Kitty},
+		{"iterm2", ITerm2},
+		{"halfblocks", Blocks},
+		{"Blocks", Blocks},
+	} {
+		t.Setenv(BYPASS_DETECTION_ENV, tt.value)
+		if got := DetectProtocol(); got != tt.want {
+			t.Errorf("DetectProtocol() with %s=%s = %s, want %s", BYPASS_DETECTION_ENV, tt.value, got, tt.want)
+		}
+	}
+
+	// a forced protocol also drives the fallback chain, which lands on Blocks
+	t.Setenv(BYPASS_DETECTION_ENV, "halfblocks")
+	SetDefaultFontSize(8, 16)
+	defer SetDefaultFontSize(0, 0)
+	img := testImage(16, 16)
+	ti := (&TermImg{protocol: Kitty, img: &img}).WithFallback(ITerm2)
+	if _, err := ti.Render(); err != nil || ti.ResolvedProtocol() != Blocks {
+		t.Errorf("ResolvedProtocol() = %s, %v; want %s", ti.ResolvedProtocol(), err, Blocks)
+	}
+}
+
+func TestDetectProtocolContext(t *testing.T) {
+	saved := queryTerminal
+	defer func() { queryTerminal = saved }()
+	queryTerminal = func(_ context.Context, query string) ([]byte, error) {
+		t.Errorf("unexpected terminal query %q", query)
+		return nil, ErrEmptyResponse
+	}
+	t.Setenv(BYPASS_DETECTION_ENV, "")
+	t.Setenv("TERM", "xterm-256color")
+	t.Setenv("TERM_PROGRAM", "")
+	t.Setenv("KITTY_WINDOW_ID", "1")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	start := time.Now()
+	if got := DetectProtocolContext(ctx); got != Kitty {
+		t.Errorf("DetectProtocolContext() = %s, want %s from KITTY_WINDOW_ID", got, Kitty)
+	}
+	if elapsed := time.Since(start); elapsed > 50*time.Millisecond {
+		t.Errorf("expected an expired context to return promptly, took %s", elapsed)
+	}
+
+	t.Setenv("KITTY_WINDOW_ID", "")
+	if got := DetectProtocolContext(ctx); got != Unsupported {
+		t.Errorf("DetectProtocolContext() = %s without hints, want %s", got, Unsupported)
+	}
+
+	// canceling the context ends the query in progress, and no other query is sent
+	ClearDetectionCache()
+	defer ClearDetectionCache()
+	ctx, cancel = context.WithCancel(context.Background())
+	var canceled atomic.Bool
+	queries := 0
+	queryTerminal = func(ctx context.Context, query string) ([]byte, error) {
+		if canceled.Load() {
+			t.Errorf("query %q sent after the context was canceled", query)
+		}
+		queries++
+		<-ctx.Done() // the terminal doesn't answer
+		return nil, ctx.Err()
+	}
+	time.AfterFunc(20*time.Millisecond, func() {
+		canceled.Store(true)
+		cancel()
+	})
+	start = time.Now()
+	if got := DetectProtocolContext(ctx); got != Unsupported || queries != 1 {
+		t.Errorf("DetectProtocolContext() = %s after %d queries, want %s after 1", got, queries, Unsupported)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("expected a canceled detection to return promptly, took %s", elapsed)
+	}
+	// the canceled query isn't cached as the terminal's answer
+	if terminalName != nil {
+		t.Errorf("expected the canceled XTVERSION query not to be cached")
+	}
+}
+
+func TestKittyImageID(t *testing.T) {
+	img := testImage(8, 8)
+	for range 2 {
+		ti := (&TermImg{protocol: Kitty, img: &img}).KittyImageID(4242)
+		out, err := ti.Render()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(out, ",i=4242;") || ti.kittyID != 4242 {
+			t.Errorf("expected the forced image ID, got %q", out[:min(len(out), 64)])
+		}
+	}
+
+	saved := globalKittyImageID.Load()
+	defer globalKittyImageID.Store(saved)
+	ResetKittyImageIDs()
+	a, b := &TermImg{protocol: Kitty, img: &img}, &TermImg{protocol: Kitty, img: &img}
+	if a.kittyImageID() != 1 || b.kittyImageID() != 2 {
+		t.Errorf("expected IDs to restart from 1, got %d and %d", a.kittyID, b.kittyID)
+	}
+	if id := a.KittyImageID(0).kittyImageID(); id != 3 {
+		t.Errorf("expected KittyImageID(0) to restore automatic IDs, got %d", id)
+	}
+}
+
+func TestStraightAlpha(t *testing.T) {
+	// a constant color with an alpha gradient
+	want := color.NRGBA{R: 255, G: 64, A: 255}
+	src := image.NewNRGBA(image.Rect(0, 0, 64, 8))
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 64; x++ {
+			src.SetNRGBA(x, y, color.NRGBA{R: want.R, G: want.G, A: uint8(x * 4)})
+		}
+	}
+	var img image.Image = src
+
+	// scaling interpolates premultiplied colors, translucent edges keep their color
+	scaled := &TermImg{img: &img, maxW: 16, maxH: 16}
+	scaled.scaleDecoded()
+	for x := 0; x < 16; x++ {
+		if c := color.NRGBAModel.Convert((*scaled.img).At(x, 1)).(color.NRGBA); c.R != want.R || c.G != want.G {
+			t.Errorf("scaled pixel %d = %v, want the straight color %v", x, c, want)
+		}
+	}
+
+	// two level alpha outputs make translucent pixels either transparent or their straight color
+	for _, ti := range []*TermImg{
+		(&TermImg{img: &img}).DitherColors(4),
+		(&TermImg{img: &img}).DitherColors(4).DitherMode(DitherAtkinson),
+		(&TermImg{img: &img}).DitherColors(4).DitherMode(DitherOrdered),
+		(&TermImg{img: &img}).Monochrome(255, want, nil),
+	} {
+		out := ti.processImage()
+		for x := 0; x < 64; x++ {
+			c := color.NRGBAModel.Convert(out.At(x, 4)).(color.NRGBA)
+			if x*4 < 128 && c.A != 0 {
+				t.Errorf("pixel %d with alpha %d = %v, want transparent", x, x*4, c)
+			} else if x*4 >= 128 && c != want {
+				t.Errorf("pixel %d with alpha %d = %v, want %v", x, x*4, c, want)
+			}
+		}
+	}
+}
+
+func TestRenderReusesOutput(t *testing.T) {
+	SetDefaultFontSize(8, 16)
+	defer SetDefaultFontSize(0, 0)
+	img := testImage(16, 16)
+	mutations := map[string]func(*TermImg){
+		"Invert":         func(ti *TermImg) { ti.Invert(true) },
+		"AutoInvert":     func(ti *TermImg) { ti.AutoInvert(true) },
+		"Layer":          func(ti *TermImg) { ti.Layer(2) },
+		"PixelOffset":    func(ti *TermImg) { ti.PixelOffset(1, 1) },
+		"Label":          func(ti *TermImg) { ti.Label("x", LabelTopLeft) },
+		"ITerm2Chunk":    func(ti *TermImg) { ti.ITerm2ChunkSize(100) },
+		"MaxLineLength":  func(ti *TermImg) { ti.MaxLineLength(100) },
+		"DitherColors":   func(ti *TermImg) { ti.DitherColors(4) },
+		"DitherMode":     func(ti *TermImg) { ti.DitherMode(DitherOrdered) },
+		"DitherStrength": func(ti *TermImg) { ti.DitherStrength(0.5) },
+		"ColorDepth":     func(ti *TermImg) { ti.ColorDepth(Depth256) },
+		"FillCells":      func(ti *TermImg) { ti.FillCells(2, 2) },
+		"OnOverflow":     func(ti *TermImg) { ti.OnOverflow(OverflowClip) },
+		"Wrap":           func(ti *TermImg) { ti.Wrap(true) },
+		"Monochrome":     func(ti *TermImg) { ti.Monochrome(100, nil, nil) },
+		"Background":     func(ti *TermImg) { ti.Background(color.White) },
+		"CacheKey":       func(ti *TermImg) { ti.CacheKey("k") },
+		"KittyChunkSize": func(ti *TermImg) { ti.KittyChunkSize(300) },
+		"KittyQuiet":     func(ti *TermImg) { ti.KittyQuiet(0) },
+		"KittyImageID":   func(ti *TermImg) { ti.KittyImageID(7) },
+		"KittyNoMove":    func(ti *TermImg) { ti.KittyDoNotMoveCursor(true) },
+		"FontSize":       func(ti *TermImg) { ti.FontSize(10, 20) },
+		"WithFallback":   func(ti *TermImg) { ti.WithFallback(Kitty) },
+	}
+	for _, protocol := range []Protocol{ITerm2, Kitty, Blocks} {
+		for name, mutate := range mutations {
+			ti := &TermImg{protocol: protocol, img: &img}
+			first, err := ti.Render()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if second, _ := ti.Render(); second != first || ti.encoded != first {
+				t.Fatalf("%s: expected the second render to reuse the first", protocol)
+			}
+			mutate(ti)
+			if ti.encoded != "" {
+				t.Errorf("%s: %s should invalidate the rendered output", protocol, name)
+			}
+		}
+	}
+}
+
+// writeRecorder records the largest write it receives
+type writeRecorder struct {
+	bytes.Buffer
+	largest int
+}
+
+func (w *writeRecorder) Write(p []byte) (int, error) {
+	w.largest = max(w.largest, len(p))
+	return w.Buffer.Write(p)
+}
+
+func TestPrintStreaming(t *testing.T) {
+	img := noiseImage(512, 512)
+	ti := &TermImg{protocol: Kitty, img: &img}
+	var w writeRecorder
+	if err := ti.PrintStreaming(&w); err != nil {
+		t.Fatal(err)
+	}
+	if limit := 2 * KITTY_CHUNK_SIZE; w.largest > limit {
+		t.Errorf("largest write is %d bytes, want at most about a chunk (%d)", w.largest, limit)
+	}
+	out := w.String()
+	if n := strings.Count(out, "m=1;"); n < 100 {
+		t.Errorf("expected many chunks, got %d", n)
+	}
+	if rendered, _ := (&TermImg{protocol: Kitty, img: &img, kittyID: ti.kittyID}).Render(); out != rendered+"\n" {
+		t.Errorf("expected the same chunks as Render")
+	}
+
+	var payload strings.Builder
+	for _, seq := range strings.Split(out, ESCAPE+CLOSE) {
+		if i := strings.IndexByte(seq, ';'); i >= 0 {
+			payload.WriteString(seq[i+1:])
+		}
+	}
+	data, err := base64.StdEncoding.DecodeString(payload.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := image.NewNRGBA(decoded.Bounds())
+	draw.Draw(got, got.Bounds(), decoded, image.Point{}, draw.Src)
+	if !bytes.Equal(got.Pix, img.(*image.NRGBA).Pix) {
+		t.Errorf("the reassembled transfer doesn't decode to the original pixels")
+	}
+}
+
+func TestPreserveCursor(t *testing.T) {
+	img := testImage(8, 8)
+	for _, protocol := range []Protocol{ITerm2, Kitty, Blocks} {
+		ti := &TermImg{protocol: protocol, img: &img}
+		plain, err := ti.Render()
+		if err != nil {
+			t.Fatal(err)
+		}
+		out, err := ti.PreserveCursor(true).Render()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if out != "\x1b7"+plain+"\x1b8" {
+			t.Errorf("%s: expected the output to be bracketed by a cursor save and restore", protocol)
+		}
+		var buf bytes.Buffer
+		if err := ti.PrintTo(&buf); err != nil {
+			t.Fatal(err)
+		}
+		if s := buf.String(); !strings.HasPrefix(s, "\x1b7") || !strings.HasSuffix(s, "\x1b8") || strings.Count(s, "\x1b7") != 1 {
+			t.Errorf("%s: expected the printed image to be bracketed by a single cursor save and restore", protocol)
+		}
+	}
+}
+
+func TestRenderWithSize(t *testing.T) {
+	savedSize := terminalSize
+	defer func() {
+		terminalSize = savedSize
+		SetFontSizeDetectionOrder(nil)
+	}()
+	terminalSize = func() (int, int, error) { return 80, 4, nil }
+	SetFontSizeDetectionOrder([]FontSizeMethod{Fallback})
+
+	img := testImage(20, 40) // 3x3 cells with the 8x16 fallback font
+	tall := testImage(10, 100)
+	wide := testImage(1000, 20)
+	tests := []struct {
+		name       string
+		ti         *TermImg
+		cols, rows int
+		want       string
+	}{
+		{"Kitty/Fill", (&TermImg{protocol: Kitty, img: &img}).FillCells(5, 3), 5, 3, "c=5,r=3"},
+		{"Kitty/Downscale", (&TermImg{protocol: Kitty, img: &tall}).OnOverflow(OverflowDownscale), 1, 4, ",r=4;"},
+		{"Kitty/Wrap", (&TermImg{protocol: Kitty, img: &wide}).Wrap(true), 80, 4, "_Gs=640,v=20,"},
+		{"iTerm2", &TermImg{protocol: ITerm2, img: &img}, 3, 3, "width=20px;height=40px"},
+		{"iTerm2/Fill", (&TermImg{protocol: ITerm2, img: &img}).FillCells(6, 2), 6, 2, "width=6;height=2;"},
+		{"Blocks", &TermImg{protocol: Blocks, img: &img}, 3, 3, "m \x1b[0m\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, cols, rows, err := tt.ti.RenderWithSize()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cols != tt.cols || rows != tt.rows {
+				t.Errorf("RenderWithSize() = %dx%d cells, want %dx%d", cols, rows, tt.cols, tt.rows)
+			}
+			if !strings.Contains(out, tt.want) {
+				t.Errorf("output missing %q", tt.want)
+			}
+			if tt.ti.protocol == Blocks {
+				lines := strings.Split(strings.TrimSuffix(out, "\n"), "\n")
+				if len(lines) != rows || strings.Count(lines[0], " ") != cols {
+					t.Errorf("expected %dx%d blocks, got %d lines", cols, rows, len(lines))
+				}
+			}
+		})
+	}
+}
+
+func TestDetectKittyFeatures(t *testing.T) {
+	saved := queryTerminal
+	defer func() {
+		queryTerminal = saved
+		ClearDetectionCache()
+	}()
+
+	tests := []struct {
+		name      string
+		responses map[string]string
+		want      KittyFeatures
+	}{
+		{
+			name: "Kitty",
+			responses: map[string]string{
+				"\x1b[>0q": "\x1bP>|kitty(0.35.2)\x1b\\",
+				"i=44,":    "\x1b_Gi=44;OK\x1b\\",
+				"i=45,":    "\x1b_Gi=45;OK\x1b\\",
+			},
+			want: KittyFeatures{SupportsAnimation: true, SupportsCompression: true, SupportsUnicodePlacement: true, SupportsFileTransfer: true},
+		},
+		{
+			name: "old Kitty over SSH",
+			responses: map[string]string{
+				"\x1b[>0q": "\x1bP>|kitty(0.19.3)\x1b\\",
+				"i=44,":    "\x1b_Gi=44;OK\x1b\\",
+				"i=45,":    "\x1b_Gi=45;EBADF:Failed to open file for graphics transmission\x1b\\",
+			},
+			want: KittyFeatures{SupportsCompression: true},
+		},
+		{
+			name: "clone without compression",
+			responses: map[string]string{
+				"\x1b[>0q": "\x1bP>|ghostty 1.1.0\x1b\\",
+				"i=44,":    "\x1b_Gi=44;EINVAL:unsupported compression\x1b\\",
+				"i=45,":    "\x1b_Gi=45;OK\x1b\\",
+			},
+			want: KittyFeatures{SupportsUnicodePlacement: true, SupportsFileTransfer: true},
+		},
+		{
+			name:      "no response",
+			responses: map[string]string{},
+			want:      KittyFeatures{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ClearDetectionCache()
+			queryTerminal = func(_ context.Context, query string) ([]byte, error) {
+				for key, resp := range tt.responses {
+					if strings.Contains(query, key) {
+						return []byte(resp), nil
+					}
+				}
+				return nil, ErrEmptyResponse
+			}
+			if got := DetectKittyFeatures(); got != tt.want {
+				t.Errorf("DetectKittyFeatures() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFlash(t *testing.T) {
+	SetFontSizeDetectionOrder([]FontSizeMethod{Fallback})
+	defer SetFontSizeDetectionOrder(nil)
+
+	img := testImage(20, 40)
+	ti := &TermImg{protocol: Kitty, img: &img}
+	var err error
+	out := captureStdout(t, func() { err = ti.Flash(time.Millisecond) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	draw := strings.Index(out, "a=T")
+	clear := strings.Index(out, fmt.Sprintf("a=d,d=i,i=%d", ti.kittyID))
+	if !strings.HasPrefix(out, "\x1b7") || draw < 0 || clear < draw || !strings.HasSuffix(out, "\x1b8") {
+		t.Errorf("expected the image to be drawn then deleted between a cursor save and restore, got %q", out)
+	}
+
+	out = captureStdout(t, func() { err = (&TermImg{protocol: Blocks, img: &img}).Flash(time.Millisecond) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(out, "\x1b8"+strings.Repeat("\x1b[3X\x1b[1B", 3)+"\x1b8") {
+		t.Errorf("expected the 3x3 blocks to be erased, got %q", out)
+	}
+}
+
+func TestKittyDoNotMoveCursor(t *testing.T) {
+	img := testImage(8, 8)
+	ti := &TermImg{protocol: Kitty, img: &img}
+	out, err := ti.Render()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(out, "C=1") {
+		t.Errorf("expected the cursor to move past the image by default")
+	}
+	out, err = ti.KittyDoNotMoveCursor(true).Render()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out, fmt.Sprintf("i=%d,C=1;", ti.kittyID)) {
+		t.Errorf("expected the control data to contain C=1, got %q", out[:min(len(out), 64)])
+	}
+}
+
+func TestUpdateRegion(t *testing.T) {
+	img := noiseImage(64, 64)
+	var buf bytes.Buffer
+	if err := UpdateRegionTo(&buf, 7, image.Rect(4, 2, 12, 8), img); err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+	if !strings.HasPrefix(out, START+"_Ga=f,i=7,r=1,x=4,y=2,s=8,v=6,f=100,") {
+		t.Errorf("expected a frame edit of the image's region, got %q", out[:min(len(out), 64)])
+	}
+	data, err := base64.StdEncoding.DecodeString(out[strings.IndexByte(out, ';')+1 : strings.LastIndex(out, ESCAPE)])
+	if err != nil {
+		t.Fatal(err)
+	}
+	patch, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b := patch.Bounds(); b.Dx() != 8 || b.Dy() != 6 || patch.At(b.Min.X, b.Min.Y) != img.At(4, 2) {
+		t.Errorf("expected only the region's pixels to be transmitted, got %v", b)
+	}
+
+	if err := UpdateRegionTo(&buf, 7, image.Rect(60, 60, 70, 70), img); err == nil {
+		t.Errorf("expected an error for a region beyond the image")
+	}
+	if err := UpdateRegionTo(&buf, 7, image.Rectangle{}, img); err == nil {
+		t.Errorf("expected an error for an empty region")
+	}
+}
+
+func TestParseOSCColor(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want color.RGBA
+	}{
+		{"16 bit, ST", "\x1b]11;rgb:1e1e/1e1e/2e2e\x1b\\", color.RGBA{0x1e, 0x1e, 0x2e, 0xff}},
+		{"16 bit, BEL", "\x1b]11;rgb:ffff/ffff/ffff\x07", color.RGBA{0xff, 0xff, 0xff, 0xff}},
+		{"8 bit", "\x1b]11;rgb:28/2c/34\x1b\\", color.RGBA{0x28, 0x2c, 0x34, 0xff}},
+		{"4 bit", "\x1b]11;rgb:f/8/0\x07", color.RGBA{0xff, 0x88, 0x00, 0xff}},
+		{"rgba", "\x1b]11;rgba:0000/8080/ffff/ffff\x1b\\", color.RGBA{0x00, 0x80, 0xff, 0xff}},
+		{"tmux prefix", "\x1bP\x1b]11;rgb:0000/0000/0000\x1b\\", color.RGBA{0, 0, 0, 0xff}},
+	}
+	for _, tt := range tests {
+		got, err := parseOSCColor([]byte(tt.in), 11)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%s: parseOSCColor() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+	for _, in := range []string{"", "\x1b]10;rgb:0/0/0\x07", "\x1b]11;#ffffff\x07", "\x1b]11;rgb:ff/ff\x07", "\x1b]11;rgb:fffff/0/0\x07"} {
+		if _, err := parseOSCColor([]byte(in), 11); err == nil {
+			t.Errorf("parseOSCColor(%q) should fail", in)
+		}
+	}
+
+	saved := queryTerminal
+	defer func() {
+		queryTerminal = saved
+		clear(termColors)
+	}()
+	queries := 0
+	queryTerminal = func(_ context.Context, query string) ([]byte, error) {
+		queries++
+		switch {
+		case strings.Contains(query, "\x1b]11;?\x07"):
+			return []byte("\x1b]11;rgb:2828/2c2c/3434\x1b\\"), nil
+		case strings.Contains(query, "\x1b]10;?\x07"):
+			return []byte("\x1b]10;rgb:abab/b2b2/bfbf\x07"), nil
+		default:
+			return nil, ErrEmptyResponse
+		}
+	}
+	for range 2 {
+		if bg, err := QueryBackgroundColor(); err != nil || bg != (color.RGBA{0x28, 0x2c, 0x34, 0xff}) {
+			t.Errorf("QueryBackgroundColor() = %v, %v", bg, err)
+		}
+		if fg, err := QueryForegroundColor(); err != nil || fg != (color.RGBA{0xab, 0xb2, 0xbf, 0xff}) {
+			t.Errorf("QueryForegroundColor() = %v, %v", fg, err)
+		}
+	}
+	if queries != 2 {
+		t.Errorf("expected the colors to be queried once and cached, got %d queries", queries)
+	}
+}
+
+func TestMaxPixels(t *testing.T) {
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	var huge image.Image = image.NewNRGBA(image.Rect(0, 0, 12000, 300))
+	ti := &TermImg{protocol: Kitty, img: &huge}
+	out, err := ti.Render()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out, "_Gs=10000,v=250,") {
+		t.Errorf("expected the image to be downscaled to Kitty's default limit, got %q", out[:min(len(out), 64)])
+	}
+	// the default limit is logged, once per image
+	ti.Layer(1).Render()
+	if n := strings.Count(logs.String(), "12000x300 image downscaled to the Kitty limit of 10000 pixels"); n != 1 {
+		t.Errorf("expected one warning about the default limit, got %q", logs.String())
+	}
+	logs.Reset()
+
+	img := testImage(200, 100)
+	out, err = (&TermImg{protocol: ITerm2, img: &img}).MaxPixels(50).Render()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out, "width=50px;height=25px") {
+		t.Errorf("expected the image to be downscaled to 50x25, got %q", out[:min(len(out), 64)])
+	}
+	out, _ = (&TermImg{protocol: Kitty, img: &huge}).MaxPixels(-1).Render()
+	if !strings.Contains(out, "_Gs=12000,v=300,") {
+		t.Errorf("expected a negative limit to disable downscaling")
+	}
+	if logs.Len() > 0 {
+		t.Errorf("expected no warning with an explicit limit, got %q", logs.String())
+	}
+}
+
+func TestFitWidthHeight(t *testing.T) {
+	SetDefaultFontSize(8, 16)
+	defer SetDefaultFontSize(0, 0)
+
+	img := testImage(80, 40) // 10x3 cells at its natural size
+	want := map[Protocol]string{Kitty: "c=20,r=5", ITerm2: "width=20;height=5;", Blocks: strings.Repeat(" ", 20) + "\x1b[0m\n"}
+	for _, protocol := range []Protocol{Kitty, ITerm2, Blocks} {
+		for name, ti := range map[string]*TermImg{
+			"FitWidth":  (&TermImg{protocol: protocol, img: &img}).FitWidth(20),
+			"FitHeight": (&TermImg{protocol: protocol, img: &img}).FitHeight(5),
+		} {
+			out, cols, rows, err := ti.RenderWithSize()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cols != 20 || rows != 5 {
+				t.Errorf("%s/%s: got %dx%d cells, want 20x5 like the image's 2:1 aspect ratio with 1:2 cells", protocol, name, cols, rows)
+			}
+			if protocol == Blocks {
+				out = regexp.MustCompile(`\x1b\[48;2;\d+;\d+;\d+m`).ReplaceAllString(out, "")
+			}
+			if !strings.Contains(out, want[protocol]) || protocol == Blocks && strings.Count(out, "\n") != 5 {
+				t.Errorf("%s/%s: output missing %q", protocol, name, want[protocol])
+			}
+		}
+	}
+}
+
+func TestDitherPalette(t *testing.T) {
+	img := testImage(32, 32)
+	brand := color.Palette{color.RGBA{0xe0, 0x1b, 0x24, 0xff}, color.RGBA{0xf6, 0xf5, 0xf4, 0xff}, color.NRGBA{0x1c, 0x71, 0xd8, 0xff}, color.Transparent}
+	allowed := map[color.NRGBA]bool{{}: true}
+	for _, c := range brand[:3] {
+		allowed[color.NRGBAModel.Convert(c).(color.NRGBA)] = true
+	}
+	for _, mode := range []DitherMode{DitherFloydSteinberg, DitherAtkinson, DitherOrdered} {
+		out := (&TermImg{protocol: Kitty, img: &img}).DitherColors(64).DitherPalette(brand).DitherMode(mode).processImage()
+		b := out.Bounds()
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			for x := b.Min.X; x < b.Max.X; x++ {
+				if c := color.NRGBAModel.Convert(out.At(x, y)).(color.NRGBA); !allowed[c] {
+					t.Fatalf("%s: pixel %d,%d = %v isn't in the palette", mode, x, y, c)
+				}
+			}
+		}
+	}
+
+	// a palette without opaque colors leaves the image as is
+	src := image.NewNRGBA(image.Rect(0, 0, 2, 1))
+	src.SetNRGBA(0, 0, color.NRGBA{R: 200, A: 255})
+	img = src
+	for _, mode := range []DitherMode{DitherFloydSteinberg, DitherAtkinson, DitherOrdered} {
+		out := (&TermImg{protocol: Kitty, img: &img}).DitherPalette(color.Palette{color.Transparent, color.NRGBA{G: 255, A: 40}}).DitherMode(mode).processImage()
+		if out.At(0, 0) != src.At(0, 0) || out.At(1, 0) != src.At(1, 0) {
+			t.Errorf("%s: expected a translucent palette to leave the image unchanged", mode)
+		}
+	}
+}
+
+func TestBlocksFitTerminal(t *testing.T) {
+	savedSize := terminalSize
+	defer func() { terminalSize = savedSize }()
+	terminalSize = func() (int, int, error) { return 10, 24, nil }
+
+	img := testImage(200, 100)
+	out, cols, rows, err := (&TermImg{protocol: Blocks, img: &img}).FontSize(10, 20).RenderWithSize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 20x5 cells at its natural size, shrunk to the 10 columns of the terminal
+	if cols != 10 || rows != 3 || strings.Count(out, "\n") != 3 || strings.Count(out, " ") != 30 {
+		t.Errorf("RenderWithSize() = %dx%d cells, %q", cols, rows, out)
+	}
+
+	// smaller images keep their natural size
+	img = testImage(50, 40)
+	if _, cols, rows, _ = (&TermImg{protocol: Blocks, img: &img}).FontSize(10, 20).RenderWithSize(); cols != 5 || rows != 2 {
+		t.Errorf("RenderWithSize() = %dx%d cells, want 5x2", cols, rows)
+	}
+}
+
+func TestBlockResolution(t *testing.T) {
+	img := testImage(60, 60)
+	hasSextant := func(s string) bool {
+		return strings.ContainsFunc(s, func(r rune) bool { return r >= 0x1FB00 && r <= 0x1FB3B })
+	}
+
+	out, err := (&TermImg{protocol: Blocks, img: &img}).Preview(10, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hasSextant(out) || strings.Contains(out, "▀") || strings.Count(out, " ") != 50 {
+		t.Errorf("expected a colored space per cell by default")
+	}
+	out, _ = (&TermImg{protocol: Blocks, img: &img}).BlockResolution(BlockHalf).Preview(10, 5)
+	if hasSextant(out) || strings.Count(out, "▀") != 50 || !strings.Contains(out, "\x1b[38;2;") {
+		t.Errorf("expected half blocks with a foreground color")
+	}
+	out, _ = (&TermImg{protocol: Blocks, img: &img}).BlockResolution(BlockSextant).Preview(10, 5)
+	if !hasSextant(out) || strings.Count(out, "\n") != 5 {
+		t.Errorf("expected 5 lines of sextants, got %q", out)
+	}
+
+	for mask, want := range map[int]rune{1: 0x1FB00, 20: 0x1FB13, 21: '▌', 22: 0x1FB14, 41: 0x1FB27, 42: '▐', 43: 0x1FB28, 62: 0x1FB3B, 63: '█'} {
+		if got := sextantRune(mask); got != want {
+			t.Errorf("sextantRune(%06b) = %U, want %U", mask, got, want)
+		}
+	}
+	// a cell split between two colors
+	black, white := color.RGBA{A: 255}, color.RGBA{255, 255, 255, 255}
+	cell := (&TermImg{}).sextant([6]color.RGBA{white, black, white, black, white, white})
+	if cell != "\x1b[38;2;255;255;255m\x1b[48;2;0;0;0m"+string(sextantRune(0b110101)) {
+		t.Errorf("sextant() = %q", cell)
+	}
+}
+
+func TestSentinelErrors(t *testing.T) {
+	t.Setenv(BYPASS_DETECTION_ENV, "")
+	t.Setenv("TERM_PROGRAM", "")
+	t.Setenv("TERM", "xterm-256color")
+	t.Setenv("KITTY_WINDOW_ID", "")
+	saved := queryTerminal
+	defer func() { queryTerminal = saved }()
+	queryTerminal = func(context.Context, string) ([]byte, error) { return nil, ErrEmptyResponse }
+
+	if _, err := NewTermImg(strings.NewReader("GIF89a")); !errors.Is(err, ErrNoProtocol) {
+		t.Errorf("NewTermImg() without a supported protocol error = %v, want ErrNoProtocol", err)
+	}
+
+	t.Setenv(BYPASS_DETECTION_ENV, "kitty")
+	if _, err := FromBytes([]byte("not an image")); !errors.Is(err, ErrDecode) {
+		t.Errorf("FromBytes() of invalid data error = %v, want ErrDecode", err)
+	}
+
+	img := testImage(4, 4)
+	if _, err := (&TermImg{protocol: Unsupported, img: &img}).Render(); !errors.Is(err, ErrProtocolUnavailable) {
+		t.Errorf("Render() error = %v, want ErrProtocolUnavailable", err)
+	}
+	if err := (&TermImg{protocol: Blocks, img: &img}).ClearTo(io.Discard); !errors.Is(err, ErrProtocolUnavailable) {
+		t.Errorf("ClearTo() error = %v, want ErrProtocolUnavailable", err)
+	}
+
+	if !term.IsTerminal(int(os.Stdin.Fd())) {
+		if _, err := saved(context.Background(), "\x1b[>0q"); !errors.Is(err, ErrNotInteractive) {
+			t.Errorf("queryTerminal() without a terminal error = %v, want ErrNotInteractive", err)
+		}
+	}
+}
+
+func TestClone(t *testing.T) {
+	img := testImage(16, 16)
+	base := (&TermImg{protocol: Kitty, img: &img}).Layer(2).FitWidth(4)
+	first, err := base.Render()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clone := base.Clone()
+	if clone.encoded != "" {
+		t.Errorf("expected the clone to be rendered from scratch")
+	}
+	out, err := clone.Render()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if clone.kittyID == base.kittyID || out != strings.Replace(first, fmt.Sprintf("i=%d,", base.kittyID), fmt.Sprintf("i=%d,", clone.kittyID), 1) {
+		t.Errorf("expected the clone to render like the original with its own image ID")
+	}
+
+	clone.FitWidth(8)
+	clone.protocol = ITerm2
+	if base.fillCols != 4 || base.protocol != Kitty {
+		t.Errorf("modifying the clone changed the original")
+	}
+	if again, _ := base.Render(); again != first {
+		t.Errorf("expected the original's output to be unchanged")
+	}
+	if forced := base.KittyImageID(9).Clone(); forced.kittyID != 9 || !forced.kittyIDForced {
+		t.Errorf("expected a forced image ID to be kept by the clone")
+	}
+}
+
+func TestIndependentChains(t *testing.T) {
+	img := testImage(16, 16)
+	base := (&TermImg{protocol: Kitty, img: &img}).Layer(1)
+	small := base.Clone().FitWidth(2)
+	large := base.Clone().FitWidth(8).Invert(true)
+	if small.fillCols != 2 || small.invert || large.fillCols != 8 || !large.invert {
+		t.Errorf("expected chains from clones of the same image to be configured independently")
+	}
+	if base.fillCols != 0 || base.invert || base.layer != 1 || small.layer != 1 || large.layer != 1 {
+		t.Errorf("expected the clones to keep the base configuration without modifying it")
+	}
+
+	// without Clone, chains share the image they start from
+	if a, b := base.FitWidth(2), base.FitWidth(8); a != b || a.fillCols != 8 {
+		t.Errorf("expected the setters to modify the image they are called on")
+	}
+}
+
+func TestWatchTerminalSize(t *testing.T) {
+	SetDefaultFontSize(8, 16)
+	savedSize := terminalSize
+	defer func() {
+		terminalSize = savedSize
+		SetDefaultFontSize(0, 0)
+	}()
+	var mu sync.Mutex
+	cols, rows := 80, 24
+	terminalSize = func() (int, int, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		return cols, rows, nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	sig := make(chan os.Signal)
+	sizes := watchTerminalSize(ctx, sig)
+	sig <- os.Interrupt
+	if got := <-sizes; got != (TerminalSize{Cols: 80, Rows: 24, FontWidth: 8, FontHeight: 16}) {
+		t.Errorf("first size = %+v", got)
+	}
+	mu.Lock()
+	cols, rows = 120, 40
+	mu.Unlock()
+	sig <- os.Interrupt
+	if got := <-sizes; got.Cols != 120 || got.Rows != 40 {
+		t.Errorf("expected the size to be detected again after a resize, got %+v", got)
+	}
+	cancel()
+	if _, ok := <-sizes; ok {
+		t.Errorf("expected the channel to be closed when the context is done")
+	}
+
+	// the terminal is never queried for the font size on resizes, only the known one is reported
+	SetDefaultFontSize(0, 0)
+	ClearDetectionCache()
+	savedMethods := fontSizeMethods
+	defer func() {
+		fontSizeMethods = savedMethods
+		SetFontSizeDetectionOrder(nil)
+	}()
+	detections := 0
+	fontSizeMethods = map[FontSizeMethod]func() (int, int, error){
+		CSI16t: func() (int, int, error) { detections++; return 9, 18, nil },
+	}
+	SetFontSizeDetectionOrder([]FontSizeMethod{CSI16t})
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	sizes = watchTerminalSize(ctx, sig)
+	sig <- os.Interrupt
+	if got := <-sizes; got.FontWidth != 0 || got.FontHeight != 0 || detections != 0 {
+		t.Errorf("expected an unknown font size without queries, got %+v (%d detections)", got, detections)
+	}
+	GetTerminalFontSize() // e.g. by a render
+	sig <- os.Interrupt
+	if got := <-sizes; got.FontWidth != 9 || got.FontHeight != 18 || detections != 1 {
+		t.Errorf("expected the detected font size without queries, got %+v (%d detections)", got, detections)
+	}
+	cancel()
+
+	// the public watcher stops when its context is done
+	ctx, cancel = context.WithCancel(context.Background())
+	sizes = WatchTerminalSize(ctx)
+	cancel()
+	for range sizes {
+	}
+}
+
+func TestPrintToTTY(t *testing.T) {
+	saved := ttyPath
+	defer func() { ttyPath = saved }()
+	ttyPath = filepath.Join(t.TempDir(), "tty")
+	if err := os.WriteFile(ttyPath, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	img := testImage(8, 8)
+	ti := &TermImg{protocol: ITerm2, img: &img}
+	var err error
+	if out := captureStdout(t, func() { err = ti.PrintToTTY() }); err != nil || out != "" {
+		t.Errorf("expected nothing to be written to the redirected stdout, got %q (%v)", out, err)
+	}
+	tty, _ := os.ReadFile(ttyPath)
+	if !strings.Contains(string(tty), "]1337;File=inline=1;") {
+		t.Errorf("expected the image to be written to the terminal, got %q", tty)
+	}
+
+	// without a terminal, the image is printed to stdout
+	ttyPath = filepath.Join(t.TempDir(), "missing", "tty")
+	if out := captureStdout(t, func() { err = ti.PrintToTTY() }); err != nil || !strings.Contains(out, "]1337;File=inline=1;") {
+		t.Errorf("expected the image to be printed to stdout, got %q (%v)", out, err)
+	}
+}
+
+func TestKittyBatch(t *testing.T) {
+	var batch KittyBatch
+	var ids []uint32
+	for i := range 3 {
+		img := testImage(8+i, 8)
+		ti := (&TermImg{protocol: Kitty, img: &img}).FillCells(2, 1)
+		if err := batch.AddImage(ti, i*3, 1); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, ti.kittyImageID())
+	}
+	img := testImage(8, 8)
+	if err := batch.AddImage(&TermImg{protocol: ITerm2, img: &img}, 0, 0); !errors.Is(err, ErrProtocolUnavailable) {
+		t.Errorf("expected an error adding an iTerm2 image, got %v", err)
+	}
+
+	var buf bytes.Buffer
+	if err := batch.FlushTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+	if last, first := strings.LastIndex(out, ",a=t,"), strings.Index(out, "_Ga=p,"); strings.Count(out, ",a=t,") != 3 || last > first {
+		t.Errorf("expected the 3 transfers to be sent before any placement")
+	}
+	for i, id := range ids {
+		if want := fmt.Sprintf("\x1b[2;%dH%s_Ga=p,q=2,i=%d,c=2,r=1", i*3+1, START, id); !strings.Contains(out, want) {
+			t.Errorf("missing placement %q", want)
+		}
+	}
+	if !strings.HasPrefix(out[strings.Index(out, "_Ga=p,")-len("\x1b7\x1b[2;1H"+START):], "\x1b7") || !strings.HasSuffix(out, "\x1b8") {
+		t.Errorf("expected the placements to be drawn between a cursor save and restore")
+	}
+
+	buf.Reset()
+	if err := batch.FlushTo(&buf); err != nil || buf.Len() != 0 {
+		t.Errorf("expected Flush to empty the batch, got %q", buf.String())
+	}
+}
+
+func TestInspect(t *testing.T) {
+	SetFontSizeDetectionOrder([]FontSizeMethod{Fallback})
+	defer SetFontSizeDetectionOrder(nil)
+
+	img := testImage(20, 40) // 3x3 cells with the 8x16 fallback font
+	big := noiseImage(64, 64)
+	tests := []struct {
+		name       string
+		ti         *TermImg
+		cols, rows int
+		chunks     int
+	}{
+		{"Kitty", &TermImg{protocol: Kitty, img: &img}, 3, 3, 1},
+		{"Kitty/Fill", (&TermImg{protocol: Kitty, img: &img}).FillCells(5, 2), 5, 2, 1},
+		{"Kitty/Chunks", (&TermImg{protocol: Kitty, img: &big}).KittyChunkSize(300), 8, 4, 0},
+		{"iTerm2", &TermImg{protocol: ITerm2, img: &img}, 3, 3, 1},
+		{"iTerm2/Fill", (&TermImg{protocol: ITerm2, img: &img}).FillCells(6, 2), 6, 2, 1},
+		{"Blocks", &TermImg{protocol: Blocks, img: &img}, 3, 3, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			info, err := tt.ti.Inspect()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.Protocol != tt.ti.protocol {
+				t.Errorf("Protocol = %s, want %s", info.Protocol, tt.ti.protocol)
+			}
+			if info.Cols != tt.cols || info.Rows != tt.rows {
+				t.Errorf("Inspect() = %dx%d cells, want %dx%d", info.Cols, info.Rows, tt.cols, tt.rows)
+			}
+			out, err := tt.ti.Render()
+			if err != nil {
+				t.Fatal(err)
+			}
+			switch tt.ti.protocol {
+			case Kitty:
+				if !strings.Contains(out, START+"_G"+info.Control+",") && !strings.Contains(out, START+"_G"+info.Control+";") {
+					t.Errorf("control data %q is not in the output", info.Control)
+				}
+				if cols, rows := tt.ti.fillCells(); cols > 0 && !strings.Contains(info.Control, fmt.Sprintf("c=%d,r=%d", info.Cols, info.Rows)) {
+					t.Errorf("control data %q doesn't have the %dx%d cells", info.Control, cols, rows)
+				}
+				want := tt.chunks
+				if want == 0 {
+					want = ceilDiv(info.Size, 300)
+				}
+				if info.Chunks != want || strings.Count(out, START+"_G") != want {
+					t.Errorf("Chunks = %d, want %d", info.Chunks, want)
+				}
+			case ITerm2:
+				if !strings.Contains(out, "]1337;File="+info.Control+":") {
+					t.Errorf("arguments %q are not in the output", info.Control)
+				}
+				if info.Chunks != tt.chunks {
+					t.Errorf("Chunks = %d, want %d", info.Chunks, tt.chunks)
+				}
+			case Blocks:
+				if info.Control != "" || info.Chunks != 0 || info.Width != 20 || info.Height != 40 {
+					t.Errorf("Inspect() = %+v, want only the dimensions of a Blocks image", info)
+				}
+			}
+		})
+	}
+}
+
+func TestDetectionCacheTTL(t *testing.T) {
+	saved := queryTerminal
+	defer func() {
+		queryTerminal = saved
+		SetDetectionCacheTTL(0)
+		ClearDetectionCache()
+	}()
+	queries := 0
+	queryTerminal = func(_ context.Context, query string) ([]byte, error) {
+		queries++
+		if strings.Contains(query, "a=t") {
+			return []byte("\x1b_Gi=43;OK\x1b\\"), nil
+		}
+		return []byte("\x1b]11;rgb:0000/0000/0000\x07"), nil
+	}
+	detect := func() {
+		captureStdout(t, func() { kittyTransmissionSupported(context.Background()) }) // discard the probe deletion
+		if _, err := QueryBackgroundColor(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ClearDetectionCache()
+	detect()
+	detect()
+	if queries != 2 {
+		t.Fatalf("expected the detection to be cached forever by default, got %d queries", queries)
+	}
+
+	SetDetectionCacheTTL(time.Millisecond)
+	time.Sleep(2 * time.Millisecond)
+	detect()
+	if queries != 4 {
+		t.Errorf("expected the expired results to be detected again, got %d queries", queries)
+	}
+
+	SetDetectionCacheTTL(time.Hour)
+	detect()
+	if queries != 4 {
+		t.Errorf("expected fresh results to be cached, got %d queries", queries)
+	}
+	ClearDetectionCache()
+	detect()
+	if queries != 6 {
+		t.Errorf("expected ClearDetectionCache to force a new detection, got %d queries", queries)
+	}
+}
+
+func TestNormalize(t *testing.T) {
+	cmyk := image.NewCMYK(image.Rect(0, 0, 4, 4))
+	draw.Draw(cmyk, cmyk.Bounds(), image.NewUniform(color.CMYK{C: 0, M: 255, Y: 255, K: 0}), image.Point{}, draw.Src)
+	rgba64 := image.NewRGBA64(image.Rect(0, 0, 4, 4))
+	draw.Draw(rgba64, rgba64.Bounds(), image.NewUniform(color.RGBA64{R: 0xffff, G: 0x8080, A: 0xffff}), image.Point{}, draw.Src)
+	translucent := image.NewNRGBA64(image.Rect(0, 0, 4, 4))
+	draw.Draw(translucent, translucent.Bounds(), image.NewUniform(color.NRGBA64{B: 0xffff, A: 0x8080}), image.Point{}, draw.Src)
+
+	for _, tt := range []struct {
+		name string
+		img  image.Image
+		want color.NRGBA
+	}{
+		{"CMYK", cmyk, color.NRGBA{R: 255, A: 255}},
+		{"RGBA64", rgba64, color.NRGBA{R: 255, G: 128, A: 255}},
+		{"NRGBA64", translucent, color.NRGBA{B: 255, A: 128}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			out, err := (&TermImg{protocol: Kitty, img: &tt.img}).Render()
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, err := base64.StdEncoding.DecodeString(out[strings.IndexByte(out, ';')+1 : strings.LastIndex(out, ESCAPE)])
+			if err != nil {
+				t.Fatal(err)
+			}
+			decoded, err := png.Decode(bytes.NewReader(data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, ok := decoded.(*image.NRGBA); !ok {
+				if _, ok := decoded.(*image.RGBA); !ok {
+					t.Errorf("expected an 8-bit PNG, got %T", decoded)
+				}
+			}
+			if got := color.NRGBAModel.Convert(decoded.At(1, 1)); got != tt.want {
+				t.Errorf("Kitty pixel = %v, want %v", got, tt.want)
+			}
+
+			if _, err := (&TermImg{protocol: ITerm2, img: &tt.img}).Render(); err != nil {
+				t.Errorf("iTerm2: %v", err)
+			}
+			out, err = (&TermImg{protocol: Blocks, img: &tt.img}).FontSize(4, 4).Render()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := fmt.Sprintf("\x1b[48;2;%d;%d;%dm", tt.want.R, tt.want.G, tt.want.B); tt.want.A == 255 && !strings.Contains(out, want) {
+				t.Errorf("Blocks output = %q, want it to contain %q", out, want)
+			}
+		})
+	}
+}
+
+func TestOnProgress(t *testing.T) {
+	saved := queryTerminal
+	defer func() { queryTerminal = saved }()
+	queryTerminal = func(context.Context, string) ([]byte, error) { return nil, ErrEmptyResponse }
+
+	img := noiseImage(64, 64)
+	for _, tt := range []struct {
+		name string
+		ti   *TermImg
+	}{
+		{"Kitty", (&TermImg{protocol: Kitty, img: &img}).KittyChunkSize(300)},
+		{"iTerm2", (&TermImg{protocol: ITerm2, img: &img}).ITerm2ChunkSize(300)},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls []int
+			tt.ti.OnProgress(func(sent, total int) {
+				if total < 2 || sent > total {
+					t.Errorf("progress %d/%d", sent, total)
+				}
+				calls = append(calls, sent)
+			})
+			info, err := tt.ti.Inspect()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := tt.ti.Render(); err != nil || len(calls) != 0 {
+				t.Fatalf("expected Render not to report progress, got %d calls (%v)", len(calls), err)
+			}
+			want, _ := tt.ti.Render()
+			var buf bytes.Buffer
+			if err := tt.ti.PrintTo(&buf); err != nil {
+				t.Fatal(err)
+			}
+			if len(calls) != info.Chunks || calls[len(calls)-1] != info.Chunks {
+				t.Errorf("expected %d progress calls, got %v", info.Chunks, calls)
+			}
+			if buf.String() != want+"\n" {
+				t.Errorf("expected the output to be written unchanged")
+			}
+
+			if tt.ti.protocol == Kitty {
+				calls = nil
+				if err := tt.ti.PrintStreaming(&buf); err != nil {
+					t.Fatal(err)
+				}
+				if len(calls) != info.Chunks {
+					t.Errorf("expected %d progress calls while streaming, got %d", info.Chunks, len(calls))
+				}
+			}
+		})
+	}
+}
+
+func TestReadResponse(t *testing.T) {
+	tests := []struct {
+		name     string
+		chunks   []string
+		untilDA1 bool
+		want     string
+		err      error
+		reads    int
+	}{
+		{"split", []string{"\x1b_Gi=42;O", "K\x1b\\", "\x1b[?62;22c", "ignored"}, true, "\x1b_Gi=42;OK\x1b\\", nil, 3},
+		{"unanswered", []string{"\x1b[?62;22c"}, true, "", ErrEmptyResponse, 1},
+		{"key pressed", []string{"a\x1b[12;5R\x1b[?1;2c"}, true, "a\x1b[12;5R", nil, 1},
+		{"multiplexer", []string{"\x1b]11;rgb:0/0/0\x07", "\x1b[?62c"}, false, "\x1b]11;rgb:0/0/0\x07", nil, 1},
+		{"DCS", []string{"\x1bP>|kitty(0.35.2)\x1b", "\\"}, false, "\x1bP>|kitty(0.35.2)\x1b\\", nil, 2},
+		{"timeout", nil, true, "", ErrQueryTimeout, 1},
+		{"incomplete", []string{"\x1b[6;1"}, true, "\x1b[6;1", nil, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reads := 0
+			read := func(p []byte, timeout time.Duration) (int, error) {
+				reads++
+				if len(tt.chunks) < reads {
+					return 0, ErrQueryTimeout
+				}
+				return copy(p, tt.chunks[reads-1]), nil
+			}
+			resp, err := readResponse(context.Background(), read, time.Second, tt.untilDA1)
+			if !errors.Is(err, tt.err) || (tt.err == ErrEmptyResponse && errors.Is(err, ErrQueryTimeout)) {
+				t.Errorf("readResponse() error = %v, want %v", err, tt.err)
+			}
+			if string(resp) != tt.want {
+				t.Errorf("readResponse() = %q, want %q", resp, tt.want)
+			}
+			if reads != tt.reads {
+				t.Errorf("expected %d reads, got %d", tt.reads, reads)
+			}
+		})
+	}
+	if !errors.Is(ErrQueryTimeout, ErrEmptyResponse) {
+		t.Errorf("expected timeouts to be empty responses")
+	}
+
+	// the context ends the wait, by its deadline or when it is canceled
+	unanswered := func(p []byte, timeout time.Duration) (int, error) {
+		time.Sleep(timeout)
+		return 0, ErrQueryTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := readResponse(ctx, unanswered, time.Minute, true); !errors.Is(err, context.DeadlineExceeded) || time.Since(start) > 500*time.Millisecond {
+		t.Errorf("readResponse() = %v after %s, want the context deadline", err, time.Since(start))
+	}
+	ctx, cancel = context.WithCancel(context.Background())
+	time.AfterFunc(30*time.Millisecond, cancel)
+	start = time.Now()
+	if _, err := readResponse(ctx, unanswered, time.Minute, true); !errors.Is(err, context.Canceled) || time.Since(start) > 500*time.Millisecond {
+		t.Errorf("readResponse() = %v after %s, want the context cancellation", err, time.Since(start))
+	}
+}
+
+func TestReadStdinTimeout(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("reads of stdin can't be interrupted on Windows")
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	defer w.Close()
+	saved := os.Stdin
+	os.Stdin = r
+	defer func() { os.Stdin = saved }()
+
+	buf := make([]byte, 16)
+	if _, err := readStdinTimeout(buf, 10*time.Millisecond); !errors.Is(err, ErrQueryTimeout) {
+		t.Fatalf("expected a timeout, got %v", err)
+	}
+	// nothing is left reading stdin after the timeout to swallow the next response
+	w.Write([]byte("\x1b[?62c"))
+	n, err := readStdinTimeout(buf, time.Second)
+	if err != nil || string(buf[:n]) != "\x1b[?62c" {
+		t.Errorf("readStdinTimeout() = %q, %v", buf[:n], err)
+	}
+}
+
+func TestFontSizeCache(t *testing.T) {
+	saved := fontSizeMethods
+	defer func() {
+		fontSizeMethods = saved
+		SetFontSizeDetectionOrder(nil)
+		SetDetectionCacheTTL(0)
+	}()
+	detections := 0
+	fontSizeMethods = map[FontSizeMethod]func() (int, int, error){
+		CSI16t: func() (int, int, error) { detections++; return 8, 16, nil },
+	}
+	SetFontSizeDetectionOrder([]FontSizeMethod{CSI16t})
+
+	img := testImage(40, 20)
+	for range 3 {
+		out, err := (&TermImg{protocol: Kitty, img: &img}).FitWidth(10).Render()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(out, "c=10,r=3") {
+			t.Errorf("expected the rows to be computed from the detected font size, got %q", out[:min(len(out), 64)])
+		}
+	}
+	if detections != 1 {
+		t.Errorf("expected the font size to be detected once, got %d detections", detections)
+	}
+
+	SetDetectionCacheTTL(time.Millisecond)
+	time.Sleep(2 * time.Millisecond)
+	GetTerminalFontSize()
+	if detections != 2 {
+		t.Errorf("expected the expired font size to be detected again, got %d detections", detections)
+	}
+	ClearDetectionCache()
+	GetTerminalFontSize()
+	if detections != 3 {
+		t.Errorf("expected ClearDetectionCache to force a new detection, got %d detections", detections)
+	}
+}
+
+func TestTerminalNameCache(t *testing.T) {
+	t.Setenv("TERM_PROGRAM", "")
+	t.Setenv("TERM", "xterm-256color")
+	saved := queryTerminal
+	defer func() {
+		queryTerminal = saved
+		ClearDetectionCache()
+	}()
+	ClearDetectionCache()
+	queries := 0
+	queryTerminal = func(_ context.Context, query string) ([]byte, error) {
+		queries++
+		return nil, ErrEmptyResponse // e.g. xterm with XTVERSION disabled
+	}
+	for range 3 {
+		if checkITerm2Support(context.Background()) {
+			t.Errorf("expected iTerm2 not to be detected")
+		}
+		if _, _, err := fontSizeITerm2(); err == nil {
+			t.Errorf("expected the iTerm2 font size method to fail")
+		}
+	}
+	if queries != 1 {
+		t.Errorf("expected the terminal name to be queried once, got %d queries", queries)
+	}
+}
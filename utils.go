@@ -1,13 +1,333 @@
 package termimg
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
 	"log"
+	"os"
 	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/term"
 )
 
+// tmuxCommand runs a tmux command and returns its output (swappable in tests)
+var tmuxCommand = func(args ...string) ([]byte, error) {
+	return exec.Command("tmux", args...).Output()
+}
+
 func tmuxPassthrough() {
-	cmd := exec.Command("tmux", "set", "-p", "allow-passthrough", "on")
-	if err := cmd.Run(); err != nil {
+	// keep `all` if it is already set, it also allows passthrough from the current pane
+	if mode, err := TmuxPassthroughMode(); err == nil && mode == "all" {
+		return
+	}
+	if err := SetTmuxPassthroughMode("on"); err != nil {
 		log.Fatalf("Failed to run tmux command: %v", err)
 	}
 }
+
+// SetTmuxPassthroughMode sets the tmux allow-passthrough option of the current pane (tmux 3.3+):
+//   - on: images are only passed through while the pane is visible (the default set by this package)
+//   - all: images are also passed through from invisible panes and inactive windows (e.g. a status image)
+func SetTmuxPassthroughMode(mode string) error {
+	if mode != "on" && mode != "all" {
+		return fmt.Errorf("invalid tmux passthrough mode %q: must be 'on' or 'all'", mode)
+	}
+	if _, err := tmuxCommand("set", "-p", "allow-passthrough", mode); err != nil {
+		return fmt.Errorf("failed to set tmux allow-passthrough: %s", err)
+	}
+	return nil
+}
+
+// TmuxPassthroughMode returns the tmux allow-passthrough option that applies to the current pane ("off", "on" or "all")
+func TmuxPassthroughMode() (string, error) {
+	// the pane option is empty unless it was set on the pane itself, fall back to the global option
+	for _, scope := range []string{"-pv", "-gv"} {
+		out, err := tmuxCommand("show", scope, "allow-passthrough")
+		if err != nil {
+			return "", fmt.Errorf("failed to get tmux allow-passthrough: %s", err)
+		}
+		if mode := strings.TrimSpace(string(out)); mode != "" {
+			return mode, nil
+		}
+	}
+	return "off", nil
+}
+
+// WrapForMultiplexer wraps an escape sequence so that it is passed through to the outer terminal
+// when running inside tmux or GNU screen, and returns it unchanged otherwise. This is for apps that
+// emit their own escape sequences (e.g. custom OSC codes) alongside images.
+//
+// Both multiplexers pass through the contents of a DCS string (`ESC P ... ESC \`):
+//   - tmux: the DCS must start with `tmux;` and every ESC inside it must be doubled (ESC ESC),
+//     as a single ESC ends the passthrough (requires `allow-passthrough on`)
+//   - screen: the sequence is wrapped as is, and must not itself contain an ST (`ESC \`)
+func WrapForMultiplexer(seq string) string {
+	return wrapForMultiplexer(seq, detectMultiplexer())
+}
+
+// detectMultiplexer returns "tmux", "screen" or "" when not running inside a multiplexer
+func detectMultiplexer() string {
+	switch {
+	case os.Getenv("TMUX") != "" || os.Getenv("TERM_PROGRAM") == "tmux":
+		return "tmux"
+	case os.Getenv("STY") != "":
+		return "screen"
+	default:
+		return ""
+	}
+}
+
+func wrapForMultiplexer(seq, multiplexer string) string {
+	switch multiplexer {
+	case "tmux":
+		return "\x1bPtmux;" + strings.ReplaceAll(seq, "\x1b", "\x1b\x1b") + "\x1b\\"
+	case "screen":
+		return "\x1bP" + seq + "\x1b\\"
+	default:
+		return seq
+	}
+}
+
+// cursorTo returns the escape sequence moving the cursor to the 0-based cell x,y.
+//
+// All public APIs of this package use 0-based cell coordinates (the top left cell is 0,0)
+// and convert them to the 1-based coordinates of the terminal's cursor sequences here.
+func cursorTo(x, y int) string {
+	return fmt.Sprintf("\x1b[%d;%dH", y+1, x+1)
+}
+
+// cursorMove returns the escape sequence moving the cursor by dx columns and dy rows (negative is left/up)
+func cursorMove(dx, dy int) string {
+	var seq string
+	switch {
+	case dx > 0:
+		seq += fmt.Sprintf("\x1b[%dC", dx)
+	case dx < 0:
+		seq += fmt.Sprintf("\x1b[%dD", -dx)
+	}
+	switch {
+	case dy > 0:
+		seq += fmt.Sprintf("\x1b[%dB", dy)
+	case dy < 0:
+		seq += fmt.Sprintf("\x1b[%dA", -dy)
+	}
+	return seq
+}
+
+// IsRemoteSession reports whether we are likely running inside an SSH session, in which case
+// the terminal can't read files from our local filesystem
+func IsRemoteSession() bool {
+	return os.Getenv("SSH_CONNECTION") != "" || os.Getenv("SSH_TTY") != "" || os.Getenv("SSH_CLIENT") != ""
+}
+
+// ErrNotInteractive is returned (wrapped) when the terminal can't be queried, as stdin isn't a terminal
+var ErrNotInteractive = fmt.Errorf("not an interactive terminal")
+
+// ErrQueryTimeout is returned when the terminal doesn't answer a query in time (it wraps
+// ErrEmptyResponse, like queries the terminal answered with nothing)
+var ErrQueryTimeout = fmt.Errorf("%w: no answer within %s", ErrEmptyResponse, QUERY_TIMEOUT)
+
+// QUERY_TIMEOUT is how long a query waits for the terminal's response
+const QUERY_TIMEOUT = time.Second
+
+// queryMu serializes the queries, so each response is read by the query it answers
+var queryMu sync.Mutex
+
+// queryTerminal sends a query to the terminal (in raw mode) and returns its response (swappable in tests).
+// Outside of multiplexers the query is followed by a primary device attributes request (DA1), which
+// every terminal answers: the response is what comes before the DA1 answer, so a query the terminal
+// ignores fails as soon as it arrives instead of after QUERY_TIMEOUT. Multiplexers answer DA1 themselves,
+// possibly before the outer terminal's response, so there the response ends with the first escape sequence.
+// The query isn't sent if ctx is done, and stops waiting for the response when ctx is done.
+var queryTerminal = func(ctx context.Context, query string) ([]byte, error) {
+	return queryTerminalTo(ctx, os.Stdout, query)
+}
+
+// queryTerminalTo is like queryTerminal, but writes the query to w, which must write to the terminal
+// stdin reads from (e.g. /dev/tty when stdout is redirected)
+func queryTerminalTo(ctx context.Context, w io.Writer, query string) ([]byte, error) {
+	return queryTerminalUntil(ctx, w, query, detectMultiplexer() == "")
+}
+
+// queryTerminalUntil sends a query to the terminal with w like queryTerminalTo, with the response
+// ending with the DA1 answer (untilDA1) or else with the first escape sequence
+func queryTerminalUntil(ctx context.Context, w io.Writer, query string, untilDA1 bool) ([]byte, error) {
+	queryMu.Lock()
+	defer queryMu.Unlock()
+	if err := ctx.Err(); err != nil {
+		return nil, err // e.g. expired while waiting for an earlier query
+	}
+
+	oldState, err := term.MakeRaw(int(os.Stdin.Fd()))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrNotInteractive, err)
+	}
+	defer term.Restore(int(os.Stdin.Fd()), oldState)
+
+	// drop the leftovers of earlier queries (e.g. an answer that arrived after its timeout)
+	buf := make([]byte, 256)
+	for {
+		if n, err := readStdinTimeout(buf, 0); err != nil || n == 0 {
+			break
+		}
+	}
+
+	if untilDA1 {
+		query += "\x1b[c"
+	}
+	if _, err := io.WriteString(w, query); err != nil {
+		return nil, err
+	}
+	return readResponse(ctx, readStdinTimeout, QUERY_TIMEOUT, untilDA1)
+}
+
+// queryPollInterval is how often a query waiting for its response checks whether its context was canceled
+const queryPollInterval = 20 * time.Millisecond
+
+// readResponse reads the terminal's response to a query with read, until it is complete (see
+// queryTerminal), timeout expires or ctx is done (returning its error)
+func readResponse(ctx context.Context, read func(p []byte, timeout time.Duration) (int, error), timeout time.Duration, untilDA1 bool) ([]byte, error) {
+	deadline := time.Now().Add(timeout)
+	ctxDeadline := false
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline, ctxDeadline = d, true
+	}
+	buf := make([]byte, 256)
+	var in []byte
+	for {
+		if resp, ok := completeResponse(in, untilDA1); ok {
+			if len(resp) == 0 {
+				return nil, ErrEmptyResponse
+			}
+			return resp, nil
+		}
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		wait := time.Until(deadline)
+		polling := ctx.Done() != nil && wait > queryPollInterval
+		if polling {
+			wait = queryPollInterval // a context can be canceled before its deadline
+		}
+		n, err := read(buf, wait)
+		if polling && errors.Is(err, ErrQueryTimeout) {
+			continue
+		}
+		if err != nil {
+			break
+		}
+		in = append(in, buf[:n]...)
+	}
+	if ctx.Err() != nil || ctxDeadline {
+		<-ctx.Done() // the wait may end just before the context's own timer
+		return nil, ctx.Err()
+	}
+	if len(in) == 0 {
+		return nil, ErrQueryTimeout
+	}
+	return in, nil // incomplete, let the caller try to parse it
+}
+
+// completeResponse returns the response in the input read so far, and whether it is complete: the
+// input before the DA1 answer, or else up to the end of the first escape sequence
+func completeResponse(in []byte, untilDA1 bool) ([]byte, bool) {
+	for i := 0; i < len(in); {
+		if in[i] != '\x1b' {
+			i++ // e.g. a key pressed during the query
+			continue
+		}
+		end := sequenceEnd(in[i:])
+		if end < 0 {
+			return nil, false
+		}
+		if !untilDA1 {
+			return in[:i+end], true
+		}
+		if seq := in[i : i+end]; bytes.HasPrefix(seq, []byte("\x1b[?")) && seq[len(seq)-1] == 'c' {
+			return in[:i], true
+		}
+		i += end
+	}
+	return nil, false
+}
+
+// sequenceEnd returns the length of the escape sequence at the start of in, or -1 if it is incomplete:
+// CSI sequences end with a final byte, OSC ones with BEL or ST, and DCS, APC, PM and SOS ones with ST
+func sequenceEnd(in []byte) int {
+	if len(in) < 2 {
+		return -1
+	}
+	switch in[1] {
+	case '[':
+		for i := 2; i < len(in); i++ {
+			if in[i] >= 0x40 && in[i] <= 0x7e {
+				return i + 1
+			}
+		}
+	case ']', 'P', '_', '^', 'X':
+		for i := 2; i < len(in); i++ {
+			if in[i] == '\a' && in[1] == ']' {
+				return i + 1
+			}
+			if in[i] == '\x1b' && i+1 < len(in) && in[i+1] == '\\' {
+				return i + 2
+			}
+		}
+	default:
+		return 2
+	}
+	return -1
+}
+
+// terminalNameResult is the answer to the XTVERSION query, or why there is none
+type terminalNameResult struct {
+	name string
+	err  error
+}
+
+var (
+	terminalNameMu sync.Mutex
+	terminalName   *cachedDetection[terminalNameResult] // nil until queried
+)
+
+// queryTerminalName asks the terminal for its name and version (XTVERSION), e.g. "iTerm2 3.5.0".
+// The answer (or the lack of one) is cached, see SetDetectionCacheTTL, unless ctx ended the query.
+func queryTerminalName(ctx context.Context) (string, error) {
+	terminalNameMu.Lock()
+	defer terminalNameMu.Unlock()
+	if terminalName != nil && terminalName.fresh() {
+		return terminalName.value.name, terminalName.value.err
+	}
+	var result terminalNameResult
+	resp, err := queryTerminal(ctx, "\x1b[>0q")
+	if ctx.Err() != nil {
+		return "", ctx.Err()
+	}
+	if err != nil {
+		result.err = err
+	} else {
+		result.name, result.err = parseXTVERSION(resp)
+	}
+	cached := newCachedDetection(result)
+	terminalName = &cached
+	return result.name, result.err
+}
+
+// parseXTVERSION parses a `DCS > | name ST` response
+func parseXTVERSION(in []byte) (string, error) {
+	start := bytes.Index(in, []byte("\x1bP>|"))
+	if start < 0 {
+		return "", fmt.Errorf("invalid XTVERSION response: %q", in)
+	}
+	in = in[start+4:]
+	if end := bytes.Index(in, []byte("\x1b\\")); end >= 0 {
+		in = in[:end]
+	}
+	return string(in), nil
+}
@@ -0,0 +1,80 @@
+package termimg
+
+import (
+	"fmt"
+	"image"
+	"strings"
+)
+
+// Wrap splits images wider than the terminal into horizontal strips that each fit the terminal
+// width, and renders them stacked vertically (each as its own image), so very wide images
+// (e.g. panoramas) can be viewed at full size instead of being scaled down to illegibility
+func (ti *TermImg) Wrap(wrap bool) *TermImg {
+	ti.wrap = wrap
+	ti.invalidate()
+	return ti
+}
+
+// stripWidth returns the width in pixels of the strips the image is split into, or 0 if it isn't
+func (ti *TermImg) stripWidth() int {
+	if !ti.wrap {
+		return 0
+	}
+	cols, _, err := terminalSize()
+	if err != nil || cols <= 0 {
+		return 0
+	}
+	fontWidth, _, err := ti.fontSize()
+	if err != nil {
+		return 0
+	}
+	if width := cols * fontWidth; ti.source().Bounds().Dx() > width {
+		return width
+	}
+	return 0
+}
+
+// renderStrips renders each strip of the image below the previous one
+func (ti *TermImg) renderStrips(stripWidth int) (string, error) {
+	if ti.encoded != "" {
+		return ti.encoded, nil
+	}
+	img := ti.processImage()
+	b := img.Bounds()
+	_, fontHeight, err := ti.fontSize()
+	if err != nil {
+		return "", err
+	}
+
+	var sb strings.Builder
+	for x := b.Min.X; x < b.Max.X; x += stripWidth {
+		if x > b.Min.X {
+			if ti.protocol == ITerm2 {
+				// iTerm2 images don't move the cursor, skip the rows the previous strip occupies
+				sb.WriteString(strings.Repeat("\n", ceilDiv(b.Dy(), fontHeight)))
+			} else {
+				sb.WriteString("\n")
+			}
+		}
+		strip := cropImage(img, image.Rect(x, b.Min.Y, x+stripWidth, b.Max.Y))
+		sti := &TermImg{
+			protocol:      ti.protocol,
+			img:           &strip,
+			layer:         ti.layer,
+			blockRes:      ti.blockRes,
+			chunkSize:     ti.chunkSize,
+			kittyChunk:    ti.kittyChunk,
+			kittyQuiet:    ti.kittyQuiet,
+			fontWidth:     ti.fontWidth,
+			fontHeight:    ti.fontHeight,
+			maxLineLength: ti.maxLineLength,
+		}
+		out, err := sti.Render()
+		if err != nil {
+			return "", fmt.Errorf("failed to render strip at x=%d: %w", x, err)
+		}
+		sb.WriteString(out)
+	}
+	ti.encoded = sb.String()
+	return ti.encoded, nil
+}